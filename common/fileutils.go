@@ -149,26 +149,40 @@ func WriteStringToFile(content string, targetFile string, mode os.FileMode, isAp
 }
 
 
+// ParseHostFile: host => ip, the ip of the last line of host is kept; use ParseHostFileMulti to get all ip of host
 func ParseHostFile(hostFile string) (map[string]string, error) {
-	info := make(map[string]string)
+	_, info, err := parseHostFile(hostFile)
+	return info, err
+}
+
+// ParseHostFileMulti: host => ip list; all aliases of each line are kept, and one host may have several ip(v4 or v6)
+func ParseHostFileMulti(hostFile string) (map[string][]string, error) {
+	info, _, err := parseHostFile(hostFile)
+	return info, err
+}
+
+// parseHostFile: host => ip list without duplicate ip, and host => ip of the last line
+func parseHostFile(hostFile string) (map[string][]string, map[string]string, error) {
+	info := make(map[string][]string)
+	lastInfo := make(map[string]string)
 	lines, err := FileReadLines(hostFile)
 	if err != nil {
-		return info, err
+		return info, lastInfo, err
 	}
 	for _, line := range lines {
-		if strings.Index(line, "#") != 0 {
-			contentList := strings.Split(strings.TrimSpace(strings.Replace(line, "\t", " ", -1)), " ")
-			if len(contentList) > 0 {
-				ip := contentList[0]
-				for _, host := range contentList[1:] {
-					if len(host) > 0 {
-						info[host] = ip
-						break
-					}
-				}
-			}
+		if index := strings.Index(line, "#"); index > -1 {
+			line = line[:index]
+		}
+		contentList := strings.Fields(line)
+		if len(contentList) < 2 {
+			continue
+		}
+		ip := contentList[0]
+		for _, host := range contentList[1:] {
+			info[host] = RemoveDuplicateContent(append(info[host], ip))
+			lastInfo[host] = ip
 		}
 	}
 	logger.Infof("get %d record from host file\n", len(info))
-	return info, nil
+	return info, lastInfo, nil
 }
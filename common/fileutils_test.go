@@ -0,0 +1,37 @@
+package common
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseHostFile(t *testing.T) {
+	hostFile := filepath.Join(t.TempDir(), "hosts")
+	content := "# comment\n1.1.1.1 a.lan b.lan # alias\n2.2.2.2\ta.lan\n::1 a.lan\n\n1.1.1.1 a.lan\n3.3.3.3\nc.lan\n"
+	if err := ioutil.WriteFile(hostFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	
+	info, err := ParseHostFile(hostFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ip of the last line of host
+	if expected := map[string]string{"a.lan": "1.1.1.1", "b.lan": "1.1.1.1"}; !reflect.DeepEqual(info, expected) {
+		t.Errorf("host record is %v, expected %v", info, expected)
+	}
+	
+	multiInfo, err := ParseHostFileMulti(hostFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string][]string{"a.lan": {"1.1.1.1", "2.2.2.2", "::1"}, "b.lan": {"1.1.1.1"}}; !reflect.DeepEqual(multiInfo, expected) {
+		t.Errorf("host record is %v, expected %v", multiInfo, expected)
+	}
+	
+	if _, err := ParseHostFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error of missing host file")
+	}
+}
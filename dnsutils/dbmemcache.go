@@ -0,0 +1,420 @@
+package dnsutils
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EvictionPolicy int
+
+const (
+	// evict the least recently used entry
+	EvictLRU EvictionPolicy = iota
+	// evict the least frequently used entry, and the least recently used one of the same frequency
+	EvictLFU
+)
+
+var (
+	BoundedMemCacheShardCount    = 16
+	BoundedMemCacheSweepInterval = time.Minute
+)
+
+// memory used by each entry besides key and value
+const memCacheEntryOverhead = 64
+
+type BoundedMemCacheOptions struct {
+	// max entry count of each bucket, 0 means no limit; budget is split to shards, see newBoundedMemCacheStore
+	MaxEntries int
+	// max bytes of key and value of each bucket, 0 means no limit; value larger than budget of one shard is rejected
+	MaxBytes int64
+	// default is EvictLRU
+	Policy EvictionPolicy
+	// default is BoundedMemCacheShardCount
+	ShardCount int
+	// interval of removing expired entry, default is BoundedMemCacheSweepInterval
+	SweepInterval time.Duration
+}
+
+type BoundedMemCacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+}
+
+type memCacheEntry struct {
+	key    string
+	value  string
+	expire time.Time
+	freq   uint64
+	seq    uint64
+	index  int
+}
+
+func (entry *memCacheEntry) size() int64 {
+	return int64(len(entry.key) + len(entry.value) + memCacheEntryOverhead)
+}
+
+func (entry *memCacheEntry) isExpired(now time.Time) bool {
+	return !entry.expire.IsZero() && entry.expire.Before(now)
+}
+
+// min heap of entry, the first one is evicted first
+type memCacheHeap struct {
+	policy  EvictionPolicy
+	entries []*memCacheEntry
+}
+
+func (h *memCacheHeap) Len() int { return len(h.entries) }
+
+func (h *memCacheHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if h.policy == EvictLFU && a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.seq < b.seq
+}
+
+func (h *memCacheHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *memCacheHeap) Push(x interface{}) {
+	entry := x.(*memCacheEntry)
+	entry.index = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *memCacheHeap) Pop() interface{} {
+	n := len(h.entries)
+	entry := h.entries[n-1]
+	h.entries[n-1] = nil
+	h.entries = h.entries[:n-1]
+	entry.index = -1
+	return entry
+}
+
+type memCacheShard struct {
+	entryMap   map[string]*memCacheEntry
+	evictHeap  *memCacheHeap
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+	seq        uint64
+	lock       sync.Mutex
+}
+
+func (shard *memCacheShard) remove(entry *memCacheEntry) {
+	heap.Remove(shard.evictHeap, entry.index)
+	delete(shard.entryMap, entry.key)
+	shard.bytes -= entry.size()
+}
+
+func (shard *memCacheShard) isFull() bool {
+	return (shard.maxEntries > 0 && len(shard.entryMap) > shard.maxEntries) || (shard.maxBytes > 0 && shard.bytes > shard.maxBytes)
+}
+
+func (shard *memCacheShard) clear() {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.entryMap = make(map[string]*memCacheEntry)
+	shard.evictHeap.entries = nil
+	shard.bytes = 0
+}
+
+// shards and counters of BoundedMemCache or one of its buckets
+type boundedMemCacheStore struct {
+	// counters are the first fields, so that they are 64-bit aligned for atomic
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+	shardList   []*memCacheShard
+}
+
+// options, buckets and sweeper shared by BoundedMemCache and its buckets
+type boundedMemCacheShared struct {
+	options   BoundedMemCacheOptions
+	bucketMap *sync.Map
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+// BoundedMemCache: sharded in-memory DBCache with entry/byte budget and LRU or LFU eviction;
+// each bucket has its own shards and budget, so that entry of one bucket is never evicted by another bucket
+type BoundedMemCache struct {
+	*boundedMemCacheStore
+	shared *boundedMemCacheShared
+	name   string
+}
+
+func NewBoundedMemCache(options BoundedMemCacheOptions) *BoundedMemCache {
+	if options.ShardCount <= 0 {
+		options.ShardCount = BoundedMemCacheShardCount
+	}
+	if options.SweepInterval <= 0 {
+		options.SweepInterval = BoundedMemCacheSweepInterval
+	}
+	
+	shared := &boundedMemCacheShared{options: options, bucketMap: &sync.Map{}, stopChan: make(chan struct{})}
+	db := &BoundedMemCache{boundedMemCacheStore: newBoundedMemCacheStore(options), shared: shared}
+	shared.bucketMap.Store("", db)
+	go shared.loopSweep()
+	return db
+}
+
+// budget is split to each shard evenly, 0 means no limit; since shard of key is decided by hash, a shard may evict
+// entry before the whole budget is used if keys are not spread evenly, so the budget should leave room for it,
+// or use less ShardCount for small budget
+func newBoundedMemCacheStore(options BoundedMemCacheOptions) *boundedMemCacheStore {
+	store := &boundedMemCacheStore{}
+	shardCount := options.ShardCount
+	for i := 0; i < shardCount; i++ {
+		shard := &memCacheShard{
+			entryMap:  make(map[string]*memCacheEntry),
+			evictHeap: &memCacheHeap{policy: options.Policy},
+			lock:      sync.Mutex{},
+		}
+		if options.MaxEntries > 0 {
+			shard.maxEntries = (options.MaxEntries + shardCount - 1) / shardCount
+		}
+		if options.MaxBytes > 0 {
+			shard.maxBytes = (options.MaxBytes + int64(shardCount) - 1) / int64(shardCount)
+		}
+		store.shardList = append(store.shardList, shard)
+	}
+	return store
+}
+
+func (db *boundedMemCacheStore) getShard(key string) *memCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return db.shardList[h.Sum32()%uint32(len(db.shardList))]
+}
+
+func (db *BoundedMemCache) Get(key string) (string, error) {
+	shard := db.getShard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	
+	entry, exists := shard.entryMap[key]
+	if exists && entry.isExpired(time.Now()) {
+		shard.remove(entry)
+		atomic.AddUint64(&db.expirations, 1)
+		exists = false
+	}
+	if !exists {
+		atomic.AddUint64(&db.misses, 1)
+		return "", fmt.Errorf("record not found: %s", key)
+	}
+	
+	atomic.AddUint64(&db.hits, 1)
+	shard.seq++
+	entry.seq = shard.seq
+	entry.freq++
+	heap.Fix(shard.evictHeap, entry.index)
+	return entry.value, nil
+}
+
+func (db *BoundedMemCache) Set(key string, value string) error {
+	return db.SetWithTTL(key, value, 0)
+}
+
+func (db *BoundedMemCache) SetWithTTL(key string, value string, ttl time.Duration) error {
+	shard := db.getShard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	
+	// existing entry is kept if the new value is too large
+	entry := &memCacheEntry{key: key, value: value}
+	if shard.maxBytes > 0 && entry.size() > shard.maxBytes {
+		return fmt.Errorf("value of key[%s] is too large: %d bytes", key, entry.size())
+	}
+	// frequency of new entry is 1, so that it is not always evicted first by LFU
+	entry.freq = 1
+	if oldEntry, exists := shard.entryMap[key]; exists {
+		entry.freq = oldEntry.freq + 1
+		shard.remove(oldEntry)
+	}
+	if ttl > 0 {
+		entry.expire = time.Now().Add(ttl)
+	}
+	shard.seq++
+	entry.seq = shard.seq
+	heap.Push(shard.evictHeap, entry)
+	shard.entryMap[key] = entry
+	shard.bytes += entry.size()
+	
+	for shard.isFull() {
+		shard.remove(shard.evictHeap.entries[0])
+		atomic.AddUint64(&db.evictions, 1)
+	}
+	return nil
+}
+
+func (db *BoundedMemCache) Delete(key string) error {
+	shard := db.getShard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	
+	if entry, exists := shard.entryMap[key]; exists {
+		shard.remove(entry)
+	}
+	return nil
+}
+
+func (db *BoundedMemCache) BatchDelete(keyList []string) error {
+	for _, key := range keyList {
+		db.Delete(key)
+	}
+	return nil
+}
+
+func (db *BoundedMemCache) BatchSet(record map[string]string) error {
+	for key, value := range record {
+		if err := db.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan does not change recency or frequency of entry
+func (db *BoundedMemCache) Scan(prefix string, fn func(key, value string) bool) error {
+	var itemList []dbCacheItem
+	now := time.Now()
+	for _, shard := range db.shardList {
+		shard.lock.Lock()
+		for key, entry := range shard.entryMap {
+			if strings.HasPrefix(key, prefix) && !entry.isExpired(now) {
+				itemList = append(itemList, dbCacheItem{key: key, value: entry.value})
+			}
+		}
+		shard.lock.Unlock()
+	}
+	scanItemList(itemList, fn)
+	return nil
+}
+
+func (db *BoundedMemCache) Len() (int, error) {
+	count := 0
+	err := db.Scan("", func(key, value string) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// Bucket has its own shards and the same budget as db, and shares sweeper with db;
+// budget of bucket is decided when the bucket is created by Bucket or UnboundedBucket first
+func (db *BoundedMemCache) Bucket(name string) DBCache {
+	return db.getBucket(name, db.shared.options)
+}
+
+// UnboundedBucket has no budget, so that its entry is never evicted, but still removed after ttl;
+// it is used for record which can not be fetched again, like host, zone and dynamic record of dns server
+func (db *BoundedMemCache) UnboundedBucket(name string) DBCache {
+	options := db.shared.options
+	options.MaxEntries = 0
+	options.MaxBytes = 0
+	return db.getBucket(name, options)
+}
+
+func (db *BoundedMemCache) getBucket(name string, options BoundedMemCacheOptions) *BoundedMemCache {
+	name = getBucketName(db.name, name)
+	if bucket, exists := db.shared.bucketMap.Load(name); exists {
+		return bucket.(*BoundedMemCache)
+	}
+	bucket, _ := db.shared.bucketMap.LoadOrStore(name, &BoundedMemCache{
+		boundedMemCacheStore: newBoundedMemCacheStore(options),
+		shared:               db.shared,
+		name:                 name,
+	})
+	return bucket.(*BoundedMemCache)
+}
+
+// Clear removes entry of db, but not entry of its buckets
+func (db *BoundedMemCache) Clear() error {
+	for _, shard := range db.shardList {
+		shard.clear()
+	}
+	return nil
+}
+
+// Close stops sweeper and removes all entry, including entry of buckets
+func (db *BoundedMemCache) Close() {
+	if len(db.name) > 0 {
+		return
+	}
+	db.shared.stopOnce.Do(func() {
+		close(db.shared.stopChan)
+	})
+	db.shared.rangeBucket(func(bucket *BoundedMemCache) {
+		bucket.Clear()
+	})
+}
+
+// rangeBucket calls fn with the root cache and each bucket
+func (shared *boundedMemCacheShared) rangeBucket(fn func(bucket *BoundedMemCache)) {
+	shared.bucketMap.Range(func(name interface{}, bucket interface{}) bool {
+		fn(bucket.(*BoundedMemCache))
+		return true
+	})
+}
+
+// sweep removes expired entry of all shard
+func (db *boundedMemCacheStore) sweep() {
+	now := time.Now()
+	for _, shard := range db.shardList {
+		shard.lock.Lock()
+		for _, entry := range shard.entryMap {
+			if entry.isExpired(now) {
+				shard.remove(entry)
+				atomic.AddUint64(&db.expirations, 1)
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
+
+func (shared *boundedMemCacheShared) loopSweep() {
+	ticker := time.NewTicker(shared.options.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shared.stopChan:
+			return
+		case <-ticker.C:
+			shared.rangeBucket(func(bucket *BoundedMemCache) {
+				bucket.sweep()
+			})
+		}
+	}
+}
+
+// Stats of the root cache and all buckets
+func (db *BoundedMemCache) Stats() BoundedMemCacheStats {
+	stats := BoundedMemCacheStats{}
+	db.shared.rangeBucket(func(bucket *BoundedMemCache) {
+		stats.Hits += atomic.LoadUint64(&bucket.hits)
+		stats.Misses += atomic.LoadUint64(&bucket.misses)
+		stats.Evictions += atomic.LoadUint64(&bucket.evictions)
+		stats.Expirations += atomic.LoadUint64(&bucket.expirations)
+		for _, shard := range bucket.shardList {
+			shard.lock.Lock()
+			stats.Entries += len(shard.entryMap)
+			stats.Bytes += shard.bytes
+			shard.lock.Unlock()
+		}
+	})
+	return stats
+}
@@ -0,0 +1,200 @@
+package dnsutils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBoundedMemCacheBucket(t *testing.T) {
+	db := NewBoundedMemCache(BoundedMemCacheOptions{MaxEntries: 2, ShardCount: 1})
+	defer db.Close()
+	hostCache := db.UnboundedBucket(DNSHostBucket)
+	answerCache := db.Bucket(DNSAnswerBucket)
+	for i := 0; i < 5; i++ {
+		if err := hostCache.Set(fmt.Sprint(i), "host"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := answerCache.Set(fmt.Sprint(i), "answer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Set("root", "root")
+	
+	testCases := []struct {
+		name     string
+		db       DBCache
+		expected int
+	}{
+		{name: "unbounded bucket is not evicted", db: hostCache, expected: 5},
+		{name: "bucket has its own budget", db: answerCache, expected: 2},
+		{name: "root is not evicted by bucket", db: db, expected: 1},
+		{name: "bucket is created once", db: db.Bucket(DNSHostBucket), expected: 5},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if count, err := testCase.db.Len(); err != nil || count != testCase.expected {
+				t.Errorf("len is %d, expected %d, error is %v", count, testCase.expected, err)
+			}
+		})
+	}
+	if stats := db.Stats(); stats.Entries != 8 || stats.Evictions != 3 {
+		t.Errorf("stats is %+v", stats)
+	}
+}
+
+func TestBoundedMemCacheServerBucket(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{DBCache: NewBoundedMemCache(BoundedMemCacheOptions{MaxEntries: 2, ShardCount: 1})})
+	testCases := []struct {
+		name     string
+		db       DBCache
+		expected int
+	}{
+		{name: DNSHostBucket, db: ds.hostCache, expected: 5},
+		{name: DNSZoneBucket, db: ds.zoneCache, expected: 5},
+		{name: DNSDynamicBucket, db: ds.dynamicCache, expected: 5},
+		{name: DNSAnswerBucket, db: ds.answerCache, expected: 2},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				testCase.db.Set(fmt.Sprint(i), testCase.name)
+			}
+			if count, err := testCase.db.Len(); err != nil || count != testCase.expected {
+				t.Errorf("len is %d, expected %d, error is %v", count, testCase.expected, err)
+			}
+		})
+	}
+}
+
+// getTestMemCacheKeyList returns keys in db, sorted
+func getTestMemCacheKeyList(t *testing.T, db DBCache) string {
+	var keyList []string
+	if err := db.Scan("", func(key, value string) bool {
+		keyList = append(keyList, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keyList, ",")
+}
+
+func TestBoundedMemCacheEviction(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policy   EvictionPolicy
+		expected string
+	}{
+		// a is used recently, so b is evicted
+		{name: "lru", policy: EvictLRU, expected: "a,c,d"},
+		// b, c and d are used less than a, and b is used the earliest
+		{name: "lfu", policy: EvictLFU, expected: "a,c,d"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			db := NewBoundedMemCache(BoundedMemCacheOptions{MaxEntries: 3, Policy: testCase.policy, ShardCount: 1})
+			defer db.Close()
+			for _, key := range []string{"a", "b", "c"} {
+				db.Set(key, key)
+			}
+			db.Get("a")
+			db.Set("d", "d")
+			if keyList := getTestMemCacheKeyList(t, db); keyList != testCase.expected {
+				t.Errorf("keys are %s, expected %s", keyList, testCase.expected)
+			}
+		})
+	}
+	
+	// a is used often but long ago: lru evicts a, lfu evicts b which is used the least and earlier than d
+	testCases = []struct {
+		name     string
+		policy   EvictionPolicy
+		expected string
+	}{
+		{name: "lru frequent", policy: EvictLRU, expected: "b,c,d"},
+		{name: "lfu frequent", policy: EvictLFU, expected: "a,c,d"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			db := NewBoundedMemCache(BoundedMemCacheOptions{MaxEntries: 3, Policy: testCase.policy, ShardCount: 1})
+			defer db.Close()
+			db.Set("a", "a")
+			for i := 0; i < 3; i++ {
+				db.Get("a")
+			}
+			db.Set("b", "b")
+			db.Set("c", "c")
+			db.Get("c")
+			db.Set("d", "d")
+			if keyList := getTestMemCacheKeyList(t, db); keyList != testCase.expected {
+				t.Errorf("keys are %s, expected %s", keyList, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestBoundedMemCacheMaxBytes(t *testing.T) {
+	entrySize := int64(1 + 10 + memCacheEntryOverhead)
+	db := NewBoundedMemCache(BoundedMemCacheOptions{MaxBytes: entrySize * 2, ShardCount: 1})
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Set(key, strings.Repeat(key, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keyList := getTestMemCacheKeyList(t, db); keyList != "b,c" {
+		t.Errorf("keys are %s, expected b,c", keyList)
+	}
+	if stats := db.Stats(); stats.Bytes != entrySize*2 || stats.Evictions != 1 {
+		t.Errorf("stats is %+v", stats)
+	}
+	
+	// value larger than budget is rejected, and existing value is kept
+	if err := db.Set("c", strings.Repeat("c", int(entrySize*2))); err == nil {
+		t.Error("expected error of too large value")
+	}
+	if value, err := db.Get("c"); err != nil || value != strings.Repeat("c", 10) {
+		t.Errorf("value of c is %q, error is %v", value, err)
+	}
+	if stats := db.Stats(); stats.Entries != 2 || stats.Bytes != entrySize*2 {
+		t.Errorf("stats is %+v", stats)
+	}
+}
+
+func TestBoundedMemCacheSweep(t *testing.T) {
+	db := NewBoundedMemCache(BoundedMemCacheOptions{ShardCount: 2, SweepInterval: 10 * time.Millisecond})
+	defer db.Close()
+	bucket := db.Bucket(DNSAnswerBucket).(*BoundedMemCache)
+	db.SetWithTTL("a", "a", 20*time.Millisecond)
+	bucket.SetWithTTL("b", "b", 20*time.Millisecond)
+	db.Set("c", "c")
+	
+	// expired entry is removed by sweeper without being read
+	for i := 0; i < 100 && db.Stats().Entries > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := db.Stats(); stats.Entries != 1 || stats.Expirations != 2 || stats.Misses != 0 {
+		t.Errorf("stats is %+v", stats)
+	}
+}
+
+func TestBoundedMemCacheStats(t *testing.T) {
+	db := NewBoundedMemCache(BoundedMemCacheOptions{MaxEntries: 2, ShardCount: 1})
+	defer db.Close()
+	db.Set("a", "a")
+	db.Set("b", "b")
+	db.SetWithTTL("c", "c", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	
+	for _, key := range []string{"a", "b", "b", "c", "d"} {
+		db.Get(key)
+	}
+	expected := BoundedMemCacheStats{Hits: 2, Misses: 3, Evictions: 1, Expirations: 1, Entries: 1,
+		Bytes: int64(2 + memCacheEntryOverhead)}
+	if stats := db.Stats(); stats != expected {
+		t.Errorf("stats is %+v, expected %+v", stats, expected)
+	}
+}
@@ -0,0 +1,494 @@
+package dnsutils
+
+// ref: https://redis.io/docs/reference/protocol-spec/, RESP
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	RedisCacheDefaultPrefix = "dnsutils"
+	RedisCacheDialTimeout   = 3 * time.Second
+	RedisCacheIOTimeout     = 3 * time.Second
+	RedisCacheMaxIdleConn   = 4
+	// retry of command when connection is broken, each retry dials a new connection
+	RedisCacheMaxRetry      = 2
+	RedisCacheRetryInterval = 100 * time.Millisecond
+	// max command count of one pipeline, and COUNT of SCAN
+	RedisCacheBatchSize = 500
+)
+
+// separator of prefix, bucket name and key: `prefix:bucket:key`, key of root is `prefix::key`;
+// redisCacheKeySep and redisCacheEscape in bucket name are escaped, so that key of bucket `a:b` is not in bucket `a`
+const (
+	redisCacheKeySep = ":"
+	redisCacheEscape = `\`
+)
+
+type RedisCacheOptions struct {
+	// host:port of redis server
+	Addr string
+	// password of AUTH, empty means no AUTH
+	Password string
+	// database of SELECT
+	DB int
+	// prefix of all key, so that one redis server can be shared by different cache; default is RedisCacheDefaultPrefix
+	Prefix string
+	// default is RedisCacheDialTimeout and RedisCacheIOTimeout
+	DialTimeout time.Duration
+	IOTimeout   time.Duration
+	// default is RedisCacheMaxIdleConn
+	MaxIdleConn int
+	// default is RedisCacheMaxRetry, negative means no retry
+	MaxRetry int
+}
+
+// error reply of redis server, connection is still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func (c *redisConn) writeCommand(args []string) {
+	c.writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		c.writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		c.writer.WriteString(arg)
+		c.writer.WriteString("\r\n")
+	}
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("invalid reply line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply: string for simple string and bulk string, int64 for integer, []interface{} for array,
+// nil for null, and redisError for error reply
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		replyList := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			reply, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			replyList = append(replyList, reply)
+		}
+		return replyList, nil
+	}
+	return nil, fmt.Errorf("unknown reply type: %q", line)
+}
+
+// keep idle connections of redis server; broken connection is closed instead of put back
+type redisConnPool struct {
+	options RedisCacheOptions
+	idle    []*redisConn
+	closed  bool
+	lock    sync.Mutex
+}
+
+func (pool *redisConnPool) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", pool.options.Addr, pool.options.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	var initList [][]string
+	if len(pool.options.Password) > 0 {
+		initList = append(initList, []string{"AUTH", pool.options.Password})
+	}
+	if pool.options.DB != 0 {
+		initList = append(initList, []string{"SELECT", strconv.Itoa(pool.options.DB)})
+	}
+	if len(initList) > 0 {
+		replyList, err := pool.pipelineWithConn(c, initList)
+		if err == nil {
+			for _, reply := range replyList {
+				if e, isErr := reply.(redisError); isErr {
+					err = e
+					break
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("fail to init connection of redis server[%s]: %s", pool.options.Addr, err)
+		}
+	}
+	return c, nil
+}
+
+func (pool *redisConnPool) get() (*redisConn, error) {
+	pool.lock.Lock()
+	if pool.closed {
+		pool.lock.Unlock()
+		return nil, fmt.Errorf("redis cache is closed")
+	}
+	if len(pool.idle) > 0 {
+		c := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		pool.lock.Unlock()
+		return c, nil
+	}
+	pool.lock.Unlock()
+	return pool.dial()
+}
+
+func (pool *redisConnPool) put(c *redisConn) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	
+	if pool.closed || len(pool.idle) >= pool.options.MaxIdleConn {
+		c.conn.Close()
+		return
+	}
+	pool.idle = append(pool.idle, c)
+}
+
+func (pool *redisConnPool) Close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	
+	pool.closed = true
+	for _, c := range pool.idle {
+		c.conn.Close()
+	}
+	pool.idle = nil
+}
+
+// pipelineWithConn writes all command, then reads reply of each command
+func (pool *redisConnPool) pipelineWithConn(c *redisConn, cmdList [][]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(pool.options.IOTimeout))
+	for _, args := range cmdList {
+		c.writeCommand(args)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	replyList := make([]interface{}, 0, len(cmdList))
+	for range cmdList {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		replyList = append(replyList, reply)
+	}
+	return replyList, nil
+}
+
+// pipeline retries with new connection if connection is broken, all command of DBCache can be retried safely
+func (pool *redisConnPool) pipeline(cmdList [][]string) ([]interface{}, error) {
+	var lastErr error
+	for i := 0; i <= pool.options.MaxRetry; i++ {
+		if i > 0 {
+			time.Sleep(RedisCacheRetryInterval * time.Duration(i))
+		}
+		c, err := pool.get()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		replyList, err := pool.pipelineWithConn(c, cmdList)
+		if err != nil {
+			c.conn.Close()
+			lastErr = err
+			continue
+		}
+		pool.put(c)
+		return replyList, nil
+	}
+	return nil, fmt.Errorf("fail to run command on redis server[%s]: %s", pool.options.Addr, lastErr)
+}
+
+func (pool *redisConnPool) do(args ...string) (interface{}, error) {
+	replyList, err := pool.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, isErr := replyList[0].(redisError); isErr {
+		return nil, e
+	}
+	return replyList[0], nil
+}
+
+// run command in pipelines of RedisCacheBatchSize, and return the first error reply
+func (pool *redisConnPool) batch(cmdList [][]string) error {
+	for start := 0; start < len(cmdList); start += RedisCacheBatchSize {
+		end := start + RedisCacheBatchSize
+		if end > len(cmdList) {
+			end = len(cmdList)
+		}
+		replyList, err := pool.pipeline(cmdList[start:end])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replyList {
+			if e, isErr := reply.(redisError); isErr {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// RedisCache: DBCache of redis server or other server of RESP protocol, which can be shared by multi dns server;
+// ttl of value is the native ttl of redis key
+type RedisCache struct {
+	pool *redisConnPool
+	// `prefix:bucket:`, see getRedisKeyPrefix
+	keyPrefix string
+	bucket    string
+}
+
+// NewRedisCache does not connect redis server until the first command, use Ping to check the connection
+func NewRedisCache(options RedisCacheOptions) *RedisCache {
+	if len(options.Prefix) == 0 {
+		options.Prefix = RedisCacheDefaultPrefix
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = RedisCacheDialTimeout
+	}
+	if options.IOTimeout <= 0 {
+		options.IOTimeout = RedisCacheIOTimeout
+	}
+	if options.MaxIdleConn <= 0 {
+		options.MaxIdleConn = RedisCacheMaxIdleConn
+	}
+	if options.MaxRetry == 0 {
+		options.MaxRetry = RedisCacheMaxRetry
+	} else if options.MaxRetry < 0 {
+		options.MaxRetry = 0
+	}
+	pool := &redisConnPool{options: options, lock: sync.Mutex{}}
+	return &RedisCache{pool: pool, keyPrefix: getRedisKeyPrefix(options.Prefix, "")}
+}
+
+func getRedisKeyPrefix(prefix, bucket string) string {
+	bucket = strings.ReplaceAll(bucket, redisCacheEscape, redisCacheEscape+redisCacheEscape)
+	bucket = strings.ReplaceAll(bucket, redisCacheKeySep, redisCacheEscape+redisCacheKeySep)
+	return prefix + redisCacheKeySep + bucket + redisCacheKeySep
+}
+
+func (db *RedisCache) Ping() error {
+	_, err := db.pool.do("PING")
+	return err
+}
+
+// glob pattern of SCAN MATCH, special character of prefix is escaped
+func getRedisMatchPattern(prefix string) string {
+	var builder strings.Builder
+	for _, c := range prefix {
+		if strings.ContainsRune(`*?[]\`, c) {
+			builder.WriteRune('\\')
+		}
+		builder.WriteRune(c)
+	}
+	builder.WriteString("*")
+	return builder.String()
+}
+
+func (db *RedisCache) Get(key string) (string, error) {
+	reply, err := db.pool.do("GET", db.keyPrefix+key)
+	if err != nil {
+		return "", err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("record not found: %s", key)
+	}
+	return value, nil
+}
+
+func (db *RedisCache) Set(key string, value string) error {
+	return db.SetWithTTL(key, value, 0)
+}
+
+func (db *RedisCache) SetWithTTL(key string, value string, ttl time.Duration) error {
+	_, err := db.pool.do(getRedisSetCommand(db.keyPrefix+key, value, ttl)...)
+	return err
+}
+
+func getRedisSetCommand(key, value string, ttl time.Duration) []string {
+	if ttl <= 0 {
+		return []string{"SET", key, value}
+	}
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		ms = 1
+	}
+	return []string{"SET", key, value, "PX", strconv.FormatInt(ms, 10)}
+}
+
+func (db *RedisCache) Delete(key string) error {
+	_, err := db.pool.do("DEL", db.keyPrefix+key)
+	return err
+}
+
+// BatchDelete deletes keys with DEL of RedisCacheBatchSize keys
+func (db *RedisCache) BatchDelete(keyList []string) error {
+	var cmdList [][]string
+	for start := 0; start < len(keyList); start += RedisCacheBatchSize {
+		end := start + RedisCacheBatchSize
+		if end > len(keyList) {
+			end = len(keyList)
+		}
+		args := []string{"DEL"}
+		for _, key := range keyList[start:end] {
+			args = append(args, db.keyPrefix+key)
+		}
+		cmdList = append(cmdList, args)
+	}
+	return db.pool.batch(cmdList)
+}
+
+// BatchSet sets keys in pipeline, which is not atomic
+func (db *RedisCache) BatchSet(record map[string]string) error {
+	cmdList := make([][]string, 0, len(record))
+	for key, value := range record {
+		cmdList = append(cmdList, getRedisSetCommand(db.keyPrefix+key, value, 0))
+	}
+	return db.pool.batch(cmdList)
+}
+
+// scanKey: all key of db which has the prefix, without key prefix of db
+func (db *RedisCache) scanKey(prefix string) ([]string, error) {
+	pattern := getRedisMatchPattern(db.keyPrefix + prefix)
+	keySet := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := db.pool.do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(RedisCacheBatchSize))
+		if err != nil {
+			return nil, err
+		}
+		replyList, ok := reply.([]interface{})
+		if !ok || len(replyList) != 2 {
+			return nil, fmt.Errorf("invalid reply of SCAN: %v", reply)
+		}
+		keyList, _ := replyList[1].([]interface{})
+		for _, key := range keyList {
+			if keyStr, ok := key.(string); ok {
+				// SCAN may return the same key more than once
+				keySet[strings.TrimPrefix(keyStr, db.keyPrefix)] = true
+			}
+		}
+		if cursor, _ = replyList[0].(string); cursor == "0" || len(cursor) == 0 {
+			break
+		}
+	}
+	keyList := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keyList = append(keyList, key)
+	}
+	return keyList, nil
+}
+
+// Scan finds keys with SCAN, then reads values with MGET; key which is expired before MGET is skipped
+func (db *RedisCache) Scan(prefix string, fn func(key, value string) bool) error {
+	keyList, err := db.scanKey(prefix)
+	if err != nil {
+		return err
+	}
+	var itemList []dbCacheItem
+	for start := 0; start < len(keyList); start += RedisCacheBatchSize {
+		end := start + RedisCacheBatchSize
+		if end > len(keyList) {
+			end = len(keyList)
+		}
+		args := []string{"MGET"}
+		for _, key := range keyList[start:end] {
+			args = append(args, db.keyPrefix+key)
+		}
+		reply, err := db.pool.do(args...)
+		if err != nil {
+			return err
+		}
+		valueList, _ := reply.([]interface{})
+		for i, value := range valueList {
+			if valueStr, ok := value.(string); ok && start+i < end {
+				itemList = append(itemList, dbCacheItem{key: keyList[start+i], value: valueStr})
+			}
+		}
+	}
+	scanItemList(itemList, fn)
+	return nil
+}
+
+func (db *RedisCache) Len() (int, error) {
+	keyList, err := db.scanKey("")
+	return len(keyList), err
+}
+
+// Bucket shares connection pool with db
+func (db *RedisCache) Bucket(name string) DBCache {
+	bucket := getBucketName(db.bucket, name)
+	return &RedisCache{
+		pool:      db.pool,
+		keyPrefix: getRedisKeyPrefix(db.pool.options.Prefix, bucket),
+		bucket:    bucket,
+	}
+}
+
+// Clear deletes key of db, but not key of its buckets
+func (db *RedisCache) Clear() error {
+	keyList, err := db.scanKey("")
+	if err != nil {
+		return err
+	}
+	return db.BatchDelete(keyList)
+}
+
+// Close closes idle connection, and key is kept in redis server
+func (db *RedisCache) Close() {
+	if len(db.bucket) > 0 {
+		return
+	}
+	db.pool.Close()
+}
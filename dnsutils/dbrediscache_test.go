@@ -0,0 +1,408 @@
+package dnsutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRedisServer: in-process RESP server with GET, SET, DEL, MGET, SCAN and PING, which is enough for RedisCache
+type testRedisServer struct {
+	listener    net.Listener
+	record      map[string]string
+	expire      map[string]time.Time
+	connList    []net.Conn
+	commandList [][]string
+	// command count of each pipeline, one command which is not pipelined is also counted
+	pipelineList []int
+	lock         sync.Mutex
+}
+
+func newTestRedisServer(t *testing.T) *testRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testRedisServer{listener: listener, record: make(map[string]string), expire: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.connList = append(server.connList, conn)
+			server.lock.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		server.dropConn()
+	})
+	return server
+}
+
+func newTestRedisCache(t *testing.T, server *testRedisServer) *RedisCache {
+	db := NewRedisCache(RedisCacheOptions{Addr: server.listener.Addr().String(), Prefix: "test"})
+	t.Cleanup(db.Close)
+	return db
+}
+
+// dropConn closes all connection of clients
+func (server *testRedisServer) dropConn() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	
+	for _, conn := range server.connList {
+		conn.Close()
+	}
+	server.connList = nil
+}
+
+func (server *testRedisServer) getKeyList() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	
+	var keyList []string
+	for key := range server.record {
+		if server.isAlive(key) {
+			keyList = append(keyList, key)
+		}
+	}
+	sort.Strings(keyList)
+	return keyList
+}
+
+func (server *testRedisServer) getCommandList(name string) [][]string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	
+	var commandList [][]string
+	for _, args := range server.commandList {
+		if args[0] == name {
+			commandList = append(commandList, args)
+		}
+	}
+	return commandList
+}
+
+func (server *testRedisServer) getPipelineList() []int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	
+	return append([]int{}, server.pipelineList...)
+}
+
+func (server *testRedisServer) reset() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	
+	server.commandList = nil
+	server.pipelineList = nil
+}
+
+func readTestRedisCommand(reader *bufio.Reader) ([]string, error) {
+	readLine := func(kind byte) (int, error) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != kind {
+			return 0, fmt.Errorf("invalid line: %q", line)
+		}
+		return strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	}
+	count, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func getTestRedisBulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+// pattern of RedisCache is always escaped prefix with `*`
+func matchTestRedisPattern(pattern, key string) bool {
+	var builder strings.Builder
+	escaped := false
+	for _, c := range strings.TrimSuffix(pattern, "*") {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		builder.WriteRune(c)
+	}
+	return strings.HasPrefix(key, builder.String())
+}
+
+func (server *testRedisServer) isAlive(key string) bool {
+	if expire, exists := server.expire[key]; exists && expire.Before(time.Now()) {
+		delete(server.record, key)
+		delete(server.expire, key)
+	}
+	_, exists := server.record[key]
+	return exists
+}
+
+func (server *testRedisServer) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	pipelineSize := 0
+	for {
+		args, err := readTestRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		server.lock.Lock()
+		server.commandList = append(server.commandList, args)
+		// command which is written in one flush is read without waiting
+		pipelineSize++
+		if reader.Buffered() == 0 {
+			server.pipelineList = append(server.pipelineList, pipelineSize)
+			pipelineSize = 0
+		}
+		reply := server.run(args)
+		server.lock.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+func (server *testRedisServer) run(args []string) string {
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if !server.isAlive(args[1]) {
+			return "$-1\r\n"
+		}
+		return getTestRedisBulk(server.record[args[1]])
+	case "SET":
+		server.record[args[1]] = args[2]
+		delete(server.expire, args[1])
+		if len(args) == 5 && args[3] == "PX" {
+			ms, err := strconv.Atoi(args[4])
+			if err != nil || ms <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			server.expire[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		count := 0
+		for _, key := range args[1:] {
+			if server.isAlive(key) {
+				count++
+			}
+			delete(server.record, key)
+			delete(server.expire, key)
+		}
+		return ":" + strconv.Itoa(count) + "\r\n"
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)-1) + "\r\n"
+		for _, key := range args[1:] {
+			if server.isAlive(key) {
+				reply += getTestRedisBulk(server.record[key])
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "SCAN":
+		// cursor is the index in sorted key list, and COUNT keys are checked in each call
+		var keyList []string
+		for key := range server.record {
+			keyList = append(keyList, key)
+		}
+		sort.Strings(keyList)
+		cursor, _ := strconv.Atoi(args[1])
+		count, _ := strconv.Atoi(args[5])
+		if cursor > len(keyList) {
+			cursor = len(keyList)
+		}
+		end, next := cursor+count, cursor+count
+		if end >= len(keyList) {
+			end, next = len(keyList), 0
+		}
+		var matchList []string
+		for _, key := range keyList[cursor:end] {
+			if matchTestRedisPattern(args[3], key) && server.isAlive(key) {
+				matchList = append(matchList, key)
+			}
+		}
+		reply := "*2\r\n" + getTestRedisBulk(strconv.Itoa(next)) + "*" + strconv.Itoa(len(matchList)) + "\r\n"
+		for _, key := range matchList {
+			reply += getTestRedisBulk(key)
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisCacheConformance(t *testing.T) {
+	testDBCacheConformance(t, func(t *testing.T) DBCache {
+		return newTestRedisCache(t, newTestRedisServer(t))
+	})
+}
+
+func TestRedisCacheBucket(t *testing.T) {
+	server := newTestRedisServer(t)
+	db := newTestRedisCache(t, server)
+	db.Set("a", "root")
+	db.Bucket("b").Set("a", "b")
+	db.Bucket("a").Set("b:c", "a")
+	db.Bucket("a:b").Set("c", "a:b")
+	db.Bucket(`a\`).Set(":c", `a\`)
+	db.Bucket("a").Bucket("b").Set("c", "a/b")
+	expected := []string{`test:a/b:c`, `test:a:b:c`, `test:a\:b:c`, `test:a\\::c`, `test:b:a`, `test::a`}
+	sort.Strings(expected)
+	if keyList := server.getKeyList(); !reflect.DeepEqual(keyList, expected) {
+		t.Errorf("key list is %q, expected %q", keyList, expected)
+	}
+	
+	testCases := []struct {
+		name     string
+		db       DBCache
+		expected []string
+	}{
+		{name: "root", db: db, expected: []string{"a=root"}},
+		{name: "bucket", db: db.Bucket("b"), expected: []string{"a=b"}},
+		{name: "key with separator", db: db.Bucket("a"), expected: []string{"b:c=a"}},
+		{name: "bucket with separator", db: db.Bucket("a:b"), expected: []string{"c=a:b"}},
+		{name: "bucket with escape", db: db.Bucket(`a\`), expected: []string{`:c=a\`}},
+		{name: "sub bucket", db: db.Bucket("a").Bucket("b"), expected: []string{"c=a/b"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if result := getTestScanResult(t, testCase.db, ""); !reflect.DeepEqual(result, testCase.expected) {
+				t.Errorf("result is %v, expected %v", result, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestRedisCacheTTL(t *testing.T) {
+	server := newTestRedisServer(t)
+	db := newTestRedisCache(t, server)
+	testCases := []struct {
+		name     string
+		ttl      time.Duration
+		expected []string
+	}{
+		{name: "no ttl", ttl: 0, expected: []string{"SET", "test::a", "1"}},
+		{name: "millisecond", ttl: 1500 * time.Millisecond, expected: []string{"SET", "test::a", "1", "PX", "1500"}},
+		{name: "less than millisecond", ttl: time.Microsecond, expected: []string{"SET", "test::a", "1", "PX", "1"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server.reset()
+			if err := db.SetWithTTL("a", "1", testCase.ttl); err != nil {
+				t.Fatal(err)
+			}
+			if commandList := server.getCommandList("SET"); !reflect.DeepEqual(commandList, [][]string{testCase.expected}) {
+				t.Errorf("command is %q, expected %q", commandList, testCase.expected)
+			}
+		})
+	}
+	
+	db.SetWithTTL("a", "1", 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	checkTestDBValue(t, db, "a", "", false)
+}
+
+func TestRedisCacheBatch(t *testing.T) {
+	batchSize := RedisCacheBatchSize
+	RedisCacheBatchSize = 10
+	defer func() {
+		RedisCacheBatchSize = batchSize
+	}()
+	server := newTestRedisServer(t)
+	db := newTestRedisCache(t, server)
+	
+	record := make(map[string]string)
+	var keyList []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		record[key] = strconv.Itoa(i)
+		keyList = append(keyList, key)
+	}
+	server.reset()
+	if err := db.BatchSet(record); err != nil {
+		t.Fatal(err)
+	}
+	if pipelineList := server.getPipelineList(); !reflect.DeepEqual(pipelineList, []int{10, 10, 5}) {
+		t.Errorf("pipeline of SET is %v", pipelineList)
+	}
+	
+	// SCAN is called until cursor is 0
+	server.reset()
+	if count, err := db.Len(); err != nil || count != 25 {
+		t.Errorf("len is %d, error is %v", count, err)
+	}
+	if commandList := server.getCommandList("SCAN"); len(commandList) != 3 {
+		t.Errorf("SCAN is called %d times", len(commandList))
+	}
+	result := getTestScanResult(t, db, "key1")
+	if len(result) != 10 || result[0] != "key10=10" || result[9] != "key19=19" {
+		t.Errorf("result is %v", result)
+	}
+	
+	server.reset()
+	if err := db.BatchDelete(keyList[1:]); err != nil {
+		t.Fatal(err)
+	}
+	commandList := server.getCommandList("DEL")
+	if len(commandList) != 3 || len(commandList[0]) != 11 || len(commandList[2]) != 5 {
+		t.Errorf("DEL is %q", commandList)
+	}
+	if pipelineList := server.getPipelineList(); !reflect.DeepEqual(pipelineList, []int{3}) {
+		t.Errorf("pipeline of DEL is %v", pipelineList)
+	}
+	if keyList := server.getKeyList(); !reflect.DeepEqual(keyList, []string{"test::key00"}) {
+		t.Errorf("key list is %v", keyList)
+	}
+}
+
+func TestRedisCacheReconnect(t *testing.T) {
+	server := newTestRedisServer(t)
+	db := newTestRedisCache(t, server)
+	if err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	server.dropConn()
+	checkTestDBValue(t, db, "a", "1", true)
+	server.lock.Lock()
+	connCount := len(server.connList)
+	server.lock.Unlock()
+	if connCount != 1 {
+		t.Errorf("connection count is %d", connCount)
+	}
+	
+	server.listener.Close()
+	server.dropConn()
+	if err := db.Ping(); err == nil {
+		t.Error("expected error of stopped server")
+	}
+}
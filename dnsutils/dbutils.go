@@ -1,45 +1,120 @@
 package dnsutils
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/frkhit/logger"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-const rrBucket = "rr"
+const (
+	rrBucket = "rr"
+	// separator of bucket name and its sub bucket name
+	bucketSep = "/"
+	// suffix of bucket which stores expire time of key
+	ttlBucketSuffix = "#ttl"
+)
 
 type DBCache interface {
 	Get(string) (string, error)
 	Set(string, string) error
+	// SetWithTTL: value is removed after ttl, ttl <= 0 means never expire
+	SetWithTTL(key string, value string, ttl time.Duration) error
 	Delete(string) error
 	Clear() error
 	BatchDelete([]string) (error)
 	BatchSet(map[string]string) (error)
+	// Scan calls fn with each key which has the prefix in key order, until fn returns false; fn may modify the cache
+	Scan(prefix string, fn func(key, value string) bool) error
+	// Len: count of key which is not expired
+	Len() (int, error)
+	// Bucket: independent namespace of key which shares the storage, key of the bucket is not seen by its parent;
+	// Clear of bucket only removes its own key, and Close of bucket does nothing
+	Bucket(name string) DBCache
 	Close()
 }
 
+type dbCacheItem struct {
+	key   string
+	value string
+}
+
+func scanItemList(itemList []dbCacheItem, fn func(key, value string) bool) {
+	sort.Slice(itemList, func(i, j int) bool {
+		return itemList[i].key < itemList[j].key
+	})
+	for _, item := range itemList {
+		if !fn(item.key, item.value) {
+			return
+		}
+	}
+}
+
+func getBucketName(parent, name string) string {
+	if len(parent) == 0 {
+		return name
+	}
+	return parent + bucketSep + name
+}
+
+type memCacheValue struct {
+	value  string
+	expire time.Time
+}
+
+func (value *memCacheValue) isExpired(now time.Time) bool {
+	return !value.expire.IsZero() && value.expire.Before(now)
+}
+
 type MemCache struct {
-	record sync.Map
+	name   string
+	record *sync.Map
+	// bucket name => record of bucket, shared by root and all buckets
+	bucketMap *sync.Map
 }
 
 func NewMemCache(dbPath string) DBCache {
-	return &MemCache{record: sync.Map{}}
+	return &MemCache{record: &sync.Map{}, bucketMap: &sync.Map{}}
 }
 
-func (db *MemCache) Get(key string) (string, error) {
+// load returns value which is not expired, expired value is deleted
+func (db *MemCache) load(key string) (*memCacheValue, bool) {
 	value, exists := db.record.Load(key)
+	if !exists {
+		return nil, false
+	}
+	if value.(*memCacheValue).isExpired(time.Now()) {
+		db.record.Delete(key)
+		return nil, false
+	}
+	return value.(*memCacheValue), true
+}
+
+func (db *MemCache) Get(key string) (string, error) {
+	value, exists := db.load(key)
 	if exists {
-		return value.(string), nil
+		return value.value, nil
 	} else {
 		return "", fmt.Errorf("record not found: %s", key)
 	}
 }
 
 func (db *MemCache) Set(key string, value string) (error) {
-	db.record.Store(key, value)
+	return db.SetWithTTL(key, value, 0)
+}
+
+func (db *MemCache) SetWithTTL(key string, value string, ttl time.Duration) error {
+	cacheValue := &memCacheValue{value: value}
+	if ttl > 0 {
+		cacheValue.expire = time.Now().Add(ttl)
+	}
+	db.record.Store(key, cacheValue)
 	return nil
 }
 
@@ -57,11 +132,43 @@ func (db *MemCache) BatchDelete(keyList []string) (error) {
 
 func (db *MemCache) BatchSet(record map[string]string) (error) {
 	for key, value := range record {
-		db.record.Store(key, value)
+		db.record.Store(key, &memCacheValue{value: value})
 	}
 	return nil
 }
 
+func (db *MemCache) Scan(prefix string, fn func(key, value string) bool) error {
+	var itemList []dbCacheItem
+	now := time.Now()
+	db.record.Range(func(key interface{}, value interface{}) bool {
+		cacheValue := value.(*memCacheValue)
+		if strings.HasPrefix(key.(string), prefix) && !cacheValue.isExpired(now) {
+			itemList = append(itemList, dbCacheItem{key: key.(string), value: cacheValue.value})
+		}
+		return true
+	})
+	scanItemList(itemList, fn)
+	return nil
+}
+
+func (db *MemCache) Len() (int, error) {
+	count := 0
+	now := time.Now()
+	db.record.Range(func(key interface{}, value interface{}) bool {
+		if !value.(*memCacheValue).isExpired(now) {
+			count++
+		}
+		return true
+	})
+	return count, nil
+}
+
+func (db *MemCache) Bucket(name string) DBCache {
+	name = getBucketName(db.name, name)
+	record, _ := db.bucketMap.LoadOrStore(name, &sync.Map{})
+	return &MemCache{name: name, record: record.(*sync.Map), bucketMap: db.bucketMap}
+}
+
 func (db *MemCache) Clear() (error) {
 	db.record.Range(func(key interface{}, value interface{}) bool {
 		db.record.Delete(key)
@@ -70,21 +177,32 @@ func (db *MemCache) Clear() (error) {
 	return nil
 }
 func (db *MemCache) Close() {
+	if len(db.name) > 0 {
+		return
+	}
 	db.Clear()
+	db.bucketMap.Range(func(name interface{}, record interface{}) bool {
+		db.bucketMap.Delete(name)
+		return true
+	})
 }
 
 // todo page error when running in WSL
+// expire time of key is stored in bucket with ttlBucketSuffix, and expired key is deleted when it is read
 type BoltDBCache struct {
-	bdb *bolt.DB
+	bdb    *bolt.DB
+	bucket string
 }
 
 func (db *BoltDBCache) createBucket(bucket string) (error) {
 	return db.bdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
-		if err != nil {
-			e := errors.New("Create bucket: " + bucket)
-			logger.Infoln(e.Error())
-			return e
+		for _, name := range []string{bucket, bucket + ttlBucketSuffix} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				e := errors.New("Create bucket: " + name)
+				logger.Infoln(e.Error())
+				return e
+			}
 		}
 		return nil
 	})
@@ -95,7 +213,7 @@ func NewBoltDBCache(dbPath string) DBCache {
 	if err != nil {
 		logger.Fatal("Failed to open dbPath[%s]: %s\n", dbPath, err.Error())
 	}
-	cache := &BoltDBCache{bdb: bdb}
+	cache := &BoltDBCache{bdb: bdb, bucket: rrBucket}
 	
 	// Create dns bucket if doesn't exist
 	err = cache.createBucket(rrBucket)
@@ -106,17 +224,34 @@ func NewBoltDBCache(dbPath string) DBCache {
 	return cache
 }
 
+// buckets of value and expire time
+func (db *BoltDBCache) getBucket(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket) {
+	return tx.Bucket([]byte(db.bucket)), tx.Bucket([]byte(db.bucket + ttlBucketSuffix))
+}
+
+func isBoltKeyExpired(ttlB *bolt.Bucket, key []byte, now time.Time) bool {
+	expire := ttlB.Get(key)
+	return len(expire) == 8 && int64(binary.BigEndian.Uint64(expire)) < now.UnixNano()
+}
+
 func (db *BoltDBCache) Get(key string) (string, error) {
 	var v []byte
+	expired := false
 	err := db.bdb.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(rrBucket))
-		v = b.Get([]byte(key))
-		
-		if string(v) == "" {
+		b, ttlB := db.getBucket(tx)
+		raw := b.Get([]byte(key))
+		if raw == nil {
 			return errors.New("Record not found, key: " + key)
 		}
+		// value returned by bolt is only valid in the transaction
+		v = append([]byte{}, raw...)
+		expired = isBoltKeyExpired(ttlB, []byte(key), time.Now())
 		return nil
 	})
+	if err == nil && expired {
+		db.Delete(key)
+		return "", errors.New("Record not found, key: " + key)
+	}
 	if err == nil {
 		return string(v), nil
 	}
@@ -124,71 +259,129 @@ func (db *BoltDBCache) Get(key string) (string, error) {
 }
 
 func (db *BoltDBCache) Set(key string, value string) (error) {
+	return db.SetWithTTL(key, value, 0)
+}
+
+func (db *BoltDBCache) SetWithTTL(key string, value string, ttl time.Duration) error {
 	return db.bdb.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(rrBucket))
-		return b.Put([]byte(key), []byte(value))
+		b, ttlB := db.getBucket(tx)
+		if err := b.Put([]byte(key), []byte(value)); err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			return ttlB.Delete([]byte(key))
+		}
+		expire := make([]byte, 8)
+		binary.BigEndian.PutUint64(expire, uint64(time.Now().Add(ttl).UnixNano()))
+		return ttlB.Put([]byte(key), expire)
 	})
 }
 
 func (db *BoltDBCache) Delete(key string) (error) {
 	return db.bdb.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(rrBucket))
+		b, ttlB := db.getBucket(tx)
 		e := b.Delete([]byte(key))
 		if e != nil {
 			return e
 		}
-		return nil
+		return ttlB.Delete([]byte(key))
 	})
 }
 
+// BatchDelete deletes all keys in one transaction
 func (db *BoltDBCache) BatchDelete(keyList []string) (error) {
-	//const size = 1
-	//// buffered so we never leak goroutines
-	//ch := make(chan error, size)
-	//put := func(i int) {
-	//	ch <- db.Batch(func(tx *bolt.Tx) error {
-	//		return tx.Bucket([]byte("widgets")).Put(u64tob(uint64(i)), []byte{})
-	//	})
-	//}
-	//
-	//db.MaxBatchSize = 1000
-	//db.MaxBatchDelay = 0
-	//
-	//go put(1)
-	//
-	//// Batch must trigger by time alone.
-	//
-	//// Check all responses to make sure there's no error.
-	//for i := 0; i < size; i++ {
-	//	if err := <-ch; err != nil {
-	//		t.Fatal(err)
-	//	}
-	//}
-	return nil
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		b, ttlB := db.getBucket(tx)
+		for _, key := range keyList {
+			if err := b.Delete([]byte(key)); err != nil {
+				return fmt.Errorf("fail to delete key[%s]: %s", key, err)
+			}
+			if err := ttlB.Delete([]byte(key)); err != nil {
+				return fmt.Errorf("fail to delete ttl of key[%s]: %s", key, err)
+			}
+		}
+		return nil
+	})
 }
 
+// BatchSet sets all keys in one transaction
 func (db *BoltDBCache) BatchSet(record map[string]string) (error) {
-	// todo not profile
-	for key, value := range record {
-		if err := db.Set(key, value); err != nil {
-			return err
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		b, ttlB := db.getBucket(tx)
+		for key, value := range record {
+			if err := b.Put([]byte(key), []byte(value)); err != nil {
+				return fmt.Errorf("fail to set key[%s]: %s", key, err)
+			}
+			if err := ttlB.Delete([]byte(key)); err != nil {
+				return fmt.Errorf("fail to delete ttl of key[%s]: %s", key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Scan reads matched keys in one read transaction, then calls fn out of the transaction
+func (db *BoltDBCache) Scan(prefix string, fn func(key, value string) bool) error {
+	var itemList []dbCacheItem
+	now := time.Now()
+	err := db.bdb.View(func(tx *bolt.Tx) error {
+		b, ttlB := db.getBucket(tx)
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if !isBoltKeyExpired(ttlB, k, now) {
+				itemList = append(itemList, dbCacheItem{key: string(k), value: string(v)})
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	scanItemList(itemList, fn)
 	return nil
 }
 
+func (db *BoltDBCache) Len() (int, error) {
+	count := 0
+	now := time.Now()
+	err := db.bdb.View(func(tx *bolt.Tx) error {
+		b, ttlB := db.getBucket(tx)
+		return b.ForEach(func(k, v []byte) error {
+			if !isBoltKeyExpired(ttlB, k, now) {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// Bucket: bolt bucket named with bucketSep after bucket of db, which is created if not exists
+func (db *BoltDBCache) Bucket(name string) DBCache {
+	cache := &BoltDBCache{bdb: db.bdb, bucket: getBucketName(db.bucket, name)}
+	if err := cache.createBucket(cache.bucket); err != nil {
+		logger.Errorf("Failed to create bucket[%s]: %s\n", cache.bucket, err)
+	}
+	return cache
+}
+
 func (db *BoltDBCache) Clear() (error) {
 	if delErr := db.bdb.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket([]byte(rrBucket))
-		if err != nil {
-			return fmt.Errorf("delete bucket: %s, error: %s", rrBucket, err)
+		for _, name := range []string{db.bucket, db.bucket + ttlBucketSuffix} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return fmt.Errorf("delete bucket: %s, error: %s", name, err)
+			}
 		}
 		return nil
 	}); delErr != nil {
 		return delErr
 	}
-	return db.createBucket(rrBucket)
+	return db.createBucket(db.bucket)
 }
 func (db *BoltDBCache) Close() {
+	if db.bucket != rrBucket {
+		return
+	}
 	db.bdb.Close()
 }
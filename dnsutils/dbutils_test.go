@@ -0,0 +1,172 @@
+package dnsutils
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func getTestScanResult(t *testing.T, db DBCache, prefix string) []string {
+	var result []string
+	if err := db.Scan(prefix, func(key, value string) bool {
+		result = append(result, key+"="+value)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func checkTestDBValue(t *testing.T, db DBCache, key string, expected string, exists bool) {
+	value, err := db.Get(key)
+	if exists && (err != nil || value != expected) {
+		t.Errorf("value of key[%s] is %q, expected %q, error is %v", key, value, expected, err)
+	}
+	if !exists && err == nil {
+		t.Errorf("key[%s] should not exist, value is %q", key, value)
+	}
+}
+
+// testDBCacheConformance runs the same cases with each backend of DBCache, newDB returns an empty cache
+func testDBCacheConformance(t *testing.T, newDB func(t *testing.T) DBCache) {
+	testCases := []struct {
+		name string
+		run  func(t *testing.T, db DBCache)
+	}{
+		{name: "get missing key", run: func(t *testing.T, db DBCache) {
+			checkTestDBValue(t, db, "missing", "", false)
+		}},
+		{name: "set and get", run: func(t *testing.T, db DBCache) {
+			db.Set("a", "1")
+			db.Set("b", "")
+			db.Set("a", "2")
+			checkTestDBValue(t, db, "a", "2", true)
+			checkTestDBValue(t, db, "b", "", true)
+		}},
+		{name: "delete", run: func(t *testing.T, db DBCache) {
+			db.Set("a", "1")
+			if err := db.Delete("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Delete("missing"); err != nil {
+				t.Fatal(err)
+			}
+			checkTestDBValue(t, db, "a", "", false)
+		}},
+		{name: "batch set", run: func(t *testing.T, db DBCache) {
+			db.SetWithTTL("a", "0", time.Hour)
+			if err := db.BatchSet(map[string]string{"a": "1", "b": "2", "c": "3"}); err != nil {
+				t.Fatal(err)
+			}
+			if result := getTestScanResult(t, db, ""); !reflect.DeepEqual(result, []string{"a=1", "b=2", "c=3"}) {
+				t.Errorf("result is %v", result)
+			}
+		}},
+		{name: "batch delete", run: func(t *testing.T, db DBCache) {
+			db.BatchSet(map[string]string{"a": "1", "b": "2", "c": "3"})
+			if err := db.BatchDelete([]string{"a", "c", "missing"}); err != nil {
+				t.Fatal(err)
+			}
+			if result := getTestScanResult(t, db, ""); !reflect.DeepEqual(result, []string{"b=2"}) {
+				t.Errorf("result is %v", result)
+			}
+		}},
+		{name: "scan prefix in key order", run: func(t *testing.T, db DBCache) {
+			db.BatchSet(map[string]string{"a:3": "w", "b:1": "z", "a:1": "x", "a:2": "y", "a": "v"})
+			if result := getTestScanResult(t, db, "a:"); !reflect.DeepEqual(result, []string{"a:1=x", "a:2=y", "a:3=w"}) {
+				t.Errorf("result is %v", result)
+			}
+			if result := getTestScanResult(t, db, "c"); len(result) != 0 {
+				t.Errorf("result is %v", result)
+			}
+		}},
+		{name: "scan until fn returns false and delete in fn", run: func(t *testing.T, db DBCache) {
+			db.BatchSet(map[string]string{"a": "1", "b": "2", "c": "3"})
+			var keyList []string
+			db.Scan("", func(key, value string) bool {
+				keyList = append(keyList, key)
+				db.Delete(key)
+				return len(keyList) < 2
+			})
+			if !reflect.DeepEqual(keyList, []string{"a", "b"}) {
+				t.Errorf("key list is %v", keyList)
+			}
+			if result := getTestScanResult(t, db, ""); !reflect.DeepEqual(result, []string{"c=3"}) {
+				t.Errorf("result is %v", result)
+			}
+		}},
+		{name: "ttl", run: func(t *testing.T, db DBCache) {
+			db.SetWithTTL("a", "1", 50*time.Millisecond)
+			db.SetWithTTL("b", "2", time.Hour)
+			db.SetWithTTL("c", "3", 50*time.Millisecond)
+			db.Set("c", "4")
+			time.Sleep(100 * time.Millisecond)
+			checkTestDBValue(t, db, "a", "", false)
+			checkTestDBValue(t, db, "b", "2", true)
+			checkTestDBValue(t, db, "c", "4", true)
+			if count, err := db.Len(); err != nil || count != 2 {
+				t.Errorf("len is %d, error is %v", count, err)
+			}
+		}},
+		{name: "bucket", run: func(t *testing.T, db DBCache) {
+			db.Set("a", "root")
+			bucket := db.Bucket("bucket")
+			bucket.Set("a", "bucket")
+			bucket.Bucket("sub").Set("a", "sub")
+			checkTestDBValue(t, db, "a", "root", true)
+			checkTestDBValue(t, db.Bucket("bucket"), "a", "bucket", true)
+			checkTestDBValue(t, bucket.Bucket("sub"), "a", "sub", true)
+			if result := getTestScanResult(t, db, ""); !reflect.DeepEqual(result, []string{"a=root"}) {
+				t.Errorf("result of root is %v", result)
+			}
+			
+			// Clear and Close of bucket do not change root and sub bucket
+			bucket.Clear()
+			bucket.Close()
+			checkTestDBValue(t, bucket, "a", "", false)
+			checkTestDBValue(t, db, "a", "root", true)
+			checkTestDBValue(t, bucket.Bucket("sub"), "a", "sub", true)
+		}},
+		{name: "clear", run: func(t *testing.T, db DBCache) {
+			db.BatchSet(map[string]string{"a": "1", "b": "2"})
+			if err := db.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			if count, err := db.Len(); err != nil || count != 0 {
+				t.Errorf("len is %d, error is %v", count, err)
+			}
+			db.Set("a", "3")
+			checkTestDBValue(t, db, "a", "3", true)
+		}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			db := newDB(t)
+			defer db.Close()
+			testCase.run(t, db)
+		})
+	}
+}
+
+func TestDBCacheConformance(t *testing.T) {
+	testCases := []struct {
+		name  string
+		newDB func(t *testing.T) DBCache
+	}{
+		{name: "memory", newDB: func(t *testing.T) DBCache {
+			return NewMemCache("")
+		}},
+		{name: "bounded memory", newDB: func(t *testing.T) DBCache {
+			return NewBoundedMemCache(BoundedMemCacheOptions{MaxEntries: 100})
+		}},
+		{name: "bolt", newDB: func(t *testing.T) DBCache {
+			return NewBoltDBCache(filepath.Join(t.TempDir(), "cache.db"))
+		}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testDBCacheConformance(t, testCase.newDB)
+		})
+	}
+}
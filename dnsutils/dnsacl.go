@@ -0,0 +1,250 @@
+package dnsutils
+
+// ref: https://kb.isc.org/docs/aa-00994, response rate limiting
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// access control list of client address: denied if in deny list, else allowed if allow list is empty or in allow list
+type dnsACL struct {
+	allowList []*net.IPNet
+	denyList  []*net.IPNet
+	lock      sync.RWMutex
+}
+
+func newDNSACL() *dnsACL {
+	return &dnsACL{lock: sync.RWMutex{}}
+}
+
+// ParseCIDRList: each one is CIDR like `10.0.0.0/8`, or single ip like `127.0.0.1`
+func ParseCIDRList(cidrList []string) ([]*net.IPNet, error) {
+	var netList []*net.IPNet
+	for _, cidr := range cidrList {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		if strings.Index(cidr, "/") < 0 {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		netList = append(netList, ipNet)
+	}
+	return netList, nil
+}
+
+func (acl *dnsACL) set(allowList, denyList []string) error {
+	allowNetList, err := ParseCIDRList(allowList)
+	if err != nil {
+		return fmt.Errorf("fail to parse allow list: %s", err)
+	}
+	denyNetList, err := ParseCIDRList(denyList)
+	if err != nil {
+		return fmt.Errorf("fail to parse deny list: %s", err)
+	}
+	
+	acl.lock.Lock()
+	acl.allowList, acl.denyList = allowNetList, denyNetList
+	acl.lock.Unlock()
+	return nil
+}
+
+func (acl *dnsACL) isAllowed(ip net.IP) bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	
+	if len(acl.allowList) == 0 && len(acl.denyList) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range acl.denyList {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.allowList) == 0 {
+		return true
+	}
+	for _, ipNet := range acl.allowList {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetQueryACL replaces allow/deny list of query, client not allowed is answered with REFUSED
+func (ds *DNSSimpleServer) SetQueryACL(allowList, denyList []string) error {
+	return ds.queryACL.set(allowList, denyList)
+}
+
+// SetUpdateACL replaces allow/deny list of dynamic update
+func (ds *DNSSimpleServer) SetUpdateACL(allowList, denyList []string) error {
+	return ds.updateACL.set(allowList, denyList)
+}
+
+func getAddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	rrlDrop
+	// answer with empty truncated response, so that real client would retry with tcp
+	rrlSlip
+)
+
+const dnsRateLimitCleanInterval = time.Minute
+
+var (
+	// clients in the same prefix share one bucket of rate limit, so that client can not escape the limit by
+	// changing its address in the prefix, like ipv6 client of a /64 or /56 network
+	DNSRateLimitIPv4PrefixLen = 24
+	DNSRateLimitIPv6PrefixLen = 56
+)
+
+type rrlBucket struct {
+	tokens    float64
+	last      time.Time
+	slipCount int
+}
+
+// token bucket of each client prefix, see DNSRateLimitIPv4PrefixLen
+type dnsRateLimiter struct {
+	rate      float64
+	burst     float64
+	slip      int
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	bucketMap map[string]*rrlBucket
+	lastClean time.Time
+	lock      sync.Mutex
+}
+
+func newDNSRateLimiter(rate float64, burst int, slip int) *dnsRateLimiter {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &dnsRateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		slip:      slip,
+		ipv4Mask:  net.CIDRMask(DNSRateLimitIPv4PrefixLen, 8*net.IPv4len),
+		ipv6Mask:  net.CIDRMask(DNSRateLimitIPv6PrefixLen, 8*net.IPv6len),
+		bucketMap: make(map[string]*rrlBucket),
+		lastClean: time.Now(),
+		lock:      sync.Mutex{},
+	}
+}
+
+// key of bucket is the masked prefix of client ip
+func (limiter *dnsRateLimiter) getKey(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(limiter.ipv4Mask).String()
+	}
+	return ip.Mask(limiter.ipv6Mask).String()
+}
+
+func (limiter *dnsRateLimiter) take(ip net.IP) rrlAction {
+	if limiter == nil || limiter.rate <= 0 || ip == nil {
+		return rrlAllow
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	
+	key := limiter.getKey(ip)
+	now := time.Now()
+	if now.Sub(limiter.lastClean) > dnsRateLimitCleanInterval {
+		// full bucket is the same as no bucket
+		for key, bucket := range limiter.bucketMap {
+			if float64(now.Sub(bucket.last))/float64(time.Second)*limiter.rate+bucket.tokens >= limiter.burst {
+				delete(limiter.bucketMap, key)
+			}
+		}
+		limiter.lastClean = now
+	}
+	
+	bucket, exists := limiter.bucketMap[key]
+	if !exists {
+		bucket = &rrlBucket{tokens: limiter.burst, last: now}
+		limiter.bucketMap[key] = bucket
+	}
+	bucket.tokens += float64(now.Sub(bucket.last)) / float64(time.Second) * limiter.rate
+	if bucket.tokens > limiter.burst {
+		bucket.tokens = limiter.burst
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return rrlAllow
+	}
+	
+	// every slip-th limited response is truncated instead of dropped, 0 means always drop
+	if limiter.slip > 0 {
+		bucket.slipCount++
+		if bucket.slipCount >= limiter.slip {
+			bucket.slipCount = 0
+			return rrlSlip
+		}
+	}
+	return rrlDrop
+}
+
+// admitRequest checks rate limit of client if limited, then acl of opcode; the request is answered with REFUSED if
+// not allowed. it is shared by udp, tcp and DoH request, so that none of them can bypass the admission
+func (ds *DNSSimpleServer) admitRequest(r *dns.Msg, clientIP net.IP, limited bool) (rrlAction, bool) {
+	if limited {
+		if action := ds.rateLimiter.take(clientIP); action != rrlAllow {
+			return action, false
+		}
+	}
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		if !ds.queryACL.isAllowed(clientIP) {
+			ds.logger.Errorf("query from client[%s] is refused by acl\n", clientIP)
+			return rrlAllow, false
+		}
+	case dns.OpcodeUpdate:
+		if !ds.updateACL.isAllowed(clientIP) {
+			ds.logger.Errorf("update from client[%s] is refused by acl\n", clientIP)
+			return rrlAllow, false
+		}
+	}
+	return rrlAllow, true
+}
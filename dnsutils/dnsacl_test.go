@@ -0,0 +1,173 @@
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDNSACL(t *testing.T) {
+	testCases := []struct {
+		name      string
+		allowList []string
+		denyList  []string
+		allowed   []string
+		denied    []string
+	}{
+		{name: "empty", allowed: []string{"10.0.0.1", "2001:db8::1"}},
+		{name: "allow", allowList: []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"},
+			allowed: []string{"10.1.2.3", "2001:db8::1", "192.168.1.1"}, denied: []string{"11.0.0.1", "2001:db9::1", "192.168.1.2"}},
+		{name: "deny", denyList: []string{"10.0.0.0/8"}, allowed: []string{"11.0.0.1", "::1"}, denied: []string{"10.0.0.1"}},
+		{name: "deny wins", allowList: []string{"10.0.0.0/8"}, denyList: []string{"10.1.0.0/16"},
+			allowed: []string{"10.2.0.1"}, denied: []string{"10.1.0.1", "11.0.0.1"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			acl := newDNSACL()
+			if err := acl.set(testCase.allowList, testCase.denyList); err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range testCase.allowed {
+				if !acl.isAllowed(net.ParseIP(ip)) {
+					t.Errorf("%s is denied", ip)
+				}
+			}
+			for _, ip := range testCase.denied {
+				if acl.isAllowed(net.ParseIP(ip)) {
+					t.Errorf("%s is allowed", ip)
+				}
+			}
+		})
+	}
+	
+	if err := newDNSACL().set([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("expected error of invalid CIDR")
+	}
+}
+
+func TestHandleDnsRequestACL(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{QueryDenyList: []string{"10.0.0.0/8"}, UpdateAllowList: []string{"127.0.0.1"}})
+	setTestHostRecord(t, ds, "foo.example.com. 3600 IN A 10.0.0.1")
+	query := new(dns.Msg)
+	query.SetQuestion("foo.example.com.", dns.TypeA)
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+	update.Insert([]dns.RR{newTestRR(t, "bar.example.com. 60 IN A 10.0.0.2")})
+	
+	testCases := []struct {
+		name       string
+		r          *dns.Msg
+		clientAddr net.Addr
+		rcode      int
+	}{
+		{name: "query allowed", r: query, clientAddr: &net.UDPAddr{IP: net.ParseIP("192.168.0.1")}, rcode: dns.RcodeSuccess},
+		{name: "query denied udp", r: query, clientAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}, rcode: dns.RcodeRefused},
+		{name: "query denied tcp", r: query, clientAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, rcode: dns.RcodeRefused},
+		{name: "update denied", r: update, clientAddr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, rcode: dns.RcodeRefused},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := handleTestRequest(ds, testCase.clientAddr, testCase.r)
+			if m == nil || m.Rcode != testCase.rcode {
+				t.Fatalf("reply is %v, expected rcode %s", m, dns.RcodeToString[testCase.rcode])
+			}
+			if testCase.rcode == dns.RcodeRefused && len(m.Answer) > 0 {
+				t.Errorf("refused reply has answer: %v", m.Answer)
+			}
+		})
+	}
+	if typeRecord := ds.getDynamicRecord("bar.example.com."); len(typeRecord) > 0 {
+		t.Error("update of denied client is applied")
+	}
+	
+	// DoH client: denied by the same acl
+	req := newTestDoHRequest(t, http.MethodGet, query)
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	ds.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status of denied DoH client is %d", w.Code)
+	}
+}
+
+func TestDNSRateLimiter(t *testing.T) {
+	limiter := newDNSRateLimiter(1, 2, 2)
+	testCases := []struct {
+		name   string
+		ip     string
+		action rrlAction
+	}{
+		{name: "burst", ip: "10.0.0.1", action: rrlAllow},
+		{name: "burst", ip: "10.0.0.1", action: rrlAllow},
+		{name: "drop", ip: "10.0.0.1", action: rrlDrop},
+		{name: "slip", ip: "10.0.0.1", action: rrlSlip},
+		// client in the same /24 shares the bucket
+		{name: "same prefix", ip: "10.0.0.2", action: rrlDrop},
+		{name: "same prefix", ip: "10.0.0.254", action: rrlSlip},
+		{name: "other prefix", ip: "10.0.1.1", action: rrlAllow},
+		{name: "ipv6 burst", ip: "2001:db8:0:1::1", action: rrlAllow},
+		{name: "ipv6 burst", ip: "2001:db8:0:2::1", action: rrlAllow},
+		// client in the same /56 shares the bucket
+		{name: "ipv6 same prefix", ip: "2001:db8:0:ff::1", action: rrlDrop},
+		{name: "ipv6 other prefix", ip: "2001:db8:0:100::1", action: rrlAllow},
+	}
+	for _, testCase := range testCases {
+		if action := limiter.take(net.ParseIP(testCase.ip)); action != testCase.action {
+			t.Errorf("%s: action of %s is %d, expected %d", testCase.name, testCase.ip, action, testCase.action)
+		}
+	}
+	
+	// bucket is refilled with rate
+	limiter.lock.Lock()
+	for _, bucket := range limiter.bucketMap {
+		bucket.last = bucket.last.Add(-1500 * time.Millisecond)
+	}
+	limiter.lock.Unlock()
+	if action := limiter.take(net.ParseIP("10.0.0.3")); action != rrlAllow {
+		t.Errorf("action after refill is %d", action)
+	}
+	if action := limiter.take(net.ParseIP("10.0.0.3")); action != rrlDrop {
+		t.Errorf("action after refill is %d, expected only 1 token", action)
+	}
+	
+	// no limit
+	if action := newDNSRateLimiter(0, 0, 0).take(net.ParseIP("10.0.0.1")); action != rrlAllow {
+		t.Errorf("action without limit is %d", action)
+	}
+}
+
+func TestHandleDnsRequestRateLimit(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{RateLimit: 1, RateLimitBurst: 1, RateLimitSlip: 2})
+	setTestHostRecord(t, ds, "foo.example.com. 3600 IN A 10.0.0.1")
+	query := new(dns.Msg)
+	query.SetQuestion("foo.example.com.", dns.TypeA)
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("192.168.0.1")}
+	
+	if m := handleTestRequest(ds, udpAddr, query); m == nil || len(m.Answer) != 1 {
+		t.Fatalf("reply of first query is %v", m)
+	}
+	if m := handleTestRequest(ds, udpAddr, query); m != nil {
+		t.Errorf("limited query is not dropped: %v", m)
+	}
+	if m := handleTestRequest(ds, udpAddr, query); m == nil || !m.Truncated || len(m.Answer) > 0 {
+		t.Errorf("limited query is not slipped: %v", m)
+	}
+	// tcp client can not spoof its address, so it is not limited
+	if m := handleTestRequest(ds, &net.TCPAddr{IP: udpAddr.IP}, query); m == nil || len(m.Answer) != 1 {
+		t.Errorf("reply of tcp query is %v", m)
+	}
+	
+	// DoH client is limited with the same prefix bucket
+	for _, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := newTestDoHRequest(t, http.MethodGet, query)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		ds.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("status of DoH query is %d, expected %d", w.Code, status)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package dnsutils
+
+// ref: https://adguard-dns.io/kb/general/dns-filtering-syntax/, adblock-style syntax
+import (
+	"fmt"
+	"github.com/frkhit/goutils/common"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DNSBlockMode int
+
+const (
+	// answer blocked domain with NXDOMAIN
+	BlockNXDomain DNSBlockMode = iota
+	// answer blocked domain with 0.0.0.0 and ::
+	BlockZeroIP
+	// answer blocked domain with sinkhole ip
+	BlockSinkhole
+)
+
+// refresh time of remote blocklist
+var DNSBlocklistRefresh = 24 * time.Hour
+
+// domain which is not blocked even if it is in hosts format blocklist
+var dnsBlocklistIgnoreDomain = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+type DNSBlocklistStat struct {
+	Source    string    `json:"source"`
+	Allow     bool      `json:"allow,omitempty"`
+	Domain    int       `json:"domain"`
+	Hit       uint64    `json:"hit"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// domain set of one blocklist or allowlist: exact domain, and domain with all of its sub domain
+type dnsDomainSet struct {
+	exactSet  map[string]bool
+	suffixSet map[string]bool
+}
+
+func newDNSDomainSet() *dnsDomainSet {
+	return &dnsDomainSet{exactSet: make(map[string]bool), suffixSet: make(map[string]bool)}
+}
+
+func (set *dnsDomainSet) size() int {
+	return len(set.exactSet) + len(set.suffixSet)
+}
+
+func (set *dnsDomainSet) contains(domain string) bool {
+	if set.exactSet[domain] {
+		return true
+	}
+	for len(domain) > 0 {
+		if set.suffixSet[domain] {
+			return true
+		}
+		index := strings.Index(domain, ".")
+		if index < 0 {
+			break
+		}
+		domain = domain[index+1:]
+	}
+	return false
+}
+
+func (set *dnsDomainSet) add(domain string, withSubDomain bool) {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if _, ok := dns.IsDomainName(domain); !ok || len(domain) == 0 || dnsBlocklistIgnoreDomain[domain] {
+		return
+	}
+	if withSubDomain {
+		set.suffixSet[domain] = true
+	} else {
+		set.exactSet[domain] = true
+	}
+}
+
+// parseBlocklist: each line is in hosts format `0.0.0.0 ads.example.com`, plain domain `ads.example.com` (`*.example.com`
+// or `.example.com` for sub domain too), or adblock syntax `||example.com^`; adblock exception `@@||example.com^` is allowed
+func parseBlocklist(blockFile string) (blockSet *dnsDomainSet, allowSet *dnsDomainSet, err error) {
+	blockSet, allowSet = newDNSDomainSet(), newDNSDomainSet()
+	lines, err := common.FileReadLines(blockFile)
+	if err != nil {
+		return blockSet, allowSet, err
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.Index(line, "#") == 0 || strings.Index(line, "!") == 0 || strings.Index(line, "[") == 0 {
+			continue
+		}
+		
+		// adblock syntax
+		if strings.Index(line, "||") == 0 || strings.Index(line, "@@||") == 0 {
+			targetSet := blockSet
+			if strings.Index(line, "@@") == 0 {
+				targetSet = allowSet
+				line = line[2:]
+			}
+			line = strings.TrimPrefix(line, "||")
+			index := strings.Index(line, "^")
+			if index < 0 {
+				continue
+			}
+			// rule with modifier other than `$important` is not for dns
+			if modifier := line[index+1:]; len(modifier) > 0 && modifier != "$important" {
+				continue
+			}
+			if domain := line[:index]; strings.IndexAny(domain, "/*") < 0 {
+				targetSet.add(domain, true)
+			}
+			continue
+		}
+		
+		if index := strings.Index(line, "#"); index > 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			// hosts format
+			for _, domain := range fields[1:] {
+				blockSet.add(domain, false)
+			}
+		case len(fields) == 1:
+			domain := fields[0]
+			if strings.Index(domain, "*.") == 0 || strings.Index(domain, ".") == 0 {
+				blockSet.add(strings.TrimPrefix(domain, "*"), true)
+			} else {
+				blockSet.add(domain, false)
+			}
+		}
+	}
+	return blockSet, allowSet, nil
+}
+
+type dnsBlocklist struct {
+	source    string
+	isAllow   bool
+	blockSet  *dnsDomainSet
+	allowSet  *dnsDomainSet
+	hit       uint64
+	updatedAt time.Time
+	util      *HostDNSUtil
+}
+
+type dnsBlocker struct {
+	blockMode    DNSBlockMode
+	sinkholeList []net.IP
+	blocklist    []*dnsBlocklist
+	lock         sync.RWMutex
+}
+
+func newDNSBlocker(blockMode DNSBlockMode, sinkholeList []string) (*dnsBlocker, error) {
+	blocker := &dnsBlocker{blockMode: blockMode, lock: sync.RWMutex{}}
+	switch blockMode {
+	case BlockZeroIP:
+		blocker.sinkholeList = []net.IP{net.IPv4zero, net.IPv6zero}
+	case BlockSinkhole:
+		for _, ip := range sinkholeList {
+			parsedIP := net.ParseIP(strings.TrimSpace(ip))
+			if parsedIP == nil {
+				return nil, fmt.Errorf("invalid sinkhole ip: %s", ip)
+			}
+			blocker.sinkholeList = append(blocker.sinkholeList, parsedIP)
+		}
+		if len(blocker.sinkholeList) == 0 {
+			return nil, fmt.Errorf("sinkhole ip list is empty")
+		}
+	}
+	return blocker, nil
+}
+
+func isRemoteBlocklist(source string) bool {
+	return strings.Index(source, "http://") == 0 || strings.Index(source, "https://") == 0
+}
+
+// reload list from local file
+func (ds *DNSSimpleServer) reloadBlocklist(list *dnsBlocklist, blockFile string) {
+	blockSet, allowSet, err := parseBlocklist(blockFile)
+	if err != nil {
+		ds.logger.Errorf("fail to parse blocklist[%s], error is %s\n", list.source, err)
+		return
+	}
+	if list.isAllow {
+		// every domain of allowlist is allowed
+		for domain := range blockSet.exactSet {
+			allowSet.exactSet[domain] = true
+		}
+		for domain := range blockSet.suffixSet {
+			allowSet.suffixSet[domain] = true
+		}
+		blockSet = newDNSDomainSet()
+	}
+	
+	ds.blocker.lock.Lock()
+	list.blockSet, list.allowSet, list.updatedAt = blockSet, allowSet, time.Now()
+	ds.blocker.lock.Unlock()
+	ds.logger.Infof("success to load blocklist[%s], %d blocked, %d allowed\n", list.source, blockSet.size(), allowSet.size())
+}
+
+// SetBlocklist replaces all blocklist and allowlist; each source is local file or http(s) url, url is refreshed by
+// HostDNSUtil every DNSBlocklistRefresh; domain in allowlist is never blocked
+func (ds *DNSSimpleServer) SetBlocklist(blockSourceList, allowSourceList []string) {
+	var blocklist []*dnsBlocklist
+	for _, source := range allowSourceList {
+		blocklist = append(blocklist, &dnsBlocklist{source: source, isAllow: true, blockSet: newDNSDomainSet(), allowSet: newDNSDomainSet()})
+	}
+	for _, source := range blockSourceList {
+		blocklist = append(blocklist, &dnsBlocklist{source: source, blockSet: newDNSDomainSet(), allowSet: newDNSDomainSet()})
+	}
+	
+	ds.blocker.lock.Lock()
+	oldBlocklist := ds.blocker.blocklist
+	ds.blocker.blocklist = blocklist
+	ds.blocker.lock.Unlock()
+	for _, list := range oldBlocklist {
+		if list.util != nil {
+			list.util.Stop()
+		}
+	}
+	
+	for _, list := range blocklist {
+		if !isRemoteBlocklist(list.source) {
+			ds.reloadBlocklist(list, list.source)
+			continue
+		}
+		
+		// downloaded file of last run is used until refresh
+		list.util = NewHostDNSUtil(list.source, GetLogPath(fmt.Sprintf("blocklist.%s.log", common.GetMd5(list.source))), DNSBlocklistRefresh)
+		if common.FileExists(list.util.GetHostFile()) {
+			ds.reloadBlocklist(list, list.util.GetHostFile())
+		}
+		currentList := list
+		list.util.AddHostFileUpdateTrigger(func(blockFile string) {
+			ds.reloadBlocklist(currentList, blockFile)
+		})
+		list.util.Start()
+	}
+}
+
+// blocked by which list, or nil if not blocked; hit of the matched blocklist or allowlist is counted
+func (ds *DNSSimpleServer) getBlocklist(domain string) *dnsBlocklist {
+	ds.blocker.lock.RLock()
+	defer ds.blocker.lock.RUnlock()
+	
+	if len(ds.blocker.blocklist) == 0 {
+		return nil
+	}
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	for _, list := range ds.blocker.blocklist {
+		if list.allowSet.contains(domain) {
+			atomic.AddUint64(&list.hit, 1)
+			return nil
+		}
+	}
+	for _, list := range ds.blocker.blocklist {
+		if list.blockSet.contains(domain) {
+			atomic.AddUint64(&list.hit, 1)
+			return list
+		}
+	}
+	return nil
+}
+
+// answer blocked domain by block mode; return false if domain is not blocked
+func (ds *DNSSimpleServer) answerFromBlocklist(question *dns.Question, m *dns.Msg) bool {
+	list := ds.getBlocklist(question.Name)
+	if list == nil {
+		return false
+	}
+	ds.logger.Infof("host[%s] is blocked by blocklist[%s]\n", question.Name, list.source)
+	
+	if ds.blocker.blockMode == BlockNXDomain {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, ds.getLocalNegativeSOA(question.Name))
+		return true
+	}
+	// sinkhole without ip of this query type: NODATA
+	for _, ip := range ds.blocker.sinkholeList {
+		var rr dns.RR
+		header := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: uint32(ds.ttl / time.Second)}
+		if ip.To4() != nil && question.Qtype == dns.TypeA {
+			header.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: header, A: ip.To4()}
+		} else if ip.To4() == nil && question.Qtype == dns.TypeAAAA {
+			header.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: header, AAAA: ip}
+		}
+		if rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, ds.getLocalNegativeSOA(question.Name))
+	}
+	return true
+}
+
+// BlocklistStats: domain count and hit count of each blocklist and allowlist
+func (ds *DNSSimpleServer) BlocklistStats() []DNSBlocklistStat {
+	ds.blocker.lock.RLock()
+	defer ds.blocker.lock.RUnlock()
+	
+	var statList []DNSBlocklistStat
+	for _, list := range ds.blocker.blocklist {
+		statList = append(statList, DNSBlocklistStat{
+			Source:    list.source,
+			Allow:     list.isAllow,
+			Domain:    list.blockSet.size() + list.allowSet.size(),
+			Hit:       atomic.LoadUint64(&list.hit),
+			UpdatedAt: list.updatedAt,
+		})
+	}
+	sort.SliceStable(statList, func(i, j int) bool {
+		return statList[i].Hit > statList[j].Hit
+	})
+	return statList
+}
@@ -0,0 +1,145 @@
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	content := `# comment
+! adblock comment
+[Adblock Plus 2.0]
+0.0.0.0 ads.example.com tracker.example.com # hosts
+127.0.0.1 localhost
+plain.example.com
+*.wild.example.com
+.dot.example.com
+||adblock.example.com^
+||important.example.com^$important
+||modifier.example.com^$third-party
+||path.example.com/ads^
+@@||good.adblock.example.com^
+`
+	blockSet, allowSet, err := parseBlocklist(writeTestFile(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		domain  string
+		blocked bool
+		allowed bool
+	}{
+		{domain: "ads.example.com", blocked: true},
+		{domain: "tracker.example.com", blocked: true},
+		{domain: "sub.ads.example.com"},
+		{domain: "localhost"},
+		{domain: "plain.example.com", blocked: true},
+		{domain: "sub.plain.example.com"},
+		{domain: "wild.example.com", blocked: true},
+		{domain: "a.b.wild.example.com", blocked: true},
+		{domain: "a.dot.example.com", blocked: true},
+		{domain: "adblock.example.com", blocked: true},
+		{domain: "a.adblock.example.com", blocked: true},
+		{domain: "important.example.com", blocked: true},
+		{domain: "modifier.example.com"},
+		{domain: "path.example.com"},
+		{domain: "good.adblock.example.com", blocked: true, allowed: true},
+		{domain: "example.com"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.domain, func(t *testing.T) {
+			if blocked := blockSet.contains(testCase.domain); blocked != testCase.blocked {
+				t.Errorf("blocked is %v, expected %v", blocked, testCase.blocked)
+			}
+			if allowed := allowSet.contains(testCase.domain); allowed != testCase.allowed {
+				t.Errorf("allowed is %v, expected %v", allowed, testCase.allowed)
+			}
+		})
+	}
+}
+
+func TestAnswerFromBlocklist(t *testing.T) {
+	blockFile := writeTestFile(t, "ads.example.com\n||tracker.example.com^\n@@||ok.tracker.example.com^\n")
+	allowFile := writeTestFile(t, "allow.tracker.example.com\n")
+	testCases := []struct {
+		name     string
+		mode     DNSBlockMode
+		sinkhole []string
+		domain   string
+		qType    uint16
+		rcode    int
+		answer   []string
+	}{
+		{name: "nxdomain", mode: BlockNXDomain, domain: "ads.example.com", qType: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "nxdomain sub domain", mode: BlockNXDomain, domain: "a.tracker.example.com", qType: dns.TypeAAAA, rcode: dns.RcodeNameError},
+		{name: "zero ip", mode: BlockZeroIP, domain: "ads.example.com", qType: dns.TypeA, answer: []string{"0.0.0.0"}},
+		{name: "zero ipv6", mode: BlockZeroIP, domain: "ads.example.com", qType: dns.TypeAAAA, answer: []string{"::"}},
+		{name: "zero ip other type", mode: BlockZeroIP, domain: "ads.example.com", qType: dns.TypeMX},
+		{name: "sinkhole", mode: BlockSinkhole, sinkhole: []string{"10.0.0.53", "10.0.0.54"}, domain: "ads.example.com",
+			qType: dns.TypeA, answer: []string{"10.0.0.53", "10.0.0.54"}},
+		// sinkhole without ipv6: NODATA
+		{name: "sinkhole without ipv6", mode: BlockSinkhole, sinkhole: []string{"10.0.0.53"}, domain: "ads.example.com",
+			qType: dns.TypeAAAA},
+		// exception of blocklist and allowlist are not blocked, and answered by host record
+		{name: "exception", mode: BlockNXDomain, domain: "ok.tracker.example.com", qType: dns.TypeA, answer: []string{"10.0.0.1"}},
+		{name: "allowlist", mode: BlockNXDomain, domain: "allow.tracker.example.com", qType: dns.TypeA, answer: []string{"10.0.0.2"}},
+		{name: "not blocked", mode: BlockNXDomain, domain: "www.example.com", qType: dns.TypeA, answer: []string{"10.0.0.3"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ds := newTestServer(t, DNSSimpleServerOptions{
+				BlockLists:     []string{blockFile},
+				AllowLists:     []string{allowFile},
+				BlockMode:      testCase.mode,
+				SinkholeIPList: testCase.sinkhole,
+			})
+			setTestHostRecord(t, ds, "ok.tracker.example.com. 3600 IN A 10.0.0.1",
+				"allow.tracker.example.com. 3600 IN A 10.0.0.2", "www.example.com. 3600 IN A 10.0.0.3")
+			
+			m := queryTestServer(t, ds, testCase.domain, testCase.qType)
+			if m.Rcode != testCase.rcode {
+				t.Fatalf("rcode is %s, expected %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[testCase.rcode])
+			}
+			answerList := getTestAnswer(m)
+			if len(answerList) != len(testCase.answer) {
+				t.Fatalf("answer is %v, expected %v", answerList, testCase.answer)
+			}
+			for i := range answerList {
+				if answerList[i] != testCase.answer[i] {
+					t.Errorf("answer is %v, expected %v", answerList, testCase.answer)
+				}
+			}
+			// negative answer has SOA for negative cache of client
+			if len(answerList) == 0 && (len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA) {
+				t.Errorf("authority of negative answer is %v", m.Ns)
+			}
+		})
+	}
+}
+
+func TestBlocklistStats(t *testing.T) {
+	blockFile := writeTestFile(t, "ads.example.com\nads2.example.com\n")
+	allowFile := writeTestFile(t, "ok.example.com\n")
+	ds := newTestServer(t, DNSSimpleServerOptions{BlockLists: []string{blockFile}, AllowLists: []string{allowFile}})
+	for _, domain := range []string{"ads.example.com", "ads2.example.com", "ok.example.com"} {
+		queryTestServer(t, ds, domain, dns.TypeA)
+	}
+	
+	statList := ds.BlocklistStats()
+	if len(statList) != 2 {
+		t.Fatalf("stats is %+v", statList)
+	}
+	// sorted by hit
+	if stat := statList[0]; stat.Source != blockFile || stat.Allow || stat.Domain != 2 || stat.Hit != 2 {
+		t.Errorf("stats of blocklist is %+v", stat)
+	}
+	if stat := statList[1]; stat.Source != allowFile || !stat.Allow || stat.Domain != 1 || stat.Hit != 1 {
+		t.Errorf("stats of allowlist is %+v", stat)
+	}
+	
+	// blocklist is removed
+	ds.SetBlocklist(nil, nil)
+	if m := queryTestServer(t, ds, "ads.example.com", dns.TypeA); m.Rcode == dns.RcodeNameError {
+		t.Errorf("domain is blocked after blocklist is removed: %s", m)
+	}
+}
@@ -0,0 +1,177 @@
+package dnsutils
+
+// record of host file, zone, dynamic update and remote answer is stored in its own bucket of DBCache,
+// so that each of them can be enumerated, dumped and purged independently
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DNSHostBucket    = "host"
+	DNSZoneBucket    = "zone"
+	DNSDynamicBucket = "dynamic"
+	DNSAnswerBucket  = "answer"
+)
+
+// key list of host record in the root of DBCache, which is used before record is stored in bucket
+const legacyHostKeyListCacheKey = "DNSSimpleServerCacheKeyList"
+
+// unboundedBucketCache: DBCache which evicts key by budget, like BoundedMemCache;
+// its UnboundedBucket never evicts key
+type unboundedBucketCache interface {
+	UnboundedBucket(name string) DBCache
+}
+
+// initCacheBucket: only answer bucket may be evicted by budget of DBCache, since record of host, zone and
+// dynamic update can not be fetched again from remote server
+func (ds *DNSSimpleServer) initCacheBucket() {
+	newBucket := ds.dbCache.Bucket
+	if db, ok := ds.dbCache.(unboundedBucketCache); ok {
+		newBucket = db.UnboundedBucket
+	}
+	ds.hostCache = newBucket(DNSHostBucket)
+	ds.zoneCache = newBucket(DNSZoneBucket)
+	ds.dynamicCache = newBucket(DNSDynamicBucket)
+	ds.answerCache = ds.dbCache.Bucket(DNSAnswerBucket)
+}
+
+func (ds *DNSSimpleServer) getCacheBucket(bucket string) (DBCache, error) {
+	switch bucket {
+	case DNSHostBucket:
+		return ds.hostCache, nil
+	case DNSZoneBucket:
+		return ds.zoneCache, nil
+	case DNSDynamicBucket:
+		return ds.dynamicCache, nil
+	case DNSAnswerBucket:
+		return ds.answerCache, nil
+	}
+	return nil, fmt.Errorf("unknown cache bucket[%s]", bucket)
+}
+
+// migrateCache moves record of json format in the root of DBCache to answer bucket, and converts it to binary format;
+// host record in legacyHostKeyListCacheKey is dropped, which is loaded again from host file, and other key in the
+// root of DBCache is not changed, since it is not record of this server or it is not decoded
+func (ds *DNSSimpleServer) migrateCache() (int, error) {
+	keyListStr, err := ds.dbCache.Get(legacyHostKeyListCacheKey)
+	hostKeySet := make(map[string]bool)
+	var oldKeyList []string
+	if err == nil {
+		oldKeyList = append(oldKeyList, legacyHostKeyListCacheKey)
+		for _, key := range strings.Split(keyListStr, keyListSep) {
+			hostKeySet[key] = true
+		}
+	}
+	
+	answerRecord := make(map[string]string)
+	err = ds.dbCache.Scan("", func(key, value string) bool {
+		if hostKeySet[key] {
+			if isLegacyCacheRecord(value) {
+				oldKeyList = append(oldKeyList, key)
+			}
+			return true
+		}
+		if newValue, migrated := migrateCacheRecord(key, value); migrated {
+			answerRecord[key] = newValue
+			oldKeyList = append(oldKeyList, key)
+		}
+		return true
+	})
+	if err != nil || len(oldKeyList) == 0 {
+		return 0, err
+	}
+	
+	if err := ds.answerCache.BatchSet(answerRecord); err != nil {
+		return 0, fmt.Errorf("fail to migrate answer record: %s", err)
+	}
+	if err := ds.dbCache.BatchDelete(oldKeyList); err != nil {
+		return 0, fmt.Errorf("fail to delete migrated record: %s", err)
+	}
+	return len(answerRecord), nil
+}
+
+// CacheLen: count of cache key in bucket
+func (ds *DNSSimpleServer) CacheLen(bucket string) (int, error) {
+	db, err := ds.getCacheBucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return db.Len()
+}
+
+// DumpCache writes record of bucket in master file format, and each cache key and query type is written in comment
+func (ds *DNSSimpleServer) DumpCache(bucket string, w io.Writer) error {
+	db, err := ds.getCacheBucket(bucket)
+	if err != nil {
+		return err
+	}
+	
+	var writeErr error
+	currentTime := time.Duration(time.Now().Unix()) * time.Second
+	err = db.Scan("", func(key, value string) bool {
+		result, _, decodeErr := decodeCacheRecord(value)
+		if decodeErr != nil {
+			_, writeErr = fmt.Fprintf(w, "; %s: invalid record, %s\n", key, decodeErr)
+			return writeErr == nil
+		}
+		rTypeList := make([]int, 0, len(result))
+		for rType := range result {
+			// mark of host record, which has the same record as A or AAAA record
+			if rType != DNSDefaultRType {
+				rTypeList = append(rTypeList, int(rType))
+			}
+		}
+		sort.Ints(rTypeList)
+		
+		for _, rType := range rTypeList {
+			cacheContent := result[uint16(rType)]
+			comment := fmt.Sprintf("; %s %s", key, dns.Type(rType).String())
+			if cacheContent.Negative {
+				comment += " negative " + dns.RcodeToString[cacheContent.Rcode]
+			}
+			if cacheContent.isExpired(currentTime) {
+				comment += " stale"
+			}
+			if _, writeErr = fmt.Fprintln(w, comment); writeErr != nil {
+				return false
+			}
+			rrList := cacheContent.Value
+			if cacheContent.Negative {
+				rrList = cacheContent.Ns
+			}
+			for _, rr := range rrList {
+				if _, writeErr = fmt.Fprintln(w, rr.String()); writeErr != nil {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// PurgeCache removes all record of bucket; purging zone bucket also stops answering for all zone
+func (ds *DNSSimpleServer) PurgeCache(bucket string) error {
+	db, err := ds.getCacheBucket(bucket)
+	if err != nil {
+		return err
+	}
+	switch bucket {
+	case DNSHostBucket:
+		atomic.StoreInt32(&ds.wildcardCount, 0)
+	case DNSZoneBucket:
+		ds.zoneTable.lock.Lock()
+		ds.zoneTable.zoneMap = make(map[string]*dnsZone)
+		ds.zoneTable.lock.Unlock()
+	}
+	return db.Clear()
+}
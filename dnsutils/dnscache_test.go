@@ -0,0 +1,67 @@
+package dnsutils
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestMigrateCache(t *testing.T) {
+	answerValue := encodeTestLegacyCacheRecord(t, newTestLegacyCacheRecord(t))
+	binaryValue, err := encodeCacheRecord(newTestCacheRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostContent := &legacyCacheContent{TTL: LongLiveDNSTTL, Value: "10.0.0.1"}
+	hostValue, err := json.Marshal(legacyCacheContentRecord{Record: map[uint16]*legacyCacheContent{
+		dns.TypeA: hostContent, DNSDefaultRType: hostContent}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	db := NewMemCache("")
+	db.BatchSet(map[string]string{
+		"com.example.a":           answerValue,
+		"lan.host":                string(hostValue),
+		legacyHostKeyListCacheKey: "lan.host",
+		"com.example.b":           binaryValue,
+		"com.example.c":           "{\"record\":",
+		"other":                   "value of other",
+	})
+	ds := newTestServer(t, DNSSimpleServerOptions{DBCache: db})
+	
+	testCases := []struct {
+		name     string
+		db       DBCache
+		key      string
+		expected string
+		exists   bool
+	}{
+		{name: "answer is migrated", db: ds.answerCache, key: "com.example.a", exists: true},
+		{name: "migrated answer is deleted", db: db, key: "com.example.a"},
+		{name: "host record is dropped", db: db, key: "lan.host"},
+		{name: "host key list is dropped", db: db, key: legacyHostKeyListCacheKey},
+		{name: "binary record is kept", db: db, key: "com.example.b", expected: binaryValue, exists: true},
+		{name: "invalid record is kept", db: db, key: "com.example.c", expected: "{\"record\":", exists: true},
+		{name: "other key is kept", db: db, key: "other", expected: "value of other", exists: true},
+		{name: "invalid record is not migrated", db: ds.answerCache, key: "com.example.c"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			value, err := testCase.db.Get(testCase.key)
+			if (err == nil) != testCase.exists {
+				t.Fatalf("key[%s] exists: %t, expected %t", testCase.key, err == nil, testCase.exists)
+			}
+			if len(testCase.expected) > 0 && value != testCase.expected {
+				t.Errorf("value of key[%s] is %q, expected %q", testCase.key, value, testCase.expected)
+			}
+		})
+	}
+	
+	if answerList, err := ds.getRecord("a.example.com.", dns.TypeA); err != nil || len(answerList) != 1 {
+		t.Errorf("answer of migrated record is %v, error is %v", answerList, err)
+	}
+	if count, err := ds.migrateCache(); err != nil || count != 0 {
+		t.Errorf("migrate again: %d record, error is %v", count, err)
+	}
+}
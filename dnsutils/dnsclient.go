@@ -7,22 +7,36 @@ import (
 	"time"
 )
 
+// GetRemoteList: remote server list, default remote servers are used if no valid remote server
 func GetRemoteList(remoteStr string) []string {
-	// prepare remoteList
+	remoteList := parseRemoteList(remoteStr)
+	if len(remoteList) == 0 {
+		remoteList = append(remoteList, "223.5.5.5:53", "223.6.6.6:53")
+	}
+	return remoteList
+}
+
+// parseRemoteList: remote server list without default remote servers, invalid remote server is skipped
+func parseRemoteList(remoteStr string) []string {
 	var remoteList []string
 	for _, remote := range strings.Split(remoteStr, ",") {
+		remote = strings.TrimSpace(remote)
 		if len(remote) < 5 {
 			continue
 		}
-		if len(strings.Split(remote, ":")) == 1 {
+		if isDNSOverHTTPS(remote) {
+			// DoH remote server, like https://dns.google/dns-query
+			remoteList = append(remoteList, remote)
+		} else if isDNSOverTLS(remote) {
+			// DoT remote server, like tls://1.1.1.1:853#cloudflare-dns.com
+			addr, serverName := parseDNSOverTLSRemote(remote)
+			remoteList = append(remoteList, DNSOverTLSScheme+addr+dnsOverTLSServerNameSep+serverName)
+		} else if len(strings.Split(remote, ":")) == 1 {
 			remoteList = append(remoteList, remote+":53")
 		} else {
 			remoteList = append(remoteList, remote)
 		}
 	}
-	if len(remoteList) == 0 {
-		remoteList = append(remoteList, "223.5.5.5:53", "223.6.6.6:53")
-	}
 	return remoteList
 }
 
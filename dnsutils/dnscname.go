@@ -0,0 +1,118 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc1034#section-4.3.2, step 3.a
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// max CNAME followed for one question
+var DNSMaxCNAMEDepth = 8
+
+// follow CNAME chain of name in answer section:
+// return the target which has no record in answer section yet, or empty if chain is complete; loop is true if chain is a loop
+func getCNAMETarget(name string, qType uint16, answerList []dns.RR) (target string, loop bool) {
+	visited := map[string]bool{strings.ToLower(name): true}
+	for {
+		var next string
+		var found bool
+		for _, rr := range answerList {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			found = true
+			if cname, ok := rr.(*dns.CNAME); ok && qType != dns.TypeCNAME {
+				next = cname.Target
+			}
+		}
+		if len(next) == 0 {
+			if found || len(visited) == 1 {
+				// chain is complete, or no CNAME at all
+				return "", false
+			}
+			return name, false
+		}
+		if visited[strings.ToLower(next)] {
+			return "", true
+		}
+		visited[strings.ToLower(next)] = true
+		name = next
+	}
+}
+
+// chaseCNAME completes CNAME chain in answer section with local zone, host record, cache or remote server
+func (ds *DNSSimpleServer) chaseCNAME(r *dns.Msg, m *dns.Msg, question *dns.Question) {
+	if question.Qtype == dns.TypeCNAME || question.Qtype == dns.TypeANY {
+		return
+	}
+	
+	for depth := 0; m.Rcode == dns.RcodeSuccess; depth++ {
+		target, loop := getCNAMETarget(question.Name, question.Qtype, m.Answer)
+		if !loop && len(target) == 0 {
+			break
+		}
+		if loop || depth >= DNSMaxCNAMEDepth {
+			ds.logger.Errorf("fail to follow CNAME of host[%s]: loop or too long chain\n", question.Name)
+			m.Rcode = dns.RcodeServerFailure
+			return
+		}
+		
+		subQuestion := dns.Question{Name: target, Qtype: question.Qtype, Qclass: question.Qclass}
+		subR := r.Copy()
+		subR.Question = []dns.Question{subQuestion}
+		subM := new(dns.Msg)
+		subM.SetReply(subR)
+		ds.answerQuestion(subR, subM, &subQuestion)
+		
+		m.Rcode = subM.Rcode
+		// chain is secure only if every part of it is secure, and authoritative only if every part is from local zone
+		m.AuthenticatedData = m.AuthenticatedData && subM.AuthenticatedData
+		m.Authoritative = m.Authoritative && subM.Authoritative
+		m.Answer = append(m.Answer, subM.Answer...)
+		if len(subM.Answer) == 0 {
+			// NXDOMAIN or NODATA of the target
+			m.Ns = append(m.Ns, subM.Ns...)
+			break
+		}
+	}
+	
+	if ds.flattenApexCNAME {
+		ds.flattenCNAME(m, question)
+	}
+}
+
+// replace CNAME at zone apex with A/AAAA records of its target, as CNAME is not allowed together with SOA/NS
+func (ds *DNSSimpleServer) flattenCNAME(m *dns.Msg, question *dns.Question) {
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return
+	}
+	if len(m.Answer) == 0 || m.Answer[0].Header().Rrtype != dns.TypeCNAME || m.Rcode == dns.RcodeServerFailure {
+		return
+	}
+	zone := ds.findZone(question.Name)
+	if zone == nil || !strings.EqualFold(zone.origin, question.Name) {
+		return
+	}
+	
+	// ttl of flattened record is the min ttl of the whole chain
+	ttl := m.Answer[0].Header().Ttl
+	var answerList []dns.RR
+	for _, rr := range m.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		if rr.Header().Rrtype == question.Qtype {
+			answerList = append(answerList, dns.Copy(rr))
+		}
+	}
+	for _, rr := range answerList {
+		rr.Header().Name = question.Name
+		rr.Header().Ttl = ttl
+	}
+	m.Answer = answerList
+	m.Rcode = dns.RcodeSuccess
+	if len(answerList) == 0 {
+		// apex exists, so NODATA instead of NXDOMAIN of the target
+		m.Ns = []dns.RR{zone.getNegativeSOA()}
+	}
+}
@@ -0,0 +1,245 @@
+package dnsutils
+
+// binary format of cached record, version cacheFormatVersion:
+//   version byte | count uvarint | count * (rType uint16 | ttl varint | flag byte | rcode varint | dnssec byte |
+//   origTTL varint | answer rrList | ns rrList)
+// ttl and origTTL are in second, and rrList is count uvarint followed by length-prefixed DNS wire format of each RR
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	cacheFormatVersion byte = 1
+	cacheFlagNegative  byte = 1
+)
+
+// record of json format, which is stored before binary format: Value is RR string joined by keyListSep,
+// or ip of host record
+type legacyCacheContent struct {
+	TTL   time.Duration `json:"ttl"`
+	Value string        `json:"value"`
+}
+
+type legacyCacheContentRecord struct {
+	Record map[uint16]*legacyCacheContent `json:"record"`
+}
+
+func isLegacyCacheRecord(value string) bool {
+	return strings.Index(value, "{") == 0
+}
+
+func parseRRString(value string) ([]dns.RR, error) {
+	var rList []dns.RR
+	for _, rrStr := range strings.Split(value, keyListSep) {
+		if len(rrStr) > 0 {
+			rr, err := dns.NewRR(rrStr)
+			if err != nil {
+				return nil, fmt.Errorf("fail to create dns.RR from string, error is %s", err)
+			}
+			rList = append(rList, rr)
+		}
+	}
+	return rList, nil
+}
+
+// decodeLegacyCacheRecord: host record of json format keeps ip instead of RR, and it is skipped, since it is
+// loaded again from host file
+func decodeLegacyCacheRecord(value string) (map[uint16]*CacheContent, error) {
+	data := legacyCacheContentRecord{}
+	if err := json.Unmarshal([]byte(value), &data); err != nil {
+		return nil, err
+	}
+	result := make(map[uint16]*CacheContent)
+	for rType, legacyContent := range data.Record {
+		if net.ParseIP(legacyContent.Value) != nil {
+			continue
+		}
+		answerList, err := parseRRString(legacyContent.Value)
+		if err != nil {
+			return nil, err
+		}
+		result[rType] = &CacheContent{TTL: legacyContent.TTL, Value: answerList}
+	}
+	return result, nil
+}
+
+// migrateCacheRecord converts record of json format to binary format; other value, like key list, is not changed,
+// and record without any answer after decoding, like host record, is not migrated
+func migrateCacheRecord(key, value string) (string, bool) {
+	if !isLegacyCacheRecord(value) {
+		return value, false
+	}
+	result, err := decodeLegacyCacheRecord(value)
+	if err != nil || len(result) == 0 {
+		return value, false
+	}
+	newValue, err := encodeCacheRecord(result)
+	if err != nil {
+		return value, false
+	}
+	return newValue, true
+}
+
+func writeUvarint(buf *bytes.Buffer, value uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], value)])
+}
+
+func writeVarint(buf *bytes.Buffer, value int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutVarint(tmp[:], value)])
+}
+
+func writeRRList(buf *bytes.Buffer, rList []dns.RR) error {
+	writeUvarint(buf, uint64(len(rList)))
+	for _, rr := range rList {
+		wire := make([]byte, dns.Len(rr))
+		n, err := dns.PackRR(rr, wire, 0, nil, false)
+		if err != nil {
+			return fmt.Errorf("fail to pack record[%s]: %s", rr, err)
+		}
+		writeUvarint(buf, uint64(n))
+		buf.Write(wire[:n])
+	}
+	return nil
+}
+
+// encodeCacheRecord: binary format of all record of one cache key
+func encodeCacheRecord(result map[uint16]*CacheContent) (string, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(cacheFormatVersion)
+	writeUvarint(buf, uint64(len(result)))
+	for rType, cacheContent := range result {
+		var flag byte
+		if cacheContent.Negative {
+			flag |= cacheFlagNegative
+		}
+		var tmp [2]byte
+		binary.BigEndian.PutUint16(tmp[:], rType)
+		buf.Write(tmp[:])
+		writeVarint(buf, int64(cacheContent.TTL/time.Second))
+		buf.WriteByte(flag)
+		writeVarint(buf, int64(cacheContent.Rcode))
+		buf.WriteByte(byte(cacheContent.DNSSEC))
+		writeVarint(buf, int64(cacheContent.OrigTTL/time.Second))
+		if err := writeRRList(buf, cacheContent.Value); err != nil {
+			return "", err
+		}
+		if err := writeRRList(buf, cacheContent.Ns); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+type cacheRecordReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (reader *cacheRecordReader) readByte() byte {
+	if reader.err != nil {
+		return 0
+	}
+	if reader.off >= len(reader.data) {
+		reader.err = fmt.Errorf("unexpected end of record")
+		return 0
+	}
+	reader.off++
+	return reader.data[reader.off-1]
+}
+
+func (reader *cacheRecordReader) readUint16() uint16 {
+	high, low := reader.readByte(), reader.readByte()
+	return uint16(high)<<8 | uint16(low)
+}
+
+func (reader *cacheRecordReader) readUvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(reader.data[reader.off:])
+	if n <= 0 {
+		reader.err = fmt.Errorf("invalid uvarint at %d", reader.off)
+		return 0
+	}
+	reader.off += n
+	return value
+}
+
+func (reader *cacheRecordReader) readVarint() int64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(reader.data[reader.off:])
+	if n <= 0 {
+		reader.err = fmt.Errorf("invalid varint at %d", reader.off)
+		return 0
+	}
+	reader.off += n
+	return value
+}
+
+func (reader *cacheRecordReader) readRRList() []dns.RR {
+	count := reader.readUvarint()
+	if count > uint64(len(reader.data)) {
+		reader.err = fmt.Errorf("invalid record count %d", count)
+		return nil
+	}
+	var rList []dns.RR
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		size := int(reader.readUvarint())
+		if reader.err != nil {
+			break
+		}
+		if size <= 0 || reader.off+size > len(reader.data) {
+			reader.err = fmt.Errorf("invalid record size %d", size)
+			break
+		}
+		rr, _, err := dns.UnpackRR(reader.data[reader.off:reader.off+size], 0)
+		if err != nil {
+			reader.err = fmt.Errorf("fail to unpack record: %s", err)
+			break
+		}
+		rList = append(rList, rr)
+		reader.off += size
+	}
+	return rList
+}
+
+// decodeCacheRecord: record of binary format, or json format which should be migrated
+func decodeCacheRecord(value string) (result map[uint16]*CacheContent, isLegacy bool, err error) {
+	if isLegacyCacheRecord(value) {
+		result, err = decodeLegacyCacheRecord(value)
+		return result, true, err
+	}
+	reader := &cacheRecordReader{data: []byte(value)}
+	if version := reader.readByte(); reader.err == nil && version != cacheFormatVersion {
+		return nil, false, fmt.Errorf("unknown cache format version %d", version)
+	}
+	count := reader.readUvarint()
+	result = make(map[uint16]*CacheContent)
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		rType := reader.readUint16()
+		cacheContent := &CacheContent{TTL: time.Duration(reader.readVarint()) * time.Second}
+		cacheContent.Negative = reader.readByte()&cacheFlagNegative != 0
+		cacheContent.Rcode = int(reader.readVarint())
+		cacheContent.DNSSEC = DNSSECState(reader.readByte())
+		cacheContent.OrigTTL = time.Duration(reader.readVarint()) * time.Second
+		cacheContent.Value = reader.readRRList()
+		cacheContent.Ns = reader.readRRList()
+		result[rType] = cacheContent
+	}
+	if reader.err != nil {
+		return nil, false, reader.err
+	}
+	return result, false, nil
+}
@@ -0,0 +1,227 @@
+package dnsutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCacheRecord(t testing.TB) map[uint16]*CacheContent {
+	answer, err := dns.NewRR("a.example.com. 60 IN A 10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa, err := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire := time.Duration(time.Now().Unix()+60) * time.Second
+	return map[uint16]*CacheContent{
+		dns.TypeA:    {TTL: expire, Value: []dns.RR{answer}, DNSSEC: DNSSECSecure, OrigTTL: 60 * time.Second},
+		dns.TypeAAAA: {TTL: expire, Negative: true, Rcode: dns.RcodeSuccess, Ns: []dns.RR{soa}, DNSSEC: DNSSECInsecure},
+		dns.TypeMX:   {TTL: expire, Negative: true, Rcode: dns.RcodeServerFailure},
+	}
+}
+
+// positive answer in json format, as it is stored before binary format
+func newTestLegacyCacheRecord(t testing.TB) map[uint16]*CacheContent {
+	record := newTestCacheRecord(t)
+	return map[uint16]*CacheContent{dns.TypeA: {TTL: record[dns.TypeA].TTL, Value: record[dns.TypeA].Value}}
+}
+
+// record of json format, as it is stored before binary format
+func encodeTestLegacyCacheRecord(t testing.TB, result map[uint16]*CacheContent) string {
+	data := legacyCacheContentRecord{Record: make(map[uint16]*legacyCacheContent)}
+	for rType, cacheContent := range result {
+		var rrStrList []string
+		for _, rr := range cacheContent.Value {
+			rrStrList = append(rrStrList, rr.String())
+		}
+		data.Record[rType] = &legacyCacheContent{TTL: cacheContent.TTL, Value: strings.Join(rrStrList, keyListSep)}
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value)
+}
+
+func checkTestCacheRecord(t *testing.T, expected, result map[uint16]*CacheContent) {
+	if len(result) != len(expected) {
+		t.Fatalf("record count is %d, expected %d", len(result), len(expected))
+	}
+	sameRRList := func(rList1, rList2 []dns.RR) bool {
+		if len(rList1) != len(rList2) {
+			return false
+		}
+		for i := range rList1 {
+			if !dns.IsDuplicate(rList1[i], rList2[i]) || rList1[i].Header().Ttl != rList2[i].Header().Ttl {
+				return false
+			}
+		}
+		return true
+	}
+	for rType, expectedContent := range expected {
+		cacheContent, exists := result[rType]
+		if !exists {
+			t.Fatalf("rType[%d] not found", rType)
+		}
+		if cacheContent.TTL != expectedContent.TTL || cacheContent.Negative != expectedContent.Negative ||
+			cacheContent.Rcode != expectedContent.Rcode || cacheContent.DNSSEC != expectedContent.DNSSEC ||
+			cacheContent.OrigTTL != expectedContent.OrigTTL {
+			t.Errorf("rType[%d] is %+v, expected %+v", rType, cacheContent, expectedContent)
+		}
+		if !sameRRList(cacheContent.Value, expectedContent.Value) || !sameRRList(cacheContent.Ns, expectedContent.Ns) {
+			t.Errorf("record of rType[%d] is %v %v, expected %v %v", rType, cacheContent.Value, cacheContent.Ns,
+				expectedContent.Value, expectedContent.Ns)
+		}
+	}
+}
+
+func TestEncodeDecodeCacheRecord(t *testing.T) {
+	record := newTestCacheRecord(t)
+	testCases := []struct {
+		name   string
+		record map[uint16]*CacheContent
+	}{
+		{name: "empty", record: map[uint16]*CacheContent{}},
+		{name: "positive", record: map[uint16]*CacheContent{dns.TypeA: record[dns.TypeA]}},
+		{name: "negative", record: map[uint16]*CacheContent{dns.TypeAAAA: record[dns.TypeAAAA]}},
+		{name: "all", record: record},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			value, err := encodeCacheRecord(testCase.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, isLegacy, err := decodeCacheRecord(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isLegacy {
+				t.Error("binary record is decoded as legacy record")
+			}
+			checkTestCacheRecord(t, testCase.record, result)
+		})
+	}
+}
+
+func TestDecodeCacheRecordInvalid(t *testing.T) {
+	value, err := encodeCacheRecord(newTestCacheRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name  string
+		value string
+	}{
+		{name: "empty", value: ""},
+		{name: "truncated", value: value[:len(value)-3]},
+		{name: "unknown version", value: string([]byte{cacheFormatVersion + 1}) + value[1:]},
+		{name: "invalid json", value: "{\"record\":"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if result, _, err := decodeCacheRecord(testCase.value); err == nil {
+				t.Errorf("expected error, got %v", result)
+			}
+		})
+	}
+}
+
+func TestMigrateCacheRecord(t *testing.T) {
+	record := newTestLegacyCacheRecord(t)
+	legacyValue := encodeTestLegacyCacheRecord(t, record)
+	result, isLegacy, err := decodeCacheRecord(legacyValue)
+	if err != nil || !isLegacy {
+		t.Fatalf("fail to decode legacy record: %v %s", isLegacy, err)
+	}
+	checkTestCacheRecord(t, record, result)
+	
+	value, migrated := migrateCacheRecord("com.example.a", legacyValue)
+	if !migrated || isLegacyCacheRecord(value) {
+		t.Fatalf("legacy record is not migrated: %q", value)
+	}
+	result, isLegacy, err = decodeCacheRecord(value)
+	if err != nil || isLegacy {
+		t.Fatalf("fail to decode migrated record: %v %s", isLegacy, err)
+	}
+	checkTestCacheRecord(t, record, result)
+	
+	// binary record, key list, invalid json record and host record are not changed
+	hostValue := fmt.Sprintf(`{"record":{"%d":{"ttl":%d,"value":"10.0.0.1"},"%d":{"ttl":%d,"value":"10.0.0.1"}}}`,
+		dns.TypeA, LongLiveDNSTTL, DNSDefaultRType, LongLiveDNSTTL)
+	for _, oldValue := range []string{value, "com.example.a" + keyListSep + "com.example.b", "{\"record\":", hostValue} {
+		if newValue, migrated := migrateCacheRecord("key", oldValue); migrated || newValue != oldValue {
+			t.Errorf("value %q is migrated to %q", oldValue, newValue)
+		}
+	}
+}
+
+func TestDecodeLegacyHostRecord(t *testing.T) {
+	answer := newTestLegacyCacheRecord(t)[dns.TypeA]
+	hostContent := &legacyCacheContent{TTL: LongLiveDNSTTL, Value: "10.0.0.1"}
+	testCases := []struct {
+		name     string
+		record   map[uint16]*legacyCacheContent
+		expected map[uint16]*CacheContent
+	}{
+		{name: "ipv4", record: map[uint16]*legacyCacheContent{dns.TypeA: hostContent, DNSDefaultRType: hostContent},
+			expected: map[uint16]*CacheContent{}},
+		{name: "ipv6", record: map[uint16]*legacyCacheContent{dns.TypeA: {TTL: LongLiveDNSTTL, Value: "fd00::1"}},
+			expected: map[uint16]*CacheContent{}},
+		{name: "with answer", record: map[uint16]*legacyCacheContent{DNSDefaultRType: hostContent,
+			dns.TypeA: {TTL: answer.TTL, Value: answer.Value[0].String()}},
+			expected: map[uint16]*CacheContent{dns.TypeA: answer}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			value, err := json.Marshal(legacyCacheContentRecord{Record: testCase.record})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, isLegacy, err := decodeCacheRecord(string(value))
+			if err != nil || !isLegacy {
+				t.Fatalf("fail to decode legacy record: %v %s", isLegacy, err)
+			}
+			checkTestCacheRecord(t, testCase.expected, result)
+		})
+	}
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	record := newTestCacheRecord(b)
+	binaryValue, err := encodeCacheRecord(record)
+	if err != nil {
+		b.Fatal(err)
+	}
+	testCases := []struct {
+		name  string
+		value string
+	}{
+		{name: "json", value: encodeTestLegacyCacheRecord(b, newTestLegacyCacheRecord(b))},
+		{name: "binary", value: binaryValue},
+	}
+	for _, testCase := range testCases {
+		b.Run(testCase.name, func(b *testing.B) {
+			db := NewMemCache("")
+			db.Set("com.example.a", testCase.value)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				value, err := db.Get("com.example.a")
+				if err != nil {
+					b.Fatal(err)
+				}
+				result, _, err := decodeCacheRecord(value)
+				if err != nil || len(result[dns.TypeA].Value) != 1 {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
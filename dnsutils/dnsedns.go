@@ -0,0 +1,224 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc6891, EDNS(0)
+// ref: https://tools.ietf.org/html/rfc7871, Client Subnet in DNS Queries
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+)
+
+type DNSECSMode int
+
+const (
+	// remove client subnet of client, remote server only sees address of this server
+	ECSStrip DNSECSMode = iota
+	// forward client subnet sent by client
+	ECSForward
+	// forward client subnet sent by client, or use address of client if not sent
+	ECSClientAddress
+)
+
+const ecsCacheKeySep = "@"
+
+// scope prefix of cached answer for client subnet
+type ecsScope struct {
+	family uint16
+	prefix uint8
+}
+
+var (
+	// udp payload size of this server and of query to remote server, ref: https://www.dnsflagday.net/2020/
+	DNSEdnsUDPSize uint16 = 1232
+	// max source prefix of client subnet sent to remote server
+	DNSECSIPv4Prefix uint8 = 24
+	DNSECSIPv6Prefix uint8 = 56
+)
+
+// normalize client subnet: source prefix is limited, and address is masked by source prefix
+func newECS(ip net.IP, sourceNetmask uint8) *dns.EDNS0_SUBNET {
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		ecs.Family = 1
+		if sourceNetmask > DNSECSIPv4Prefix {
+			sourceNetmask = DNSECSIPv4Prefix
+		}
+		ecs.Address = ip4.Mask(net.CIDRMask(int(sourceNetmask), 32))
+	} else {
+		ecs.Family = 2
+		if sourceNetmask > DNSECSIPv6Prefix {
+			sourceNetmask = DNSECSIPv6Prefix
+		}
+		ecs.Address = ip.Mask(net.CIDRMask(int(sourceNetmask), 128))
+	}
+	ecs.SourceNetmask = sourceNetmask
+	return ecs
+}
+
+func getECS(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// add client subnet of client address to request, if ECSClientAddress mode and not sent by client
+func (ds *DNSSimpleServer) setClientECS(r *dns.Msg, clientIP net.IP) {
+	if ds.ecsMode != ECSClientAddress || clientIP == nil || clientIP.IsLoopback() || clientIP.IsPrivate() {
+		return
+	}
+	opt := r.IsEdns0()
+	if getECS(opt) != nil {
+		return
+	}
+	if opt == nil {
+		r.SetEdns0(dns.MinMsgSize, false)
+		opt = r.IsEdns0()
+	}
+	opt.Option = append(opt.Option, newECS(clientIP, 128))
+}
+
+// client subnet sent to remote server, nil if stripped
+func (ds *DNSSimpleServer) getUpstreamECS(r *dns.Msg) *dns.EDNS0_SUBNET {
+	if ds.ecsMode == ECSStrip {
+		return nil
+	}
+	ecs := getECS(r.IsEdns0())
+	if ecs == nil || ecs.SourceNetmask == 0 {
+		return nil
+	}
+	return newECS(ecs.Address, ecs.SourceNetmask)
+}
+
+// key of client subnet sent to remote server, for query of the same client subnet to share one remote query;
+// empty if client subnet is not sent
+func (ds *DNSSimpleServer) getECSCacheKey(r *dns.Msg, domain string) string {
+	ecs := ds.getUpstreamECS(r)
+	if ecs == nil {
+		return ""
+	}
+	return ds.getKey(domain) + ecsCacheKeySep + ecs.Address.String() + "/" + strconv.Itoa(int(ecs.SourceNetmask))
+}
+
+// cache key of answer for client subnet: address is masked by scope prefix of remote server, which is limited by
+// source prefix, ref: rfc7871#section-7.3.1
+func (ds *DNSSimpleServer) getECSScopeCacheKey(domain string, ecs *dns.EDNS0_SUBNET, scope uint8) string {
+	if scope > ecs.SourceNetmask {
+		scope = ecs.SourceNetmask
+	}
+	address := newECS(ecs.Address, scope).Address
+	return ds.getKey(domain) + ecsCacheKeySep + address.String() + "/" + strconv.Itoa(int(scope))
+}
+
+// cached answer for client subnet, the longest scope prefix wins; scope prefix without any cached answer is skipped
+func (ds *DNSSimpleServer) getECSRecord(r *dns.Msg, question *dns.Question) (string, []dns.RR) {
+	ecs := ds.getUpstreamECS(r)
+	if ecs == nil {
+		return "", nil
+	}
+	for scope := int(ecs.SourceNetmask); scope > 0; scope-- {
+		if _, exists := ds.ecsScopeSet.Load(ecsScope{family: ecs.Family, prefix: uint8(scope)}); !exists {
+			continue
+		}
+		cacheKey := ds.getECSScopeCacheKey(question.Name, ecs, uint8(scope))
+		if answerList, err := ds.getRecordByKey(ds.answerCache, cacheKey, question.Qtype); err == nil && len(answerList) > 0 {
+			return cacheKey, answerList
+		}
+	}
+	return "", nil
+}
+
+// cache answer of remote server for all client in its scope
+func (ds *DNSSimpleServer) updateECSRecord(r *dns.Msg, newMsg *dns.Msg, question *dns.Question, state DNSSECState) {
+	ecs, replyECS := ds.getUpstreamECS(r), getECS(newMsg.IsEdns0())
+	if ecs == nil || replyECS == nil {
+		return
+	}
+	scope := replyECS.SourceScope
+	if scope > ecs.SourceNetmask {
+		scope = ecs.SourceNetmask
+	}
+	ds.ecsScopeSet.Store(ecsScope{family: ecs.Family, prefix: scope}, true)
+	ds.updateRecordByKey(ds.getECSScopeCacheKey(question.Name, ecs, scope), newMsg.Answer, question.Qtype, state)
+}
+
+// request sent to remote server: hop-by-hop option and TSIG of client are removed, DO bit is passed through, or always
+// set if DNSSEC validation is enabled
+func (ds *DNSSimpleServer) newUpstreamRequest(r *dns.Msg) *dns.Msg {
+	upstreamR := r.Copy()
+	upstreamR.Extra = nil
+	clientOpt := r.IsEdns0()
+	upstreamR.SetEdns0(ds.ednsUDPSize, clientOpt != nil && clientOpt.Do() || ds.dnssecValidator != nil)
+	if ecs := ds.getUpstreamECS(r); ecs != nil {
+		opt := upstreamR.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+	return upstreamR
+}
+
+// whether answer of remote server depends on client subnet
+func isECSScopedAnswer(newMsg *dns.Msg) bool {
+	ecs := getECS(newMsg.IsEdns0())
+	return ecs != nil && ecs.SourceScope > 0
+}
+
+func isDNSSECRecord(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+func removeDNSSECRecord(rList []dns.RR, qType uint16) []dns.RR {
+	var newList []dns.RR
+	for _, rr := range rList {
+		if !isDNSSECRecord(rr) || rr.Header().Rrtype == qType {
+			newList = append(newList, rr)
+		}
+	}
+	return newList
+}
+
+// set OPT of reply by OPT of request, and return max udp size of reply
+func (ds *DNSSimpleServer) setReplyEdns0(clientOpt *dns.OPT, m *dns.Msg) int {
+	if clientOpt == nil || !clientOpt.Do() {
+		// DNSSEC record is only for client with DO bit, ref: rfc3225#section-3
+		var qType uint16
+		if len(m.Question) > 0 {
+			qType = m.Question[0].Qtype
+		}
+		m.Answer = removeDNSSECRecord(m.Answer, qType)
+		m.Ns = removeDNSSECRecord(m.Ns, qType)
+		m.Extra = removeDNSSECRecord(m.Extra, qType)
+	}
+	if clientOpt == nil {
+		return dns.MinMsgSize
+	}
+	
+	udpSize := clientOpt.UDPSize()
+	if udpSize > ds.ednsUDPSize {
+		udpSize = ds.ednsUDPSize
+	}
+	if udpSize < dns.MinMsgSize {
+		udpSize = dns.MinMsgSize
+	}
+	m.SetEdns0(ds.ednsUDPSize, clientOpt.Do())
+	
+	// echo client subnet: scope is the same as source prefix if forwarded, and 0 if the answer is for all client
+	if ecs := getECS(clientOpt); ecs != nil {
+		replyECS := *ecs
+		replyECS.SourceScope = 0
+		if upstreamECS := ds.getUpstreamECS(&dns.Msg{Extra: []dns.RR{clientOpt}}); upstreamECS != nil {
+			replyECS.SourceScope = upstreamECS.SourceNetmask
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &replyECS)
+	}
+	return int(udpSize)
+}
@@ -0,0 +1,146 @@
+package dnsutils
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestNewECS(t *testing.T) {
+	testCases := []struct {
+		ip            string
+		sourceNetmask uint8
+		family        uint16
+		address       string
+		netmask       uint8
+	}{
+		{ip: "198.51.100.7", sourceNetmask: 32, family: 1, address: "198.51.100.0", netmask: 24},
+		{ip: "198.51.100.7", sourceNetmask: 16, family: 1, address: "198.51.0.0", netmask: 16},
+		{ip: "2001:db8:1:2:3::1", sourceNetmask: 128, family: 2, address: "2001:db8:1::", netmask: 56},
+		{ip: "2001:db8:1:2:3::1", sourceNetmask: 48, family: 2, address: "2001:db8:1::", netmask: 48},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("%s/%d", testCase.ip, testCase.sourceNetmask), func(t *testing.T) {
+			ecs := newECS(net.ParseIP(testCase.ip), testCase.sourceNetmask)
+			if ecs.Family != testCase.family || ecs.Address.String() != testCase.address || ecs.SourceNetmask != testCase.netmask {
+				t.Errorf("client subnet is %s", ecs)
+			}
+		})
+	}
+}
+
+// stand-in of geo remote server: answer depends on client subnet with scope prefix 16, and the last byte of answer
+// is the count of remote query
+type testECSUpstream struct {
+	ecsList []string
+	lock    sync.Mutex
+}
+
+func (upstream *testECSUpstream) handle(w dns.ResponseWriter, r *dns.Msg) {
+	upstream.lock.Lock()
+	ecs := getECS(r.IsEdns0())
+	ecsStr := ""
+	if ecs != nil {
+		ecsStr = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+	}
+	upstream.ecsList = append(upstream.ecsList, ecsStr)
+	count := len(upstream.ecsList)
+	upstream.lock.Unlock()
+	
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A: net.IPv4(10, 0, 0, byte(count))})
+	if ecs != nil {
+		replyECS := *ecs
+		if r.Question[0].Name == "geo.test." {
+			replyECS.SourceScope = 16
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &replyECS)
+	}
+	w.WriteMsg(m)
+}
+
+func (upstream *testECSUpstream) getECSList() []string {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	return append([]string{}, upstream.ecsList...)
+}
+
+// query from udp client, client subnet is sent if not empty
+func newTestECSQuery(t *testing.T, name string, subnet string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	if len(subnet) > 0 {
+		ip, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		netmask, _ := ipNet.Mask.Size()
+		r.IsEdns0().Option = append(r.IsEdns0().Option, newECS(ip, uint8(netmask)))
+	}
+	return r
+}
+
+func TestECSScope(t *testing.T) {
+	testCases := []struct {
+		name   string
+		mode   DNSECSMode
+		domain string
+		// client address and client subnet of each query
+		clientList []string
+		subnetList []string
+		// answer of each query, and client subnet received by remote server
+		answerList []string
+		ecsList    []string
+		// scope prefix of client subnet in reply of the last query
+		replyScope int
+	}{
+		{name: "strip", mode: ECSStrip, domain: "geo.test.",
+			clientList: []string{"198.51.100.7", "203.0.113.7"}, subnetList: []string{"198.51.100.0/24", "203.0.113.0/24"},
+			answerList: []string{"10.0.0.1", "10.0.0.1"}, ecsList: []string{""}, replyScope: 0},
+		// answer is shared by client subnet in its scope 198.51.0.0/16
+		{name: "forward", mode: ECSForward, domain: "geo.test.",
+			clientList: []string{"127.0.0.1", "127.0.0.1", "127.0.0.1"}, subnetList: []string{"198.51.100.0/24", "198.51.200.0/24", "203.0.113.0/24"},
+			answerList: []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"}, ecsList: []string{"198.51.100.0/24", "203.0.113.0/24"}, replyScope: 24},
+		// source prefix is limited by DNSECSIPv4Prefix
+		{name: "forward limited", mode: ECSForward, domain: "geo.test.",
+			clientList: []string{"127.0.0.1"}, subnetList: []string{"198.51.100.7/32"},
+			answerList: []string{"10.0.0.1"}, ecsList: []string{"198.51.100.0/24"}, replyScope: 24},
+		// answer of scope 0 is for all client
+		{name: "forward global", mode: ECSForward, domain: "global.test.",
+			clientList: []string{"127.0.0.1", "127.0.0.1", "127.0.0.1"}, subnetList: []string{"198.51.100.0/24", "203.0.113.0/24", ""},
+			answerList: []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"}, ecsList: []string{"198.51.100.0/24"}},
+		// address of public client is used if client subnet is not sent, and private client is not sent
+		{name: "client address", mode: ECSClientAddress, domain: "geo.test.",
+			clientList: []string{"203.0.113.7", "203.0.200.7", "192.168.0.1"}, subnetList: []string{"", "", ""},
+			answerList: []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"}, ecsList: []string{"203.0.113.0/24", ""}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			upstream := &testECSUpstream{}
+			ds := newTestServer(t, DNSSimpleServerOptions{RemoteList: []string{newTestUpstream(t, upstream.handle)}, ECSMode: testCase.mode})
+			var m *dns.Msg
+			for i, client := range testCase.clientList {
+				r := newTestECSQuery(t, testCase.domain, testCase.subnetList[i])
+				m = handleTestRequest(ds, &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}, r)
+				if m == nil || m.Rcode != dns.RcodeSuccess {
+					t.Fatalf("reply of query %d is %v", i, m)
+				}
+				if answerList := getTestAnswer(m); len(answerList) != 1 || answerList[0] != testCase.answerList[i] {
+					t.Errorf("answer of query %d is %v, expected %s", i, answerList, testCase.answerList[i])
+				}
+			}
+			if ecsList := upstream.getECSList(); fmt.Sprint(ecsList) != fmt.Sprint(testCase.ecsList) {
+				t.Errorf("client subnet of remote query is %q, expected %q", ecsList, testCase.ecsList)
+			}
+			if replyECS := getECS(m.IsEdns0()); replyECS != nil && int(replyECS.SourceScope) != testCase.replyScope {
+				t.Errorf("scope prefix of reply is %d, expected %d", replyECS.SourceScope, testCase.replyScope)
+			}
+		})
+	}
+}
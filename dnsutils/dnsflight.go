@@ -0,0 +1,86 @@
+package dnsutils
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+)
+
+// in-flight remote query of one key, which is shared by concurrent callers
+type dnsFlightCall struct {
+	wg  sync.WaitGroup
+	msg *dns.Msg
+}
+
+// dnsFlightGroup: concurrent identical queries are sent to remote server only once
+type dnsFlightGroup struct {
+	callMap map[string]*dnsFlightCall
+	lock    sync.Mutex
+}
+
+func newDNSFlightGroup() *dnsFlightGroup {
+	return &dnsFlightGroup{callMap: make(map[string]*dnsFlightCall), lock: sync.Mutex{}}
+}
+
+// do calls fn once for concurrent callers of the same key, and every caller gets the answer of it; shared is true
+// for caller which waits for the answer of another caller
+func (g *dnsFlightGroup) do(key string, fn func() *dns.Msg) (*dns.Msg, bool) {
+	g.lock.Lock()
+	if call, exists := g.callMap[key]; exists {
+		g.lock.Unlock()
+		call.wg.Wait()
+		return call.msg, true
+	}
+	call := &dnsFlightCall{}
+	call.wg.Add(1)
+	g.callMap[key] = call
+	g.lock.Unlock()
+	
+	defer func() {
+		g.lock.Lock()
+		delete(g.callMap, key)
+		g.lock.Unlock()
+		call.wg.Done()
+	}()
+	call.msg = fn()
+	return call.msg, false
+}
+
+// answer of remote server depends on question, client subnet, and DO/CD bit of request
+func getFlightKey(r *dns.Msg, question *dns.Question, ecsCacheKey string) string {
+	opt := r.IsEdns0()
+	return fmt.Sprintf("%s/%d/%d/%s/%t/%t", strings.ToLower(question.Name), question.Qtype, question.Qclass, ecsCacheKey,
+		opt != nil && opt.Do(), r.CheckingDisabled)
+}
+
+func copyRRList(rList []dns.RR) []dns.RR {
+	var newList []dns.RR
+	for _, rr := range rList {
+		newList = append(newList, dns.Copy(rr))
+	}
+	return newList
+}
+
+// answer question from remote server, concurrent identical questions share one remote query and one cache update
+func (ds *DNSSimpleServer) answerFromRemote(r *dns.Msg, m *dns.Msg, question *dns.Question, ecsCacheKey string, hasCache bool) {
+	subM, shared := ds.flightGroup.do(getFlightKey(r, question, ecsCacheKey), func() *dns.Msg {
+		subM := new(dns.Msg)
+		subM.SetReply(r)
+		ds.queryRemote(r, subM, question, ecsCacheKey, hasCache)
+		return subM
+	})
+	if subM == nil {
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+	if shared {
+		ds.logger.Infof("host[%s] is answered by shared remote query\n", question.Name)
+	}
+	
+	// record of answer may be changed by each caller, e.g. CNAME flattening
+	m.Rcode = subM.Rcode
+	m.AuthenticatedData = subM.AuthenticatedData
+	m.Answer = append(m.Answer, copyRRList(subM.Answer)...)
+	m.Ns = append(m.Ns, copyRRList(subM.Ns)...)
+}
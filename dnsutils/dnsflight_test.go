@@ -0,0 +1,160 @@
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSFlightGroup(t *testing.T) {
+	g := newDNSFlightGroup()
+	var count int32
+	release := make(chan struct{})
+	fn := func() *dns.Msg {
+		atomic.AddInt32(&count, 1)
+		<-release
+		m := new(dns.Msg)
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+	
+	var wg sync.WaitGroup
+	var sharedCount int32
+	msgList := make([]*dns.Msg, 5)
+	for i := range msgList {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m, shared := g.do("key", fn)
+			msgList[i] = m
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+		}(i)
+	}
+	// callers wait for the first call, which is blocked until release
+	for atomic.LoadInt32(&count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	
+	if count != 1 || sharedCount != 4 {
+		t.Errorf("fn is called %d times and shared by %d callers, expected 1 and 4", count, sharedCount)
+	}
+	for _, m := range msgList {
+		if m != msgList[0] {
+			t.Fatalf("caller gets answer of another call: %v", m)
+		}
+	}
+	
+	// key is released after the call, so next call queries again
+	if _, shared := g.do("key", fn); shared || count != 2 {
+		t.Errorf("next call is shared: %t, called %d times", shared, count)
+	}
+}
+
+func TestGetFlightKey(t *testing.T) {
+	newRequest := func(name string, qType uint16, do bool, cd bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qType)
+		if do {
+			r.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		r.CheckingDisabled = cd
+		return r
+	}
+	getKey := func(r *dns.Msg, ecsCacheKey string) string {
+		return getFlightKey(r, &r.Question[0], ecsCacheKey)
+	}
+	base := getKey(newRequest("a.test.", dns.TypeA, false, false), "")
+	testCases := []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{name: "case of name", key: getKey(newRequest("A.Test.", dns.TypeA, false, false), ""), same: true},
+		{name: "type", key: getKey(newRequest("a.test.", dns.TypeAAAA, false, false), "")},
+		{name: "DO bit", key: getKey(newRequest("a.test.", dns.TypeA, true, false), "")},
+		{name: "CD bit", key: getKey(newRequest("a.test.", dns.TypeA, false, true), "")},
+		{name: "client subnet", key: getKey(newRequest("a.test.", dns.TypeA, false, false), "test.a@10.0.0.0/24")},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if (testCase.key == base) != testCase.same {
+				t.Errorf("key %s, base key %s, expected same: %t", testCase.key, base, testCase.same)
+			}
+		})
+	}
+}
+
+func TestAnswerFromRemoteShared(t *testing.T) {
+	var count int32
+	upstream := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&count, 1)
+		// slow remote server, so that concurrent queries arrive while it is in flight
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A: []byte{10, 0, 0, 9}})
+		}
+		w.WriteMsg(m)
+	})
+	
+	testCases := []struct {
+		name     string
+		typeList []uint16
+		count    int32
+	}{
+		{name: "identical", typeList: []uint16{dns.TypeA, dns.TypeA, dns.TypeA, dns.TypeA, dns.TypeA}, count: 1},
+		{name: "different type", typeList: []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeA, dns.TypeAAAA}, count: 2},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ds := newTestServer(t, DNSSimpleServerOptions{RemoteList: []string{upstream}})
+			atomic.StoreInt32(&count, 0)
+			
+			var wg sync.WaitGroup
+			replyList := make([]*dns.Msg, len(testCase.typeList))
+			for i, qType := range testCase.typeList {
+				wg.Add(1)
+				go func(i int, qType uint16) {
+					defer wg.Done()
+					r := new(dns.Msg)
+					r.SetQuestion("shared.test.", qType)
+					replyList[i] = handleTestRequest(ds, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, r)
+				}(i, qType)
+			}
+			wg.Wait()
+			
+			if queryCount := atomic.LoadInt32(&count); queryCount != testCase.count {
+				t.Errorf("remote query is %d, expected %d", queryCount, testCase.count)
+			}
+			var answerList []dns.RR
+			for i, m := range replyList {
+				if m == nil || m.Rcode != dns.RcodeSuccess {
+					t.Fatalf("reply of type %d is %v", testCase.typeList[i], m)
+				}
+				if testCase.typeList[i] != dns.TypeA {
+					continue
+				}
+				if answer := getTestAnswer(m); len(answer) != 1 || answer[0] != "10.0.0.9" {
+					t.Fatalf("answer is %v", answer)
+				}
+				// each caller gets its own copy of record
+				for _, rr := range answerList {
+					if rr == m.Answer[0] {
+						t.Fatalf("record %s is shared by callers", rr)
+					}
+				}
+				answerList = append(answerList, m.Answer[0])
+			}
+		})
+	}
+}
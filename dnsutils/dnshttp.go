@@ -0,0 +1,227 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc8484, DNS Queries over HTTPS (DoH)
+// ref: https://developers.google.com/speed/public-dns/docs/doh/json, JSON API for DNS over HTTPS
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const DNSJsonContentType = "application/dns-json"
+
+// DoH endpoint path registered in http.DefaultServeMux by StartDNSServer, empty means disable
+var DNSOverHTTPSServePath = ""
+
+type DNSJsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type DNSJsonAnswer struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type DNSJsonResponse struct {
+	Status    int               `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []DNSJsonQuestion `json:"Question"`
+	Answer    []DNSJsonAnswer   `json:"Answer,omitempty"`
+	Authority []DNSJsonAnswer   `json:"Authority,omitempty"`
+}
+
+func newDNSJsonAnswerList(rList []dns.RR) []DNSJsonAnswer {
+	var answerList []DNSJsonAnswer
+	for _, rr := range rList {
+		header := rr.Header()
+		answerList = append(answerList, DNSJsonAnswer{
+			Name: header.Name,
+			Type: header.Rrtype,
+			TTL:  header.Ttl,
+			Data: strings.TrimPrefix(rr.String(), header.String()),
+		})
+	}
+	return answerList
+}
+
+func newDNSJsonResponse(m *dns.Msg) *DNSJsonResponse {
+	resp := &DNSJsonResponse{
+		Status:    m.Rcode,
+		TC:        m.Truncated,
+		RD:        m.RecursionDesired,
+		RA:        m.RecursionAvailable,
+		AD:        m.AuthenticatedData,
+		CD:        m.CheckingDisabled,
+		Answer:    newDNSJsonAnswerList(m.Answer),
+		Authority: newDNSJsonAnswerList(m.Ns),
+	}
+	for _, q := range m.Question {
+		resp.Question = append(resp.Question, DNSJsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	return resp
+}
+
+func isDNSJsonRequest(req *http.Request) bool {
+	if strings.Index(req.Header.Get("Accept"), DNSJsonContentType) > -1 || req.URL.Query().Get("ct") == DNSJsonContentType {
+		return true
+	}
+	return req.Method == http.MethodGet && len(req.URL.Query().Get("name")) > 0
+}
+
+func parseDNSJsonRequest(req *http.Request) (*dns.Msg, error) {
+	query := req.URL.Query()
+	name := query.Get("name")
+	if len(name) == 0 {
+		return nil, fmt.Errorf("param `name` is required")
+	}
+	
+	qType := dns.TypeA
+	if typeStr := query.Get("type"); len(typeStr) > 0 {
+		if value, err := strconv.ParseUint(typeStr, 10, 16); err == nil {
+			qType = uint16(value)
+		} else if value, exists := dns.StringToType[strings.ToUpper(typeStr)]; exists {
+			qType = value
+		} else {
+			return nil, fmt.Errorf("invalid param `type`: %s", typeStr)
+		}
+	}
+	
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qType)
+	r.CheckingDisabled = query.Get("cd") == "1" || query.Get("cd") == "true"
+	// AD bit of answer is always reported in json
+	r.AuthenticatedData = true
+	return r, nil
+}
+
+func parseDNSWireRequest(req *http.Request) (*dns.Msg, error) {
+	var buf []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if contentType := req.Header.Get("Content-Type"); strings.Index(contentType, DNSMessageContentType) != 0 {
+			return nil, fmt.Errorf("unsupported content type: %s", contentType)
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(req.Body, dnsOverHTTPSMaxBodySize))
+	default:
+		return nil, fmt.Errorf("unsupported method: %s", req.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("dns query cannot be null")
+	}
+	
+	r := new(dns.Msg)
+	if err := r.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("fail to unpack dns query: %s", err)
+	}
+	return r, nil
+}
+
+// address of http client, proxy header like X-Forwarded-For is not trusted
+func getHTTPClientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// min ttl of answer, used for http cache
+func getMsgMinTTL(m *dns.Msg) (uint32, bool) {
+	var minTTL uint32
+	found := false
+	for _, rList := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rList {
+			if !found || rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return minTTL, found
+}
+
+// ServeHTTP answers DoH queries with the same pipeline of handleDnsRequest,
+// e.g. `pprofServer.AddHandleFunc("/dns-query", ds.ServeHTTP)`
+func (ds *DNSSimpleServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	isJson := isDNSJsonRequest(req)
+	var r *dns.Msg
+	var err error
+	if isJson {
+		r, err = parseDNSJsonRequest(req)
+	} else {
+		r, err = parseDNSWireRequest(req)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Opcode != dns.OpcodeQuery {
+		http.Error(w, "only dns query is supported", http.StatusNotImplemented)
+		return
+	}
+	
+	// DoH client is limited by prefix like udp client, and limited response is not truncated but rejected
+	clientIP := getHTTPClientIP(req)
+	if action, allowed := ds.admitRequest(r, clientIP, true); action != rrlAllow {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	} else if !allowed {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Compress = false
+	clientOpt := r.IsEdns0()
+	if clientOpt != nil {
+		clientOpt = dns.Copy(clientOpt).(*dns.OPT)
+	}
+	ds.setClientECS(r, clientIP)
+	ds.parseQuery(r, m)
+	ds.setReplyEdns0(clientOpt, m)
+	
+	if minTTL, found := getMsgMinTTL(m); found {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL), 10))
+	}
+	
+	if isJson {
+		body, err := json.Marshal(newDNSJsonResponse(m))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", DNSJsonContentType)
+		w.Write(body)
+		return
+	}
+	
+	body, err := m.Pack()
+	if err != nil {
+		ds.logger.Errorf("fail to pack DoH response: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", DNSMessageContentType)
+	w.Write(body)
+}
@@ -0,0 +1,123 @@
+package dnsutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setTestHostRecord saves record to host bucket, like a host file
+func setTestHostRecord(t *testing.T, ds *DNSSimpleServer, rrStrList ...string) {
+	record := make(map[string]map[uint16][]dns.RR)
+	for _, rrStr := range rrStrList {
+		rr := newTestRR(t, rrStr)
+		key := ds.getKey(rr.Header().Name)
+		if record[key] == nil {
+			record[key] = make(map[uint16][]dns.RR)
+		}
+		record[key][rr.Header().Rrtype] = append(record[key][rr.Header().Rrtype], rr)
+	}
+	if err := ds.setBatchValue(ds.hostCache, record, LongLiveDNSTTL, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestDoHRequest(t *testing.T, method string, r *dns.Msg) *http.Request {
+	buf, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method == http.MethodGet {
+		return httptest.NewRequest(method, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	}
+	req := httptest.NewRequest(method, "/dns-query", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", DNSMessageContentType)
+	return req
+}
+
+func TestServeHTTP(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{})
+	setTestHostRecord(t, ds, "foo.example.com. 3600 IN A 10.0.0.1")
+	query := new(dns.Msg)
+	query.SetQuestion("foo.example.com.", dns.TypeA)
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+	
+	testCases := []struct {
+		name        string
+		req         *http.Request
+		status      int
+		contentType string
+		// answer of wire or json response
+		answer string
+		rcode  int
+	}{
+		{name: "wire get", req: newTestDoHRequest(t, http.MethodGet, query), status: http.StatusOK,
+			contentType: DNSMessageContentType, answer: "10.0.0.1"},
+		{name: "wire post", req: newTestDoHRequest(t, http.MethodPost, query), status: http.StatusOK,
+			contentType: DNSMessageContentType, answer: "10.0.0.1"},
+		{name: "json", req: httptest.NewRequest(http.MethodGet, "/resolve?name=foo.example.com&type=A", nil),
+			status: http.StatusOK, contentType: DNSJsonContentType, answer: "10.0.0.1"},
+		{name: "json type name", req: httptest.NewRequest(http.MethodGet, "/resolve?name=foo.example.com&type=aaaa", nil),
+			status: http.StatusOK, contentType: DNSJsonContentType},
+		{name: "json invalid type", req: httptest.NewRequest(http.MethodGet, "/resolve?name=foo.example.com&type=bad", nil),
+			status: http.StatusBadRequest},
+		{name: "wire without query", req: httptest.NewRequest(http.MethodGet, "/dns-query", nil), status: http.StatusBadRequest},
+		{name: "wire invalid query", req: httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil), status: http.StatusBadRequest},
+		{name: "post content type", req: httptest.NewRequest(http.MethodPost, "/dns-query", strings.NewReader("query")),
+			status: http.StatusBadRequest},
+		{name: "update", req: newTestDoHRequest(t, http.MethodPost, update), status: http.StatusNotImplemented},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ds.ServeHTTP(w, testCase.req)
+			if w.Code != testCase.status {
+				t.Fatalf("status is %d, expected %d: %s", w.Code, testCase.status, w.Body.String())
+			}
+			if testCase.status != http.StatusOK {
+				return
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != testCase.contentType {
+				t.Errorf("content type is %s, expected %s", contentType, testCase.contentType)
+			}
+			
+			var rcode int
+			var answerList []string
+			if testCase.contentType == DNSJsonContentType {
+				resp := DNSJsonResponse{}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				rcode = resp.Status
+				for _, answer := range resp.Answer {
+					answerList = append(answerList, answer.Data)
+				}
+			} else {
+				m := new(dns.Msg)
+				if err := m.Unpack(w.Body.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+				rcode = m.Rcode
+				for _, rr := range m.Answer {
+					answerList = append(answerList, rr.(*dns.A).A.String())
+				}
+			}
+			if rcode != testCase.rcode {
+				t.Errorf("rcode is %d, expected %d", rcode, testCase.rcode)
+			}
+			if len(testCase.answer) == 0 && len(answerList) > 0 || len(testCase.answer) > 0 &&
+				(len(answerList) != 1 || answerList[0] != testCase.answer) {
+				t.Errorf("answer is %v, expected %s", answerList, testCase.answer)
+			}
+			if cacheControl := w.Header().Get("Cache-Control"); strings.Index(cacheControl, "max-age=") != 0 {
+				t.Errorf("cache control is %q", cacheControl)
+			}
+		})
+	}
+}
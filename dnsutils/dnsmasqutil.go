@@ -114,10 +114,12 @@ func StartDNSMASQ(addr string, port int, hostFile string, remoteList []string) {
 	
 	// attach new host record trigger
 	if hostDNSUtil != nil {
-		hostDNSUtil.AddHostRecordUpdateTrigger(func(record map[string]string) {
+		hostDNSUtil.AddHostRecordMultiUpdateTrigger(func(record map[string][]string) {
 			var strList []string
-			for host, ip := range record {
-				strList = append(strList, host+"\t"+ip)
+			for host, ipList := range record {
+				for _, ip := range ipList {
+					strList = append(strList, ip+"\t"+host)
+				}
 			}
 			if err := writeStrListToFile(strList, TargetHost, 0644); err != nil {
 				logger.Errorln("fail to update host file: ", err)
@@ -0,0 +1,263 @@
+package dnsutils
+
+import (
+	"fmt"
+	"github.com/frkhit/goutils/common"
+	"github.com/frkhit/logger"
+	"github.com/miekg/dns"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DNSLogger is used by DNSSimpleServer, default to github.com/frkhit/logger
+type DNSLogger interface {
+	Infof(format string, v ...interface{})
+	Infoln(v ...interface{})
+	Errorf(format string, v ...interface{})
+	Errorln(v ...interface{})
+}
+
+type defaultDNSLogger struct{}
+
+func (l *defaultDNSLogger) Infof(format string, v ...interface{}) {
+	logger.Infof(format, v...)
+}
+
+func (l *defaultDNSLogger) Infoln(v ...interface{}) {
+	logger.Infoln(v...)
+}
+
+func (l *defaultDNSLogger) Errorf(format string, v ...interface{}) {
+	logger.Errorf(format, v...)
+}
+
+func (l *defaultDNSLogger) Errorln(v ...interface{}) {
+	logger.Errorln(v...)
+}
+
+// DNSSimpleServerOptions: zero value of each field means default value
+type DNSSimpleServerOptions struct {
+	// cache backend, default is NewMemCache; use NewBoundedMemCache to limit memory of cache, whose budget only
+	// applies to remote answer, or NewRedisCache to share cache between dns servers
+	DBCache DBCache
+	// listen address list, like 127.0.0.1:53; each address is served on both udp and tcp
+	ListenAddrList []string
+	// remote server list, see GetRemoteList
+	RemoteList []string
+	// how to choose remote server, default is UpstreamSequential
+	UpstreamStrategy DNSUpstreamStrategy
+	// domain based remote server rules, see ParseRouteFile
+	RouteFile string
+	// host file loaded by UpdateHostRecordMulti
+	HostFile string
+	// zone origin => RFC 1035 master file, origin may be empty if the file has SOA record of zone apex
+	ZoneFiles map[string]string
+	// answer A/AAAA query of zone apex CNAME with records of its target
+	FlattenApexCNAME bool
+	// keys of signed dynamic update, unsigned update is refused
+	TsigKeys []DNSTsigKey
+	
+	// client allowed to query/update, each one is CIDR or ip, see ParseCIDRList; deny list wins
+	QueryAllowList  []string
+	QueryDenyList   []string
+	UpdateAllowList []string
+	UpdateDenyList  []string
+	// response rate limit of each udp or DoH client prefix, see DNSRateLimitIPv4PrefixLen:
+	// responses per second, 0 means no limit
+	RateLimit float64
+	// max burst of each client prefix, default is RateLimit
+	RateLimitBurst int
+	// every RateLimitSlip-th limited response is sent truncated instead of dropped, 0 means always drop
+	RateLimitSlip int
+	
+	// blocklist and allowlist in hosts, plain domain or adblock format, each one is local file or http(s) url
+	BlockLists []string
+	AllowLists []string
+	// answer of blocked domain, default is BlockNXDomain
+	BlockMode DNSBlockMode
+	// ip list of BlockSinkhole mode, A query is answered with ipv4, and AAAA query with ipv6
+	SinkholeIPList []string
+	
+	// udp payload size of EDNS0, default is DNSEdnsUDPSize
+	EdnsUDPSize uint16
+	// how to send client subnet to remote server, default is ECSStrip
+	ECSMode DNSECSMode
+	// validate answer of remote server, bogus answer is answered with SERVFAIL
+	DNSSECValidation bool
+	// DS or DNSKEY record of trusted zone, default is DNSRootTrustAnchor
+	TrustAnchors []string
+	
+	// refresh cached answer in background when it is queried shortly before expiry
+	Prefetch bool
+	// answer with expired record if remote server fails, see DNSStaleMaxTTL
+	ServeStale bool
+	// how long expired record is kept for serve-stale, default is DNSStaleMaxTTL
+	StaleMaxTTL time.Duration
+	
+	// ttl policy
+	DefaultTTL     time.Duration
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	NegativeMaxTTL time.Duration
+	FailTTL        time.Duration
+	
+	// timeout of each remote query, and timeout of reading/writing client connection
+	QueryTimeout time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	
+	// proxy for DoH remote server, default is DNSOverHTTPSProxyUrl
+	HTTPSProxyUrl string
+	// client of DoH remote server, default is the shared client of httputils with HTTPSProxyUrl and QueryTimeout
+	HTTPClient *http.Client
+	// skip certificate verification of DoT remote server, default is DNSOverTLSInsecureSkipVerify
+	TLSInsecureSkipVerify bool
+	
+	Logger DNSLogger
+}
+
+// NewDNSSimpleServer returns error if options can not be applied, like invalid acl or missing zone file
+func NewDNSSimpleServer(options DNSSimpleServerOptions) (*DNSSimpleServer, error) {
+	ds := &DNSSimpleServer{
+		remoteList:            options.RemoteList,
+		dbCache:               options.DBCache,
+		listenAddrList:        options.ListenAddrList,
+		ttl:                   options.DefaultTTL,
+		minTTL:                options.MinTTL,
+		maxTTL:                options.MaxTTL,
+		negativeMaxTTL:        options.NegativeMaxTTL,
+		failTTL:               options.FailTTL,
+		queryTimeout:          options.QueryTimeout,
+		readTimeout:           options.ReadTimeout,
+		writeTimeout:          options.WriteTimeout,
+		httpsProxyUrl:         options.HTTPSProxyUrl,
+		httpClient:            options.HTTPClient,
+		tlsInsecureSkipVerify: options.TLSInsecureSkipVerify || DNSOverTLSInsecureSkipVerify,
+		logger:                options.Logger,
+		tlsConnPool:           newDNSTLSConnPool(),
+		routeTable:            newDNSRouteTable(),
+		zoneTable:             newDNSZoneTable(),
+		flattenApexCNAME:      options.FlattenApexCNAME,
+		tsigKeyStore:          newDNSTsigKeyStore(),
+		queryACL:              newDNSACL(),
+		updateACL:             newDNSACL(),
+		rateLimiter:           newDNSRateLimiter(options.RateLimit, options.RateLimitBurst, options.RateLimitSlip),
+		ednsUDPSize:           options.EdnsUDPSize,
+		ecsMode:               options.ECSMode,
+		prefetch:              options.Prefetch,
+		flightGroup:           newDNSFlightGroup(),
+	}
+	
+	if ds.dbCache == nil {
+		ds.dbCache = NewMemCache(GetLogPath("data.db"))
+	}
+	if len(ds.listenAddrList) == 0 {
+		ds.listenAddrList = []string{"127.0.0.1:" + strconv.Itoa(DNSPort)}
+	}
+	if len(ds.remoteList) == 0 {
+		ds.remoteList = GetRemoteList("")
+	}
+	ds.remote = ds.remoteList[0]
+	ds.upstreamGroup = newDNSUpstreamGroup(ds.remoteList, options.UpstreamStrategy)
+	if ds.ttl <= 0 {
+		ds.ttl = DNSDefaultTTL
+	}
+	if ds.minTTL <= 0 {
+		ds.minTTL = DNSCacheMinTTL
+	}
+	if ds.maxTTL <= 0 {
+		ds.maxTTL = DNSCacheMaxTTL
+	}
+	if ds.negativeMaxTTL <= 0 {
+		ds.negativeMaxTTL = DNSNegativeMaxTTL
+	}
+	if ds.failTTL <= 0 {
+		ds.failTTL = DNSFailTTL
+	}
+	if ds.queryTimeout <= 0 {
+		ds.queryTimeout = DNSQueryDefaultTimeout
+	}
+	if len(ds.httpsProxyUrl) == 0 {
+		ds.httpsProxyUrl = DNSOverHTTPSProxyUrl
+	}
+	if options.ServeStale {
+		ds.staleMaxTTL = options.StaleMaxTTL
+		if ds.staleMaxTTL <= 0 {
+			ds.staleMaxTTL = DNSStaleMaxTTL
+		}
+	}
+	if ds.ednsUDPSize < dns.MinMsgSize {
+		ds.ednsUDPSize = DNSEdnsUDPSize
+	}
+	if ds.logger == nil {
+		ds.logger = &defaultDNSLogger{}
+	}
+	
+	// acl: invalid acl is an error, instead of starting without acl
+	if err := ds.SetQueryACL(options.QueryAllowList, options.QueryDenyList); err != nil {
+		return nil, fmt.Errorf("invalid query acl: %s", err)
+	}
+	if err := ds.SetUpdateACL(options.UpdateAllowList, options.UpdateDenyList); err != nil {
+		return nil, fmt.Errorf("invalid update acl: %s", err)
+	}
+	
+	// blocker: sinkhole mode without valid sinkhole ip can not answer blocked domain
+	blocker, err := newDNSBlocker(options.BlockMode, options.SinkholeIPList)
+	if err != nil {
+		return nil, err
+	}
+	ds.blocker = blocker
+	
+	// tsig keys: malformed key is an error, instead of refusing all update signed by the key
+	for _, key := range options.TsigKeys {
+		if err := ds.SetTsigKey(key); err != nil {
+			return nil, err
+		}
+	}
+	
+	// dnssec
+	if options.DNSSECValidation {
+		validator, err := newDNSSECValidator(options.TrustAnchors)
+		if err != nil {
+			return nil, fmt.Errorf("fail to enable dnssec validation: %s", err)
+		}
+		ds.dnssecValidator = validator
+	}
+	
+	// record in the root of dbCache is migrated to bucket, and record of json format is migrated to binary format
+	ds.initCacheBucket()
+	if count, err := ds.migrateCache(); err != nil {
+		ds.logger.Errorf("fail to migrate cache record: %s\n", err)
+	} else if count > 0 {
+		ds.logger.Infof("success to migrate %d cache record to bucket\n", count)
+	}
+	
+	// route rules, local zone and host file: server should not start with missing config
+	if len(options.RouteFile) > 0 {
+		if err := ds.LoadRouteFile(options.RouteFile); err != nil {
+			return nil, err
+		}
+	}
+	for origin, zoneFile := range options.ZoneFiles {
+		if err := ds.LoadZoneFile(zoneFile, origin); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.HostFile) > 0 {
+		hostIpRecord, recordErr := common.ParseHostFileMulti(options.HostFile)
+		if recordErr != nil {
+			return nil, fmt.Errorf("fail to parse host file[%s]: %s", options.HostFile, recordErr)
+		}
+		if len(hostIpRecord) > 0 {
+			ds.UpdateHostRecordMulti(hostIpRecord)
+		}
+	}
+	
+	// blocklist is the last one, since remote blocklist is refreshed in background
+	if len(options.BlockLists) > 0 || len(options.AllowLists) > 0 {
+		ds.SetBlocklist(options.BlockLists, options.AllowLists)
+	}
+	
+	return ds, nil
+}
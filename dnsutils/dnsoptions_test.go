@@ -0,0 +1,31 @@
+package dnsutils
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDNSSimpleServerError(t *testing.T) {
+	missingFile := filepath.Join(t.TempDir(), "missing")
+	testCases := []struct {
+		name    string
+		options DNSSimpleServerOptions
+	}{
+		{name: "query acl", options: DNSSimpleServerOptions{QueryAllowList: []string{"10.0.0.0/33"}}},
+		{name: "update acl", options: DNSSimpleServerOptions{UpdateDenyList: []string{"bad"}}},
+		{name: "sinkhole", options: DNSSimpleServerOptions{BlockMode: BlockSinkhole, SinkholeIPList: []string{"bad"}}},
+		{name: "trust anchor", options: DNSSimpleServerOptions{DNSSECValidation: true, TrustAnchors: []string{"bad"}}},
+		{name: "route file", options: DNSSimpleServerOptions{RouteFile: missingFile}},
+		{name: "zone file", options: DNSSimpleServerOptions{ZoneFiles: map[string]string{"example.com.": missingFile}}},
+		{name: "host file", options: DNSSimpleServerOptions{HostFile: missingFile}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.options.DBCache = NewMemCache("")
+			if ds, err := NewDNSSimpleServer(testCase.options); err == nil {
+				ds.Close()
+				t.Error("expected error")
+			}
+		})
+	}
+}
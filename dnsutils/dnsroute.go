@@ -0,0 +1,133 @@
+package dnsutils
+
+import (
+	"fmt"
+	"github.com/frkhit/goutils/common"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+)
+
+const dnsmasqServerPrefix = "server=/"
+
+// route table: reversed label key of domain suffix => upstream group
+type dnsRouteTable struct {
+	groupMap map[string]*dnsUpstreamGroup
+	lock     sync.RWMutex
+}
+
+func newDNSRouteTable() *dnsRouteTable {
+	return &dnsRouteTable{groupMap: make(map[string]*dnsUpstreamGroup), lock: sync.RWMutex{}}
+}
+
+// ParseRouteFile: each line is `domain remote1,remote2` or dnsmasq style `server=/domain1/domain2/ip#port`
+func ParseRouteFile(routeFile string) (map[string][]string, error) {
+	rules := make(map[string][]string)
+	lines, err := common.FileReadLines(routeFile)
+	if err != nil {
+		return rules, err
+	}
+	for index, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.Index(line, "#") == 0 {
+			continue
+		}
+		
+		var domainList, remoteList []string
+		if strings.Index(line, dnsmasqServerPrefix) == 0 {
+			contentList := strings.Split(strings.TrimPrefix(line, dnsmasqServerPrefix), "/")
+			domainList = contentList[:len(contentList)-1]
+			if remote := contentList[len(contentList)-1]; len(remote) > 0 {
+				remoteList = append(remoteList, parseDnsmasqRemote(remote))
+			}
+		} else {
+			contentList := strings.Fields(line)
+			if len(contentList) != 2 {
+				return rules, fmt.Errorf("invalid route rule in line %d: %s", index+1, line)
+			}
+			domainList = []string{contentList[0]}
+			for _, remote := range strings.Split(contentList[1], ",") {
+				if remote = strings.TrimSpace(remote); len(remote) > 0 {
+					remoteList = append(remoteList, remote)
+				}
+			}
+		}
+		if len(domainList) == 0 || len(remoteList) == 0 {
+			return rules, fmt.Errorf("invalid route rule in line %d: %s", index+1, line)
+		}
+		
+		for _, domain := range domainList {
+			domain = strings.Trim(strings.TrimSpace(domain), ".")
+			if len(domain) > 0 {
+				rules[domain] = append(rules[domain], remoteList...)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// parseDnsmasqRemote: ip#port of dnsmasq to ip:port, ipv6 address is bracketed
+func parseDnsmasqRemote(remote string) string {
+	port := "53"
+	if index := strings.LastIndex(remote, "#"); index >= 0 {
+		remote, port = remote[:index], remote[index+1:]
+	}
+	return net.JoinHostPort(remote, port)
+}
+
+// SetRouteRules replaces all route rules: domain suffix => remote server list, longest suffix wins;
+// rule without valid remote server is an error, and rules are not changed, so that its domain is never sent to
+// default remote server
+func (ds *DNSSimpleServer) SetRouteRules(rules map[string][]string) error {
+	groupMap := make(map[string]*dnsUpstreamGroup, len(rules))
+	for domain, remoteList := range rules {
+		validList := parseRemoteList(strings.Join(remoteList, ","))
+		if len(validList) == 0 {
+			return fmt.Errorf("no valid remote server of route rule[%s]: %s", domain, strings.Join(remoteList, ","))
+		}
+		remoteList = validList
+		group := newDNSUpstreamGroup(remoteList, ds.upstreamGroup.strategy)
+		group.name = strings.Trim(domain, ".")
+		groupMap[ds.getKey(dns.Fqdn(group.name))] = group
+	}
+	
+	ds.routeTable.lock.Lock()
+	ds.routeTable.groupMap = groupMap
+	ds.routeTable.lock.Unlock()
+	ds.logger.Infof("success to update route rules, current rule is %d\n", len(groupMap))
+	return nil
+}
+
+// LoadRouteFile loads rules from file, and can be called again to reload at runtime
+func (ds *DNSSimpleServer) LoadRouteFile(routeFile string) error {
+	rules, err := ParseRouteFile(routeFile)
+	if err != nil {
+		return fmt.Errorf("fail to parse route file[%s]: %s", routeFile, err)
+	}
+	if err := ds.SetRouteRules(rules); err != nil {
+		return fmt.Errorf("fail to load route file[%s]: %s", routeFile, err)
+	}
+	return nil
+}
+
+// longest suffix match on reversed label key, like `local.corp.host` => `local.corp` => `local`
+func (ds *DNSSimpleServer) getUpstreamGroup(domain string) *dnsUpstreamGroup {
+	ds.routeTable.lock.RLock()
+	defer ds.routeTable.lock.RUnlock()
+	
+	if len(ds.routeTable.groupMap) > 0 {
+		key := ds.getKey(domain)
+		for len(key) > 0 {
+			if group, exists := ds.routeTable.groupMap[key]; exists {
+				return group
+			}
+			index := strings.LastIndex(key, ".")
+			if index < 0 {
+				break
+			}
+			key = key[:index]
+		}
+	}
+	return ds.upstreamGroup
+}
@@ -0,0 +1,106 @@
+package dnsutils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "test.conf")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParseRouteFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		rules   map[string][]string
+		wantErr bool
+	}{
+		{name: "plain", content: "# comment\ncorp.local 10.0.0.1,10.0.0.2:5353\n\n.lan. 10.0.0.3,,\n",
+			rules: map[string][]string{"corp.local": {"10.0.0.1", "10.0.0.2:5353"}, "lan": {"10.0.0.3"}}},
+		{name: "dnsmasq", content: "server=/a.com/b.com/10.0.0.1\nserver=/c.com/2001:db8::1#5353\n",
+			rules: map[string][]string{"a.com": {"10.0.0.1:53"}, "b.com": {"10.0.0.1:53"}, "c.com": {"[2001:db8::1]:5353"}}},
+		{name: "without remote", content: "corp.local ,\n", wantErr: true},
+		{name: "dnsmasq without remote", content: "server=/corp.local/\n", wantErr: true},
+		{name: "too many fields", content: "corp.local 10.0.0.1 10.0.0.2\n", wantErr: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rules, err := ParseRouteFile(writeTestFile(t, testCase.content))
+			if testCase.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", rules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rules, testCase.rules) {
+				t.Errorf("rules is %v, expected %v", rules, testCase.rules)
+			}
+		})
+	}
+}
+
+func TestGetUpstreamGroup(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{})
+	err := ds.SetRouteRules(map[string][]string{
+		"corp.local":     {"10.0.0.1"},
+		"dev.corp.local": {"10.0.0.2"},
+		"lan":            {"tls://10.0.0.3#dns.lan"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		domain string
+		// name of upstream group, empty means default group
+		group string
+	}{
+		{domain: "corp.local.", group: "corp.local"},
+		{domain: "a.b.corp.local.", group: "corp.local"},
+		{domain: "dev.corp.local.", group: "dev.corp.local"},
+		{domain: "a.dev.corp.local.", group: "dev.corp.local"},
+		{domain: "xdev.corp.local.", group: "corp.local"},
+		{domain: "xcorp.local.", group: ""},
+		{domain: "local.", group: ""},
+		{domain: "host.lan.", group: "lan"},
+		{domain: "example.com.", group: ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.domain, func(t *testing.T) {
+			if group := ds.getUpstreamGroup(testCase.domain); group.name != testCase.group {
+				t.Errorf("group is %q, expected %q", group.name, testCase.group)
+			}
+		})
+	}
+}
+
+func TestSetRouteRulesInvalidRemote(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{})
+	if err := ds.SetRouteRules(map[string][]string{"corp.local": {"10.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	
+	// rule without valid remote is not sent to default remote server, and old rules are kept
+	if err := ds.SetRouteRules(map[string][]string{"corp.local": {"x"}, "lan": {"10.0.0.2"}}); err == nil {
+		t.Error("expected error of rule without valid remote server")
+	}
+	if group := ds.getUpstreamGroup("a.corp.local."); group.name != "corp.local" ||
+		!reflect.DeepEqual(group.upstreamList[0].remote, "10.0.0.1:53") {
+		t.Errorf("group is %q %v", group.name, group.upstreamList)
+	}
+	if group := ds.getUpstreamGroup("a.lan."); group.name != "" {
+		t.Errorf("group of a.lan. is %q", group.name)
+	}
+	if _, err := NewDNSSimpleServer(DNSSimpleServerOptions{DBCache: NewMemCache(""), RouteFile: writeTestFile(t, "corp.local x\n")}); err == nil {
+		t.Error("expected error of route file without valid remote server")
+	}
+}
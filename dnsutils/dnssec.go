@@ -0,0 +1,659 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc4035#section-5, authenticating DNS responses
+// ref: https://tools.ietf.org/html/rfc5155#section-8, validating NSEC3 responses
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DNSSECState int
+
+const (
+	// not validated
+	DNSSECIndeterminate DNSSECState = iota
+	// signature chain to trust anchor is valid
+	DNSSECSecure
+	// zone is not signed, and the parent proves it
+	DNSSECInsecure
+	// signature is invalid or missing
+	DNSSECBogus
+)
+
+var dnssecStateNames = map[DNSSECState]string{
+	DNSSECIndeterminate: "indeterminate",
+	DNSSECSecure:        "secure",
+	DNSSECInsecure:      "insecure",
+	DNSSECBogus:         "bogus",
+}
+
+func (state DNSSECState) String() string {
+	if name, exists := dnssecStateNames[state]; exists {
+		return name
+	}
+	return fmt.Sprintf("DNSSECState(%d)", int(state))
+}
+
+var (
+	// root KSK-2017, ref: https://data.iana.org/root-anchors/root-anchors.xml
+	DNSRootTrustAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+	// max zone followed from answer to trust anchor
+	DNSSECMaxChainDepth = 16
+	// max time of validated DNSKEY and zone cut in memory
+	DNSSECKeyCacheTTL = time.Hour
+	// max zone of validated DNSKEY, and max name of zone cut in memory
+	DNSSECKeyCacheSize = 4096
+)
+
+type dnssecZoneKey struct {
+	keyList []*dns.DNSKEY
+	state   DNSSECState
+	expire  time.Time
+}
+
+type dnssecZoneCut struct {
+	zone   string
+	expire time.Time
+}
+
+// trust anchor, validated DNSKEY of each zone, and zone cut of each name
+type dnssecValidator struct {
+	anchorMap  map[string][]dns.RR
+	keyMap     map[string]*dnssecZoneKey
+	zoneCutMap map[string]*dnssecZoneCut
+	lock       sync.RWMutex
+}
+
+// newDNSSECValidator: each trust anchor is DS or DNSKEY record, default is DNSRootTrustAnchor
+func newDNSSECValidator(anchorList []string) (*dnssecValidator, error) {
+	if len(anchorList) == 0 {
+		anchorList = []string{DNSRootTrustAnchor}
+	}
+	validator := &dnssecValidator{
+		anchorMap:  make(map[string][]dns.RR),
+		keyMap:     make(map[string]*dnssecZoneKey),
+		zoneCutMap: make(map[string]*dnssecZoneCut),
+		lock:       sync.RWMutex{},
+	}
+	for _, anchor := range anchorList {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("fail to parse trust anchor[%s]: %s", anchor, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("trust anchor[%s] is neither DS nor DNSKEY", anchor)
+		}
+		zone := dns.CanonicalName(rr.Header().Name)
+		validator.anchorMap[zone] = append(validator.anchorMap[zone], rr)
+	}
+	return validator, nil
+}
+
+type dnssecRRset struct {
+	rrset   []dns.RR
+	sigList []*dns.RRSIG
+}
+
+func (set *dnssecRRset) owner() string {
+	return dns.CanonicalName(set.rrset[0].Header().Name)
+}
+
+// group record by owner and type, with RRSIG covering it
+func splitRRset(rList []dns.RR) []*dnssecRRset {
+	var setList []*dnssecRRset
+	setMap := make(map[string]*dnssecRRset)
+	getSet := func(name string, rType uint16) *dnssecRRset {
+		key := fmt.Sprintf("%s/%d", dns.CanonicalName(name), rType)
+		if _, exists := setMap[key]; !exists {
+			setMap[key] = &dnssecRRset{}
+			setList = append(setList, setMap[key])
+		}
+		return setMap[key]
+	}
+	for _, rr := range rList {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			set := getSet(sig.Hdr.Name, sig.TypeCovered)
+			set.sigList = append(set.sigList, sig)
+		} else if rr.Header().Rrtype != dns.TypeOPT {
+			set := getSet(rr.Header().Name, rr.Header().Rrtype)
+			set.rrset = append(set.rrset, rr)
+		}
+	}
+	
+	// RRSIG without covered record is ignored
+	var resultList []*dnssecRRset
+	for _, set := range setList {
+		if len(set.rrset) > 0 {
+			resultList = append(resultList, set)
+		}
+	}
+	return resultList
+}
+
+// label count of owner name for RRSIG, wildcard label is not counted, ref: rfc4034#section-3.1.3
+func getOwnerLabels(owner string) int {
+	count := dns.CountLabel(owner)
+	if strings.Index(owner, "*.") == 0 {
+		count--
+	}
+	return count
+}
+
+// the valid signature of rrset with one of the keys, or nil; signature with more labels than owner name is invalid,
+// ref: rfc4035#section-5.3.1
+func verifyRRset(set *dnssecRRset, keyList []*dns.DNSKEY) *dns.RRSIG {
+	now := time.Now()
+	ownerLabels := getOwnerLabels(set.owner())
+	for _, sig := range set.sigList {
+		if !sig.ValidityPeriod(now) || int(sig.Labels) > ownerLabels {
+			continue
+		}
+		for _, key := range keyList {
+			if sig.KeyTag == key.KeyTag() && sig.Verify(key, set.rrset) == nil {
+				return sig
+			}
+		}
+	}
+	return nil
+}
+
+// whether rrset is expanded from wildcard, as its signature has less labels than owner name
+func isWildcardExpanded(set *dnssecRRset, sig *dns.RRSIG) bool {
+	return int(sig.Labels) < getOwnerLabels(set.owner())
+}
+
+func hasNSECType(typeBitMap []uint16, rType uint16) bool {
+	for _, t := range typeBitMap {
+		if t == rType {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical order of domain name, ref: rfc4034#section-6.1
+func canonicalCompare(a, b string) int {
+	labelsA, labelsB := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(labelsA[i], labelsB[j]); c != 0 {
+			return c
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
+
+// whether name is between owner and next name of NSEC, the last NSEC of zone wraps to the apex
+func nsecCover(nsec *dns.NSEC, name string) bool {
+	afterOwner := canonicalCompare(nsec.Hdr.Name, name) < 0
+	beforeNext := canonicalCompare(name, nsec.NextDomain) < 0
+	if canonicalCompare(nsec.Hdr.Name, nsec.NextDomain) >= 0 {
+		return afterOwner || beforeNext
+	}
+	return afterOwner && beforeNext
+}
+
+// query remote server with DO bit, and CD bit so that bogus data is returned for validation
+func (ds *DNSSimpleServer) queryDNSSEC(name string, qType uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qType)
+	r.CheckingDisabled = true
+	r.SetEdns0(ds.ednsUDPSize, true)
+	return ds.queryUpstreamGroup(r, ds.getUpstreamGroup(name))
+}
+
+// apex of the zone which name belongs to, found by SOA query; SOA of other zone is ignored
+func (ds *DNSSimpleServer) findZoneCut(name string) string {
+	name = dns.CanonicalName(name)
+	validator := ds.dnssecValidator
+	validator.lock.RLock()
+	zoneCut, exists := validator.zoneCutMap[name]
+	validator.lock.RUnlock()
+	if exists && time.Now().Before(zoneCut.expire) {
+		return zoneCut.zone
+	}
+	
+	newMsg := ds.queryDNSSEC(name, dns.TypeSOA)
+	if newMsg == nil {
+		return ""
+	}
+	zoneCut = &dnssecZoneCut{expire: time.Now().Add(ds.failTTL)}
+	for _, rList := range [][]dns.RR{newMsg.Answer, newMsg.Ns} {
+		for _, rr := range rList {
+			if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) && len(zoneCut.zone) == 0 {
+				zoneCut = &dnssecZoneCut{zone: dns.CanonicalName(soa.Hdr.Name), expire: time.Now().Add(DNSSECKeyCacheTTL)}
+			}
+		}
+	}
+	validator.lock.Lock()
+	if len(validator.zoneCutMap) >= DNSSECKeyCacheSize {
+		validator.sweep()
+	}
+	validator.zoneCutMap[name] = zoneCut
+	validator.lock.Unlock()
+	return zoneCut.zone
+}
+
+// remove expired DNSKEY and zone cut, then any of them until there is room for new one; caller holds the lock
+func (validator *dnssecValidator) sweep() {
+	now := time.Now()
+	for zone, zoneKey := range validator.keyMap {
+		if now.After(zoneKey.expire) {
+			delete(validator.keyMap, zone)
+		}
+	}
+	for name, zoneCut := range validator.zoneCutMap {
+		if now.After(zoneCut.expire) {
+			delete(validator.zoneCutMap, name)
+		}
+	}
+	for zone := range validator.keyMap {
+		if len(validator.keyMap) < DNSSECKeyCacheSize {
+			break
+		}
+		delete(validator.keyMap, zone)
+	}
+	for name := range validator.zoneCutMap {
+		if len(validator.zoneCutMap) < DNSSECKeyCacheSize {
+			break
+		}
+		delete(validator.zoneCutMap, name)
+	}
+}
+
+// whether name is under a trust anchor, so that data of name is expected to be signed
+func (validator *dnssecValidator) hasTrustAnchor(name string) bool {
+	for zone := range validator.anchorMap {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validated DNSKEY of zone
+func (ds *DNSSimpleServer) getZoneKeys(zone string, depth int) ([]*dns.DNSKEY, DNSSECState) {
+	zone = dns.CanonicalName(zone)
+	validator := ds.dnssecValidator
+	validator.lock.RLock()
+	zoneKey, exists := validator.keyMap[zone]
+	validator.lock.RUnlock()
+	if exists && time.Now().Before(zoneKey.expire) {
+		return zoneKey.keyList, zoneKey.state
+	}
+	if depth > DNSSECMaxChainDepth {
+		ds.logger.Errorf("fail to validate zone[%s]: chain is too long\n", zone)
+		return nil, DNSSECBogus
+	}
+	
+	keyList, state, ttl := ds.fetchZoneKeys(zone, depth)
+	if state == DNSSECBogus {
+		ttl = ds.failTTL
+	} else if ttl <= 0 || ttl > DNSSECKeyCacheTTL {
+		ttl = DNSSECKeyCacheTTL
+	}
+	validator.lock.Lock()
+	if len(validator.keyMap) >= DNSSECKeyCacheSize {
+		validator.sweep()
+	}
+	validator.keyMap[zone] = &dnssecZoneKey{keyList: keyList, state: state, expire: time.Now().Add(ttl)}
+	validator.lock.Unlock()
+	ds.logger.Infof("DNSKEY of zone[%s] is %s\n", zone, state)
+	return keyList, state
+}
+
+// DNSKEY of zone validated by trust anchor or by DS of parent zone, ref: rfc4035#section-5.2
+func (ds *DNSSimpleServer) fetchZoneKeys(zone string, depth int) ([]*dns.DNSKEY, DNSSECState, time.Duration) {
+	trustList := ds.dnssecValidator.anchorMap[zone]
+	if len(trustList) == 0 {
+		if zone == "." {
+			return nil, DNSSECInsecure, DNSSECKeyCacheTTL
+		}
+		dsMsg := ds.queryDNSSEC(zone, dns.TypeDS)
+		if dsMsg == nil {
+			return nil, DNSSECBogus, 0
+		}
+		var dsSet *dnssecRRset
+		for _, set := range splitRRset(dsMsg.Answer) {
+			if set.owner() == zone && set.rrset[0].Header().Rrtype == dns.TypeDS {
+				dsSet = set
+			}
+		}
+		if dsSet == nil {
+			// no DS: insecure delegation only if parent proves it
+			return nil, ds.validateNoDS(zone, dsMsg, depth), DNSSECKeyCacheTTL
+		}
+		if len(dsSet.sigList) == 0 {
+			return nil, ds.getUnsignedState(zone, zone, depth), DNSSECKeyCacheTTL
+		}
+		signer := dns.CanonicalName(dsSet.sigList[0].SignerName)
+		if signer == zone || !dns.IsSubDomain(signer, zone) {
+			return nil, DNSSECBogus, 0
+		}
+		parentKeyList, parentState := ds.getZoneKeys(signer, depth+1)
+		if parentState != DNSSECSecure {
+			return nil, parentState, DNSSECKeyCacheTTL
+		}
+		if verifyRRset(dsSet, parentKeyList) == nil {
+			return nil, DNSSECBogus, 0
+		}
+		trustList = dsSet.rrset
+	}
+	
+	keyMsg := ds.queryDNSSEC(zone, dns.TypeDNSKEY)
+	if keyMsg == nil {
+		return nil, DNSSECBogus, 0
+	}
+	var keySet *dnssecRRset
+	for _, set := range splitRRset(keyMsg.Answer) {
+		if set.owner() == zone && set.rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+			keySet = set
+		}
+	}
+	if keySet == nil {
+		return nil, DNSSECBogus, 0
+	}
+	
+	// DNSKEY rrset is signed by a key which matches DS or trust anchor; key without Zone Key flag can not sign
+	// data of zone, ref: rfc4034#section-2.1.1
+	var keyList, trustedKeyList []*dns.DNSKEY
+	for _, rr := range keySet.rrset {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.ZONE == 0 {
+			continue
+		}
+		keyList = append(keyList, key)
+		for _, trust := range trustList {
+			switch t := trust.(type) {
+			case *dns.DS:
+				if digest := key.ToDS(t.DigestType); digest != nil && t.KeyTag == key.KeyTag() && t.Algorithm == key.Algorithm && strings.EqualFold(digest.Digest, t.Digest) {
+					trustedKeyList = append(trustedKeyList, key)
+				}
+			case *dns.DNSKEY:
+				if t.Algorithm == key.Algorithm && t.PublicKey == key.PublicKey {
+					trustedKeyList = append(trustedKeyList, key)
+				}
+			}
+		}
+	}
+	if len(trustedKeyList) == 0 || verifyRRset(keySet, trustedKeyList) == nil {
+		return nil, DNSSECBogus, 0
+	}
+	return keyList, DNSSECSecure, time.Duration(keySet.rrset[0].Header().Ttl) * time.Second
+}
+
+// state of unsigned data of name in zone: bogus if the zone is signed, else insecure; if zone is unknown or is not an
+// ancestor of name, it is bogus if name is under a trust anchor
+func (ds *DNSSimpleServer) getUnsignedState(name, zone string, depth int) DNSSECState {
+	if len(zone) == 0 || !dns.IsSubDomain(zone, name) {
+		if ds.dnssecValidator.hasTrustAnchor(name) {
+			return DNSSECBogus
+		}
+		return DNSSECInsecure
+	}
+	if _, state := ds.getZoneKeys(zone, depth+1); state == DNSSECSecure {
+		return DNSSECBogus
+	} else {
+		return state
+	}
+}
+
+// verify all rrset of authority section, signed by the same zone; return the signer and state
+func (ds *DNSSimpleServer) verifyAuthority(setList []*dnssecRRset, depth int) (string, DNSSECState) {
+	var signer string
+	for _, set := range setList {
+		if len(set.sigList) > 0 {
+			signer = dns.CanonicalName(set.sigList[0].SignerName)
+			break
+		}
+	}
+	if len(signer) == 0 {
+		return "", DNSSECIndeterminate
+	}
+	keyList, state := ds.getZoneKeys(signer, depth+1)
+	if state != DNSSECSecure {
+		return signer, state
+	}
+	for _, set := range setList {
+		if !dns.IsSubDomain(signer, set.owner()) || verifyRRset(set, keyList) == nil {
+			return signer, DNSSECBogus
+		}
+	}
+	return signer, DNSSECSecure
+}
+
+func getSOAOwner(setList []*dnssecRRset) string {
+	for _, set := range setList {
+		if set.rrset[0].Header().Rrtype == dns.TypeSOA {
+			return set.owner()
+		}
+	}
+	return ""
+}
+
+// whether type bit map is of a delegation without DS: NS is set, and SOA is not set as it is not the apex of child zone,
+// ref: rfc6840#section-4.4
+func isInsecureDelegation(typeBitMap []uint16) bool {
+	return hasNSECType(typeBitMap, dns.TypeNS) && !hasNSECType(typeBitMap, dns.TypeSOA) && !hasNSECType(typeBitMap, dns.TypeDS)
+}
+
+// NODATA of DS, signed by parent zone, proves that zone is an insecure delegation
+func (ds *DNSSimpleServer) validateNoDS(zone string, dsMsg *dns.Msg, depth int) DNSSECState {
+	setList := splitRRset(dsMsg.Ns)
+	signer, state := ds.verifyAuthority(setList, depth)
+	if state == DNSSECIndeterminate {
+		// parent zone is not signed, or signature is stripped; SOA of parent zone is a proper ancestor of zone
+		parent := getSOAOwner(setList)
+		if parent == zone {
+			parent = ""
+		}
+		return ds.getUnsignedState(zone, parent, depth)
+	}
+	if state != DNSSECSecure {
+		return state
+	}
+	if signer == zone || !dns.IsSubDomain(signer, zone) {
+		return DNSSECBogus
+	}
+	
+	for _, set := range setList {
+		for _, rr := range set.rrset {
+			switch record := rr.(type) {
+			case *dns.NSEC:
+				if dns.CanonicalName(record.Hdr.Name) == zone && isInsecureDelegation(record.TypeBitMap) {
+					return DNSSECInsecure
+				}
+			case *dns.NSEC3:
+				if record.Match(zone) && isInsecureDelegation(record.TypeBitMap) {
+					return DNSSECInsecure
+				}
+				// opt-out: unsigned delegation is not in NSEC3 chain
+				if record.Cover(zone) && record.Flags&1 == 1 {
+					return DNSSECInsecure
+				}
+			}
+		}
+	}
+	return DNSSECBogus
+}
+
+// the longest common ancestor of name, with owner or next name of NSEC which covers name
+func nsecClosestEncloser(nsec *dns.NSEC, name string) string {
+	count := dns.CompareDomainName(name, nsec.Hdr.Name)
+	if nextCount := dns.CompareDomainName(name, nsec.NextDomain); nextCount > count {
+		count = nextCount
+	}
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-count:], "."))
+}
+
+func getWildcardName(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// NSEC/NSEC3 of authority section proves NXDOMAIN or NODATA of question; NXDOMAIN is proved only if wildcard of
+// closest encloser does not exist either, ref: rfc4035#section-5.4, rfc5155#section-8.4
+func isDenialProved(question *dns.Question, rcode int, setList []*dnssecRRset) bool {
+	name := dns.CanonicalName(question.Name)
+	var nsecList []*dns.NSEC
+	var nsec3List []*dns.NSEC3
+	for _, set := range setList {
+		for _, rr := range set.rrset {
+			switch record := rr.(type) {
+			case *dns.NSEC:
+				nsecList = append(nsecList, record)
+				if rcode == dns.RcodeSuccess && dns.CanonicalName(record.Hdr.Name) == name &&
+					!hasNSECType(record.TypeBitMap, question.Qtype) && !hasNSECType(record.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+			case *dns.NSEC3:
+				nsec3List = append(nsec3List, record)
+				if rcode == dns.RcodeSuccess && record.Match(name) &&
+					!hasNSECType(record.TypeBitMap, question.Qtype) && !hasNSECType(record.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+			}
+		}
+	}
+	if rcode != dns.RcodeNameError {
+		return false
+	}
+	
+	for _, record := range nsecList {
+		if !nsecCover(record, name) {
+			continue
+		}
+		wildcard := getWildcardName(nsecClosestEncloser(record, name))
+		for _, wildcardRecord := range nsecList {
+			if nsecCover(wildcardRecord, wildcard) {
+				return true
+			}
+		}
+	}
+	if len(nsec3List) == 0 {
+		return false
+	}
+	
+	// closest encloser proof: closest encloser matches, and next closer name and wildcard are covered
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser, nextCloser := dns.Fqdn(strings.Join(labels[i:], ".")), dns.Fqdn(strings.Join(labels[i-1:], "."))
+		var matched, covered, wildcardCovered bool
+		for _, record := range nsec3List {
+			matched = matched || record.Match(encloser)
+			covered = covered || record.Cover(nextCloser)
+			wildcardCovered = wildcardCovered || record.Cover(getWildcardName(encloser))
+		}
+		if matched {
+			return covered && wildcardCovered
+		}
+	}
+	return false
+}
+
+// wildcard expanded answer is valid only if there is no closer match: NSEC covers the name, or NSEC3 covers the next
+// closer name, ref: rfc4035#section-5.3.4, rfc5155#section-8.8
+func isWildcardProved(set *dnssecRRset, sig *dns.RRSIG, setList []*dnssecRRset) bool {
+	labels := dns.SplitDomainName(set.owner())
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+	for _, authoritySet := range setList {
+		for _, rr := range authoritySet.rrset {
+			switch record := rr.(type) {
+			case *dns.NSEC:
+				if nsecCover(record, set.owner()) {
+					return true
+				}
+			case *dns.NSEC3:
+				if record.Cover(nextCloser) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// state of rrset, and its signature if it is valid
+func (ds *DNSSimpleServer) validateRRset(set *dnssecRRset) (DNSSECState, *dns.RRSIG) {
+	if len(set.sigList) == 0 {
+		return ds.getUnsignedState(set.owner(), ds.findZoneCut(set.owner()), 0), nil
+	}
+	state := DNSSECBogus
+	for _, sig := range set.sigList {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, set.owner()) {
+			continue
+		}
+		keyList, keyState := ds.getZoneKeys(signer, 0)
+		if keyState != DNSSECSecure {
+			state = keyState
+			continue
+		}
+		if validSig := verifyRRset(set, keyList); validSig != nil {
+			return DNSSECSecure, validSig
+		}
+	}
+	return state, nil
+}
+
+// validateMsg: state of answer from remote server; positive answer is validated by each rrset, and negative answer
+// by signed NSEC/NSEC3 of authority section
+func (ds *DNSSimpleServer) validateMsg(question *dns.Question, newMsg *dns.Msg) DNSSECState {
+	setList := splitRRset(newMsg.Answer)
+	if len(setList) > 0 {
+		state := DNSSECSecure
+		for _, set := range setList {
+			setState, sig := ds.validateRRset(set)
+			switch setState {
+			case DNSSECSecure:
+			case DNSSECInsecure:
+				state = DNSSECInsecure
+				continue
+			default:
+				return DNSSECBogus
+			}
+			if !isWildcardExpanded(set, sig) {
+				continue
+			}
+			authorityList := splitRRset(newMsg.Ns)
+			if _, authorityState := ds.verifyAuthority(authorityList, 0); authorityState != DNSSECSecure ||
+				!isWildcardProved(set, sig, authorityList) {
+				ds.logger.Errorf("fail to validate wildcard answer of host[%s]: closer match is not denied\n", set.owner())
+				return DNSSECBogus
+			}
+		}
+		return state
+	}
+	
+	setList = splitRRset(newMsg.Ns)
+	_, state := ds.verifyAuthority(setList, 0)
+	if state == DNSSECIndeterminate {
+		// unsigned negative answer without SOA of the zone of question can not prove that the zone is insecure
+		return ds.getUnsignedState(question.Name, getSOAOwner(setList), 0)
+	}
+	if state != DNSSECSecure {
+		return state
+	}
+	if !isDenialProved(question, newMsg.Rcode, setList) {
+		return DNSSECBogus
+	}
+	return DNSSECSecure
+}
+
+// validation state of cached answer
+func (ds *DNSSimpleServer) getRecordState(cacheKey string, rType uint16) DNSSECState {
+	if ds.dnssecValidator == nil {
+		return DNSSECIndeterminate
+	}
+	if cacheContent := ds.getCacheContent(cacheKey, rType); cacheContent != nil {
+		return cacheContent.DNSSEC
+	}
+	return DNSSECIndeterminate
+}
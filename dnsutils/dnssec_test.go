@@ -0,0 +1,275 @@
+package dnsutils
+
+import (
+	"crypto"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zone signed by one key, which is both KSK and ZSK
+type testSignedZone struct {
+	origin string
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func newTestSignedZone(t *testing.T, origin string, flags uint16) *testSignedZone {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags: flags, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	privateKey, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSignedZone{origin: origin, key: key, signer: privateKey.(crypto.Signer)}
+}
+
+func (zone *testSignedZone) getDS() *dns.DS {
+	return zone.key.ToDS(dns.SHA256)
+}
+
+func (zone *testSignedZone) getSOA(t *testing.T) dns.RR {
+	return newTestRR(t, zone.origin+" 300 IN SOA ns."+zone.origin+" admin."+zone.origin+" 1 3600 600 86400 300")
+}
+
+// rrset with its RRSIG, which expires at expiration
+func (zone *testSignedZone) signWithExpiration(t *testing.T, expiration time.Time, rrList ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{Hdr: dns.RR_Header{Ttl: rrList[0].Header().Ttl}, KeyTag: zone.key.KeyTag(), SignerName: zone.origin,
+		Algorithm: zone.key.Algorithm, Inception: uint32(expiration.Add(-2 * time.Hour).Unix()), Expiration: uint32(expiration.Unix())}
+	if err := sig.Sign(zone.signer, rrList); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrList, sig)
+}
+
+func (zone *testSignedZone) sign(t *testing.T, rrList ...dns.RR) []dns.RR {
+	return zone.signWithExpiration(t, time.Now().Add(time.Hour), rrList...)
+}
+
+// remote server of test zones: reply of each `name type`, and count of query
+type testDNSSECUpstream struct {
+	replyMap   map[string]*dns.Msg
+	queryCount map[string]int
+	lock       sync.Mutex
+}
+
+func (upstream *testDNSSECUpstream) add(name string, qType uint16, rcode int, answerList []dns.RR, nsList ...dns.RR) {
+	m := &dns.Msg{Answer: answerList, Ns: nsList}
+	m.Rcode = rcode
+	upstream.replyMap[name+" "+dns.TypeToString[qType]] = m
+}
+
+func (upstream *testDNSSECUpstream) handle(w dns.ResponseWriter, r *dns.Msg) {
+	key := r.Question[0].Name + " " + dns.TypeToString[r.Question[0].Qtype]
+	upstream.lock.Lock()
+	upstream.queryCount[key]++
+	reply, exists := upstream.replyMap[key]
+	upstream.lock.Unlock()
+	
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	if exists {
+		m.Rcode = reply.Rcode
+		m.Answer, m.Ns = reply.Answer, reply.Ns
+	} else {
+		m.Rcode = dns.RcodeRefused
+	}
+	w.WriteMsg(m)
+}
+
+func (upstream *testDNSSECUpstream) getQueryCount(name string, qType uint16) int {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	return upstream.queryCount[name+" "+dns.TypeToString[qType]]
+}
+
+// NSEC3 with empty salt and no iteration, owner and next name are hash or hex string of 32 chars
+func newTestNSEC3(t *testing.T, zone string, owner string, next string, typeList string) dns.RR {
+	return newTestRR(t, strings.ToLower(owner)+"."+zone+" 300 IN NSEC3 1 0 0 - "+next+" "+typeList)
+}
+
+// trust anchor test., signed child zone sec.test. and n3.test., unsigned child zone insec.test., signed child zone
+// nods.test. without DS in parent, and child zone noflag.test. whose key has no Zone Key flag
+func newTestDNSSECUpstream(t *testing.T) (*testDNSSECUpstream, *testSignedZone) {
+	upstream := &testDNSSECUpstream{replyMap: make(map[string]*dns.Msg), queryCount: make(map[string]int)}
+	root := newTestSignedZone(t, "test.", 257)
+	sec := newTestSignedZone(t, "sec.test.", 257)
+	n3 := newTestSignedZone(t, "n3.test.", 257)
+	nods := newTestSignedZone(t, "nods.test.", 257)
+	noFlag := newTestSignedZone(t, "noflag.test.", 1)
+	for _, zone := range []*testSignedZone{root, sec, n3, nods, noFlag} {
+		upstream.add(zone.origin, dns.TypeDNSKEY, dns.RcodeSuccess, zone.sign(t, zone.key))
+		upstream.add(zone.origin, dns.TypeSOA, dns.RcodeSuccess, zone.sign(t, zone.getSOA(t)))
+	}
+	for _, zone := range []*testSignedZone{sec, n3, noFlag} {
+		upstream.add(zone.origin, dns.TypeDS, dns.RcodeSuccess, root.sign(t, zone.getDS()))
+	}
+	rootSOA := root.sign(t, root.getSOA(t))
+	
+	// positive answer
+	upstream.add("www.test.", dns.TypeA, dns.RcodeSuccess, root.sign(t, newTestRR(t, "www.test. 60 IN A 10.0.0.1")))
+	badList := root.sign(t, newTestRR(t, "bad.test. 60 IN A 10.0.0.2"))
+	badList[0].(*dns.A).A = []byte{10, 6, 6, 6}
+	upstream.add("bad.test.", dns.TypeA, dns.RcodeSuccess, badList)
+	upstream.add("expired.test.", dns.TypeA, dns.RcodeSuccess,
+		root.signWithExpiration(t, time.Now().Add(-time.Hour), newTestRR(t, "expired.test. 60 IN A 10.0.0.3")))
+	upstream.add("unsigned.test.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newTestRR(t, "unsigned.test. 60 IN A 10.0.0.4")})
+	upstream.add("www.sec.test.", dns.TypeA, dns.RcodeSuccess, sec.sign(t, newTestRR(t, "www.sec.test. 60 IN A 10.0.1.1")))
+	upstream.add("www.nods.test.", dns.TypeA, dns.RcodeSuccess, nods.sign(t, newTestRR(t, "www.nods.test. 60 IN A 10.0.2.1")))
+	upstream.add("www.noflag.test.", dns.TypeA, dns.RcodeSuccess, noFlag.sign(t, newTestRR(t, "www.noflag.test. 60 IN A 10.0.3.1")))
+	
+	// wildcard expanded answer: signed as *.wild.test., with or without NSEC which proves that the name does not exist
+	wildList := root.sign(t, newTestRR(t, "*.wild.test. 60 IN A 10.0.0.5"))
+	for _, name := range []string{"a.wild.test.", "b.wild.test."} {
+		answerList := []dns.RR{dns.Copy(wildList[0]), dns.Copy(wildList[1])}
+		answerList[0].Header().Name, answerList[1].Header().Name = name, name
+		var nsList []dns.RR
+		if name == "a.wild.test." {
+			nsList = root.sign(t, newTestRR(t, "*.wild.test. 300 IN NSEC www.test. A RRSIG NSEC"))
+		}
+		upstream.add(name, dns.TypeA, dns.RcodeSuccess, answerList, nsList...)
+	}
+	
+	// insecure delegation: NSEC of parent proves that there is no DS
+	upstream.add("insec.test.", dns.TypeDS, dns.RcodeSuccess, nil,
+		append(rootSOA, root.sign(t, newTestRR(t, "insec.test. 300 IN NSEC nods.test. NS RRSIG NSEC"))...)...)
+	upstream.add("www.insec.test.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newTestRR(t, "www.insec.test. 60 IN A 10.0.4.1")})
+	upstream.add("www.insec.test.", dns.TypeSOA, dns.RcodeSuccess, nil, newTestRR(t, "insec.test. 300 IN SOA ns.insec.test. admin.insec.test. 1 3600 600 86400 300"))
+	// missing DS without proof
+	upstream.add("nods.test.", dns.TypeDS, dns.RcodeSuccess, nil, rootSOA...)
+	
+	// NSEC denial: NXDOMAIN with or without wildcard proof, and NODATA
+	upstream.add("nx.test.", dns.TypeA, dns.RcodeNameError, nil, append(append(rootSOA,
+		root.sign(t, newTestRR(t, "noflag.test. 300 IN NSEC sec.test. NS DS RRSIG NSEC"))...),
+		root.sign(t, newTestRR(t, "test. 300 IN NSEC bad.test. NS SOA RRSIG NSEC DNSKEY"))...)...)
+	upstream.add("nx2.test.", dns.TypeA, dns.RcodeNameError, nil, append(rootSOA,
+		root.sign(t, newTestRR(t, "noflag.test. 300 IN NSEC sec.test. NS DS RRSIG NSEC"))...)...)
+	upstream.add("www.test.", dns.TypeAAAA, dns.RcodeSuccess, nil, append(rootSOA,
+		root.sign(t, newTestRR(t, "www.test. 300 IN NSEC test. A RRSIG NSEC"))...)...)
+	upstream.add("www.test.", dns.TypeMX, dns.RcodeSuccess, nil, append(rootSOA,
+		root.sign(t, newTestRR(t, "www.test. 300 IN NSEC test. MX RRSIG NSEC"))...)...)
+	
+	// NSEC3 denial: apex matches, and the other NSEC3 covers every other hash; closest encloser is not proved without
+	// NSEC3 of apex
+	n3SOA := n3.sign(t, n3.getSOA(t))
+	apexHash := dns.HashName("n3.test.", dns.SHA1, 0, "")
+	apexNSEC3 := n3.sign(t, newTestNSEC3(t, "n3.test.", apexHash, apexHash, "NS SOA RRSIG DNSKEY NSEC3PARAM"))
+	coverNSEC3 := n3.sign(t, newTestNSEC3(t, "n3.test.", strings.Repeat("0", 32), strings.Repeat("V", 32), "A RRSIG"))
+	upstream.add("nx.n3.test.", dns.TypeA, dns.RcodeNameError, nil, append(append(n3SOA, apexNSEC3...), coverNSEC3...)...)
+	upstream.add("nx2.n3.test.", dns.TypeA, dns.RcodeNameError, nil, append(n3SOA, coverNSEC3...)...)
+	upstream.add("n3.test.", dns.TypeA, dns.RcodeSuccess, nil, append(n3SOA, apexNSEC3...)...)
+	return upstream, root
+}
+
+func TestValidateMsg(t *testing.T) {
+	upstream, root := newTestDNSSECUpstream(t)
+	ds := newTestServer(t, DNSSimpleServerOptions{
+		RemoteList:       []string{newTestUpstream(t, upstream.handle)},
+		DNSSECValidation: true,
+		TrustAnchors:     []string{root.key.String()},
+	})
+	// bogus answer is returned to client which disables checking
+	r := new(dns.Msg)
+	r.SetQuestion("bad.test.", dns.TypeA)
+	r.SetEdns0(dns.DefaultMsgSize, true)
+	r.CheckingDisabled = true
+	if m := handleTestRequest(ds, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, r); m.Rcode != dns.RcodeSuccess || m.AuthenticatedData || len(m.Answer) != 2 {
+		t.Errorf("reply with CD bit is %s", m)
+	}
+	
+	testCases := []struct {
+		name  string
+		qType uint16
+		rcode int
+		ad    bool
+		// count of answer record, RRSIG is included
+		answer int
+	}{
+		{name: "www.test.", qType: dns.TypeA, ad: true, answer: 2},
+		{name: "bad.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "expired.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "unsigned.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "www.sec.test.", qType: dns.TypeA, ad: true, answer: 2},
+		{name: "www.insec.test.", qType: dns.TypeA, answer: 1},
+		// missing DS without proof of insecure delegation, and key without Zone Key flag
+		{name: "www.nods.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "www.noflag.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "a.wild.test.", qType: dns.TypeA, ad: true, answer: 2},
+		// wildcard expanded answer without NSEC of the name
+		{name: "b.wild.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "nx.test.", qType: dns.TypeA, rcode: dns.RcodeNameError, ad: true},
+		// NXDOMAIN without NSEC of wildcard
+		{name: "nx2.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "www.test.", qType: dns.TypeAAAA, ad: true},
+		// NODATA of type in NSEC type bit map
+		{name: "www.test.", qType: dns.TypeMX, rcode: dns.RcodeServerFailure},
+		{name: "nx.n3.test.", qType: dns.TypeA, rcode: dns.RcodeNameError, ad: true},
+		{name: "nx2.n3.test.", qType: dns.TypeA, rcode: dns.RcodeServerFailure},
+		{name: "n3.test.", qType: dns.TypeA, ad: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name+dns.TypeToString[testCase.qType], func(t *testing.T) {
+			// answer from remote server, then from cache
+			for i := 0; i < 2; i++ {
+				r := new(dns.Msg)
+				r.SetQuestion(testCase.name, testCase.qType)
+				r.SetEdns0(dns.DefaultMsgSize, true)
+				m := handleTestRequest(ds, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, r)
+				if m.Rcode != testCase.rcode || m.AuthenticatedData != testCase.ad || len(m.Answer) != testCase.answer {
+					t.Fatalf("reply %d is %s", i, m)
+				}
+			}
+		})
+	}
+	
+	// AD bit is only for client which sets DO or AD bit
+	if m := queryTestServer(t, ds, "www.test.", dns.TypeA); m.AuthenticatedData || len(m.Answer) != 1 {
+		t.Errorf("reply without DO bit is %s", m)
+	}
+}
+
+func TestDNSSECValidatorCache(t *testing.T) {
+	upstream, root := newTestDNSSECUpstream(t)
+	ds := newTestServer(t, DNSSimpleServerOptions{
+		RemoteList:       []string{newTestUpstream(t, upstream.handle)},
+		DNSSECValidation: true,
+		TrustAnchors:     []string{root.key.String()},
+	})
+	
+	// zone cut is cached
+	for i := 0; i < 2; i++ {
+		if zone := ds.findZoneCut("www.insec.test."); zone != "insec.test." {
+			t.Fatalf("zone cut is %q", zone)
+		}
+	}
+	if count := upstream.getQueryCount("www.insec.test.", dns.TypeSOA); count != 1 {
+		t.Errorf("SOA query of zone cut is %d, expected 1", count)
+	}
+	
+	// DNSKEY and zone cut are bounded, expired one is removed first
+	defer func(size int) {
+		DNSSECKeyCacheSize = size
+	}(DNSSECKeyCacheSize)
+	DNSSECKeyCacheSize = 2
+	validator := ds.dnssecValidator
+	validator.lock.Lock()
+	validator.keyMap["expired."] = &dnssecZoneKey{state: DNSSECInsecure, expire: time.Now().Add(-time.Second)}
+	validator.lock.Unlock()
+	for _, zone := range []string{"test.", "sec.test.", "n3.test."} {
+		if _, state := ds.getZoneKeys(zone, 0); state != DNSSECSecure {
+			t.Fatalf("DNSKEY of zone[%s] is %s", zone, state)
+		}
+	}
+	for _, name := range []string{"test.", "sec.test.", "n3.test."} {
+		ds.findZoneCut(name)
+	}
+	validator.lock.RLock()
+	defer validator.lock.RUnlock()
+	if _, exists := validator.keyMap["expired."]; exists || len(validator.keyMap) > 2 || len(validator.zoneCutMap) > 2 {
+		t.Errorf("DNSKEY cache is %d, zone cut cache is %d", len(validator.keyMap), len(validator.zoneCutMap))
+	}
+}
@@ -3,15 +3,18 @@ package dnsutils
 // ref: https://blog.csdn.net/yatere/article/details/43318147, by Yatere
 // ref: http://mkaczanowski.com/golang-build-dynamic-dns-service-go/, by Mateusz Kaczanowski
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/frkhit/goutils/common"
 	"github.com/frkhit/logger"
 	"github.com/miekg/dns"
 	"math"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,94 +23,193 @@ const (
 	DNSDefaultTTL                        = 1 * time.Minute
 	DNSFailTTL                           = 15 * time.Second
 	LongLiveDNSTTL         time.Duration = 0
-	keyListCacheKey                      = "DNSSimpleServerCacheKeyList"
 	keyListSep                           = ">>>|<<<"
 	DNSQueryDefaultTimeout               = 5 * time.Second
 	DNSDefaultRType        uint16        = 0
 )
 
+var (
+	// ttl of remote answer in cache is clamped by [DNSCacheMinTTL, DNSCacheMaxTTL]
+	DNSCacheMinTTL = 0 * time.Second
+	DNSCacheMaxTTL = 24 * time.Hour
+	// ttl of negative answer in cache is limited by DNSNegativeMaxTTL, ref: rfc2308#section-5
+	DNSNegativeMaxTTL = 3 * time.Hour
+)
+
+// CacheContent: cached answer of one query type, stored in binary format, see encodeCacheRecord.
+// compatibility: Value was RR string joined by keyListSep and stored in json format together with CacheContentRecord,
+// which is removed; cache of json format is still read, and converted to binary format, see decodeLegacyCacheRecord
 type CacheContent struct {
-	TTL   time.Duration `json:"ttl"`
-	Value string        `json:"value"`
+	TTL      time.Duration
+	Value    []dns.RR
+	Negative bool
+	Rcode    int
+	Ns       []dns.RR
+	DNSSEC   DNSSECState
+	OrigTTL  time.Duration
 }
 
-type CacheContentRecord struct {
-	Record map[uint16]*CacheContent `json:"record"`
+func (content *CacheContent) isExpired(currentTime time.Duration) bool {
+	return content.TTL > LongLiveDNSTTL && content.TTL < currentTime
 }
 
 type DNSSimpleServer struct {
-	failRecord     map[string]time.Duration
-	failRecordLock sync.RWMutex
-	remoteList     []string
-	remote         string
-	dbCache        DBCache
-	ttl            time.Duration
+	remoteList            []string
+	remote                string
+	dbCache               DBCache
+	// buckets of dbCache, only answerCache may be evicted by budget of dbCache, see initCacheBucket
+	hostCache             DBCache
+	zoneCache             DBCache
+	dynamicCache          DBCache
+	answerCache           DBCache
+	listenAddrList        []string
+	ttl                   time.Duration
+	minTTL                time.Duration
+	maxTTL                time.Duration
+	negativeMaxTTL        time.Duration
+	failTTL               time.Duration
+	queryTimeout          time.Duration
+	readTimeout           time.Duration
+	writeTimeout          time.Duration
+	httpsProxyUrl         string
+	httpClient            *http.Client
+	tlsInsecureSkipVerify bool
+	tlsConnPool           *dnsTLSConnPool
+	upstreamGroup         *dnsUpstreamGroup
+	routeTable            *dnsRouteTable
+	zoneTable             *dnsZoneTable
+	wildcardCount         int32
+	flattenApexCNAME      bool
+	tsigKeyStore          *dnsTsigKeyStore
+	dynamicLock           sync.Mutex
+	queryACL              *dnsACL
+	updateACL             *dnsACL
+	rateLimiter           *dnsRateLimiter
+	blocker               *dnsBlocker
+	ednsUDPSize           uint16
+	ecsMode               DNSECSMode
+	dnssecValidator       *dnssecValidator
+	prefetch              bool
+	staleMaxTTL           time.Duration
+	refreshMap            sync.Map
+	// refresh key => time of the last failed refresh, see DNSStaleRecheckInterval
+	staleFailMap          sync.Map
+	// ecsScope => true, scope prefix of cached answer for client subnet
+	ecsScopeSet           sync.Map
+	flightGroup           *dnsFlightGroup
+	logger                DNSLogger
+	serverList            []*dns.Server
+	serverErrChan         chan error
+	serverStopChan        chan struct{}
+	serverLock            sync.Mutex
 }
 
 func (ds *DNSSimpleServer) Close() {
 	if ds.dbCache != nil {
 		ds.dbCache.Close()
 	}
+	if ds.tlsConnPool != nil {
+		ds.tlsConnPool.Close()
+	}
+	if ds.blocker != nil {
+		ds.SetBlocklist(nil, nil)
+	}
 }
 
+// UpdateHostRecord: host => ip, see UpdateHostRecordMulti
 func (ds *DNSSimpleServer) UpdateHostRecord(record map[string]string) {
-	updateFunc := func(newRecord map[string]string) {
-		logger.Infof("trying to update host record, %d record would be use\n", len(newRecord))
+	multiRecord := make(map[string][]string, len(record))
+	for host, ip := range record {
+		multiRecord[host] = []string{ip}
+	}
+	ds.UpdateHostRecordMulti(multiRecord)
+}
+
+// UpdateHostRecordMulti: host => ip list, ip may be ipv4, ipv6 or alias domain
+func (ds *DNSSimpleServer) UpdateHostRecordMulti(record map[string][]string) {
+	updateFunc := func(newRecord map[string][]string) {
+		ds.logger.Infof("trying to update host record, %d record would be use\n", len(newRecord))
 		
-		var oldCacheKeyList, newCacheKeyList []string
-		cacheRecord := make(map[string]string)
+		cacheRecord := make(map[string]map[uint16][]dns.RR)
 		
 		// find record from hostIPRecord
-		for domain, ip := range newRecord {
-			domain = strings.TrimRight(domain, ".") + "."
-			if len(domain) < 3 {
-				continue
-			}
-			cacheKey := ds.getKey(domain)
-			rr, err := dns.NewRR(fmt.Sprintf("%s A %s", domain, ip))
-			if err != nil {
-				logger.Errorf("fail to create record: domain[%s], ip[%s], error is %s", domain, ip, err)
-				continue
+		var wildcardCount int32
+		for rawDomain, ipList := range newRecord {
+			// suffix rule `.example.com`: example.com and all of its sub domain
+			domainList := []string{rawDomain}
+			if strings.Index(rawDomain, ".") == 0 {
+				domainList = []string{rawDomain[1:], "*" + rawDomain}
 			}
-			cacheRecord[cacheKey] = rr.String()
-		}
-		
-		// del old host record
-		if oldKeyListStr, err := ds.dbCache.Get(keyListCacheKey); err == nil {
-			for _, key := range strings.Split(oldKeyListStr, keyListSep) {
-				if len(key) > 2 {
-					oldCacheKeyList = append(oldCacheKeyList, key)
+			for _, domain := range domainList {
+				domain = strings.TrimRight(domain, ".") + "."
+				if len(domain) < 3 {
+					continue
+				}
+				cacheKey := ds.getKey(domain)
+				typeRecord := make(map[uint16][]dns.RR)
+				for _, ip := range ipList {
+					rType := dns.TypeA
+					if parsedIP := net.ParseIP(ip); parsedIP == nil {
+						// alias to another domain: `domain target.com`
+						if _, ok := dns.IsDomainName(ip); !ok || len(typeRecord[dns.TypeCNAME]) > 0 {
+							ds.logger.Errorf("invalid host record: domain[%s], ip[%s]\n", domain, ip)
+							continue
+						}
+						rType = dns.TypeCNAME
+						ip = dns.Fqdn(ip)
+					} else if parsedIP.To4() == nil {
+						rType = dns.TypeAAAA
+					}
+					rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", domain, dns.TypeToString[rType], ip))
+					if err != nil {
+						ds.logger.Errorf("fail to create record: domain[%s], ip[%s], error is %s", domain, ip, err)
+						continue
+					}
+					typeRecord[rType] = append(typeRecord[rType], rr)
+				}
+				if len(typeRecord) == 0 {
+					continue
+				}
+				cacheRecord[cacheKey] = typeRecord
+				if isWildcardKey(cacheKey) {
+					wildcardCount++
 				}
 			}
 		}
-		if len(oldCacheKeyList) > 0 {
-			logger.Infof("there are %d old key list in dbCache, trying to delete them...", len(oldCacheKeyList))
-			delErr := ds.dbCache.BatchDelete(oldCacheKeyList)
-			if delErr != nil {
-				logger.Fatalf("fail to run `BatchDelete`, error is %s", delErr)
-			}
-			logger.Infoln("success to delete old key in dbCache!")
-		}
 		
 		// save new host record
 		if len(cacheRecord) > 0 {
-			logger.Infof("trying to save %d new host ip record in dbCache...", len(cacheRecord))
-			for key := range cacheRecord {
-				newCacheKeyList = append(newCacheKeyList, key)
-			}
-			
-			setErr := ds.setBatchValue(cacheRecord, LongLiveDNSTTL, true)
+			ds.logger.Infof("trying to save %d new host ip record in dbCache...", len(cacheRecord))
+			setErr := ds.setBatchValue(ds.hostCache, cacheRecord, LongLiveDNSTTL, true)
 			if setErr != nil {
-				logger.Fatalf("fail to run `BatchSet`, error is %s", setErr)
+				ds.logger.Errorf("fail to run `BatchSet`, error is %s\n", setErr)
+				return
 			}
-			
-			setErr = ds.dbCache.Set(keyListCacheKey, strings.Join(newCacheKeyList, keyListSep))
-			if setErr != nil {
-				logger.Fatalf("fail to save keyListCacheKey, error is %s", setErr)
+			ds.logger.Infoln("success to save all new host ip in dbCache!")
+		}
+		
+		// del old host record which is not in the new record
+		var oldCacheKeyList []string
+		if scanErr := ds.hostCache.Scan("", func(key, value string) bool {
+			if _, exists := cacheRecord[key]; !exists {
+				oldCacheKeyList = append(oldCacheKeyList, key)
 			}
-			logger.Infoln("success to save all new host ip in dbCache!")
+			return true
+		}); scanErr != nil {
+			ds.logger.Errorf("fail to run `Scan`, error is %s\n", scanErr)
+			return
 		}
-		logger.Infof("success to update domain record, current record is %d\n", len(cacheRecord))
+		if len(oldCacheKeyList) > 0 {
+			ds.logger.Infof("there are %d old key in dbCache, trying to delete them...", len(oldCacheKeyList))
+			delErr := ds.hostCache.BatchDelete(oldCacheKeyList)
+			if delErr != nil {
+				ds.logger.Errorf("fail to run `BatchDelete`, error is %s\n", delErr)
+				return
+			}
+			ds.logger.Infoln("success to delete old key in dbCache!")
+		}
+		atomic.StoreInt32(&ds.wildcardCount, wildcardCount)
+		ds.logger.Infof("success to update domain record, current record is %d\n", len(cacheRecord))
 	}
 	
 	// run in daemon
@@ -127,231 +229,508 @@ func (ds *DNSSimpleServer) getKey(domain string) (string) {
 		
 		return strings.Join(labels, ".")
 	} else {
-		logger.Errorln("Invalid domain: " + domain)
+		ds.logger.Errorln("Invalid domain: " + domain)
 	}
 	return domain
 }
 
+func isWildcardKey(cacheKey string) bool {
+	return cacheKey == "*" || strings.HasSuffix(cacheKey, ".*")
+}
+
+// walk up the reversed label key: `com.example.dev.a` => `com.example.dev.*`, `com.example.*`, `com.*`
+func getWildcardKeyList(cacheKey string) []string {
+	var keyList []string
+	labels := strings.Split(cacheKey, ".")
+	for i := len(labels) - 1; i > 0; i-- {
+		keyList = append(keyList, strings.Join(labels[:i], ".")+".*")
+	}
+	return keyList
+}
+
+// host record wins, then cached answer; for host record, exact record wins, otherwise the closest wildcard record
+// is used, with its owner name replaced by domain
 func (ds *DNSSimpleServer) getRecord(domain string, rType uint16) (rList []dns.RR, err error) {
-	// find record from bucket
 	cacheKey := ds.getKey(domain)
+	if rList, err = ds.getRecordByKey(ds.hostCache, cacheKey, rType); err == nil {
+		return rList, nil
+	}
+	
+	if atomic.LoadInt32(&ds.wildcardCount) > 0 {
+		for _, wildcardKey := range getWildcardKeyList(cacheKey) {
+			wildcardList, wildcardErr := ds.getRecordByKey(ds.hostCache, wildcardKey, rType)
+			if wildcardErr == nil {
+				for _, r := range wildcardList {
+					r.Header().Name = dns.Fqdn(domain)
+				}
+				return wildcardList, nil
+			}
+		}
+	}
+	return ds.getRecordByKey(ds.answerCache, cacheKey, rType)
+}
+
+func (ds *DNSSimpleServer) getRecordByKey(db DBCache, cacheKey string, rType uint16) (rList []dns.RR, err error) {
+	// find record from bucket
 	realType := rType
-	result, err := ds.getResult(cacheKey)
+	result, err := ds.getResult(db, cacheKey)
 	if err != nil {
 		return rList, fmt.Errorf("key[%s] not found in record", cacheKey)
 	}
 	cacheContent, exists := result[rType]
+	if exists && cacheContent.Negative {
+		return rList, fmt.Errorf("key[%s] found in negative record, rType is %d", cacheKey, rType)
+	}
+	if !exists {
+		// CNAME is the answer of any query type of the name, and is followed by chaseCNAME
+		cacheContent, exists = result[dns.TypeCNAME]
+		realType = dns.TypeCNAME
+		if exists && cacheContent.Negative {
+			exists = false
+		}
+	}
 	if !exists {
 		cacheContent, exists = result[DNSDefaultRType]
 		realType = DNSDefaultRType
+		if exists {
+			// host record without this query type: NODATA, instead of answering AAAA or MX query with A record
+			return rList, nil
+		}
 	}
 	if !exists {
 		err = fmt.Errorf("key[%s] found in record, but rType[%d,%d] not found in result", cacheKey, rType, DNSDefaultRType)
 	}
 	if err == nil {
-		var tmpList []dns.RR
-		for _, rrStr := range strings.Split(cacheContent.Value, keyListSep) {
-			if len(rrStr) > 0 {
-				r, rErr := dns.NewRR(rrStr)
-				if rErr != nil {
-					delete(result, realType)
-					ds.setResult(cacheKey, result)
-					return rList, fmt.Errorf("fail to create dns.RR from string, error is %s", rErr)
-				} else {
-					tmpList = append(tmpList, r)
-				}
-			}
-		}
-		if len(tmpList) > 0 {
-			return tmpList, nil
+		if len(cacheContent.Value) > 0 {
+			// replay with remaining lifetime instead of the original ttl
+			setRemainingTTL(cacheContent.Value, cacheContent.TTL)
+			return cacheContent.Value, nil
 		} else {
 			delete(result, realType)
-			ds.setResult(cacheKey, result)
-			err = fmt.Errorf("fail to get valid dns.RR from string")
+			ds.setResult(db, cacheKey, result)
+			err = fmt.Errorf("fail to get valid dns.RR from record")
 		}
 	}
 	
 	return rList, err
 }
 
-func (ds *DNSSimpleServer) getResult(key string) (map[uint16]*CacheContent, error) {
-	value, err := ds.dbCache.Get(key)
+func (ds *DNSSimpleServer) getNegativeRecord(domain string, rType uint16) (rcode int, nsList []dns.RR, err error) {
+	cacheKey := ds.getKey(domain)
+	result, err := ds.getResult(ds.answerCache, cacheKey)
+	if err != nil {
+		return rcode, nsList, fmt.Errorf("key[%s] not found in record", cacheKey)
+	}
+	cacheContent, exists := result[rType]
+	if !exists || !cacheContent.Negative {
+		return rcode, nsList, fmt.Errorf("key[%s] found in record, but rType[%d] not found in negative result", cacheKey, rType)
+	}
+	
+	setRemainingTTL(cacheContent.Ns, cacheContent.TTL)
+	return cacheContent.Rcode, cacheContent.Ns, nil
+}
+
+func setRemainingTTL(rList []dns.RR, expireTTL time.Duration) {
+	if expireTTL <= LongLiveDNSTTL {
+		return
+	}
+	remaining := expireTTL - time.Duration(time.Now().Unix())*time.Second
+	if remaining < 0 {
+		remaining = 0
+	}
+	for _, r := range rList {
+		r.Header().Ttl = uint32(remaining / time.Second)
+	}
+}
+
+// record which is not expired
+func (ds *DNSSimpleServer) getResult(db DBCache, key string) (map[uint16]*CacheContent, error) {
+	result, err := ds.getAllResult(db, key)
+	if err != nil || ds.staleMaxTTL <= 0 {
+		return result, err
+	}
+	
+	freshResult := make(map[uint16]*CacheContent)
+	currentTime := time.Duration(time.Now().Unix()) * time.Second
+	for rType, cacheContent := range result {
+		if !cacheContent.isExpired(currentTime) {
+			freshResult[rType] = cacheContent
+		}
+	}
+	return freshResult, nil
+}
+
+// record with stale answer kept for serve-stale; record is removed when stale for staleMaxTTL
+func (ds *DNSSimpleServer) getAllResult(db DBCache, key string) (map[uint16]*CacheContent, error) {
+	value, err := db.Get(key)
 	if err != nil {
 		return nil, err
 	}
 	
-	data := CacheContentRecord{}
-	err = json.Unmarshal([]byte(value), &data)
+	result, isLegacy, err := decodeCacheRecord(value)
 	if err != nil {
-		ds.dbCache.Delete(key)
+		db.Delete(key)
 		return nil, err
 	}
 	
 	var clearRType []uint16
 	currentTime := time.Duration(time.Now().Unix()) * time.Second
-	for rType, cacheContent := range data.Record {
-		if cacheContent.TTL > LongLiveDNSTTL && cacheContent.TTL < currentTime { // timeout
+	for rType, cacheContent := range result {
+		staleTime := currentTime
+		if !cacheContent.Negative {
+			staleTime -= ds.staleMaxTTL
+		}
+		if cacheContent.isExpired(staleTime) { // timeout
 			clearRType = append(clearRType, rType)
 		}
 	}
-	if len(clearRType) > 0 {
-		for _, rType := range clearRType {
-			delete(data.Record, rType)
-		}
-		ds.setResult(key, data.Record)
+	for _, rType := range clearRType {
+		delete(result, rType)
+	}
+	if len(clearRType) > 0 || isLegacy {
+		// json record is migrated to binary format when it is read
+		ds.setResult(db, key, result)
 	}
 	
-	return data.Record, nil
+	return result, nil
 }
 
-func (ds *DNSSimpleServer) setResult(key string, result map[uint16]*CacheContent) (error) {
-	data := &CacheContentRecord{Record: result}
-	jsonBytes, err := json.Marshal(data)
+func (ds *DNSSimpleServer) setResult(db DBCache, key string, result map[uint16]*CacheContent) (error) {
+	value, err := encodeCacheRecord(result)
 	if err != nil {
-		return fmt.Errorf("fail to dump to json: %s", err)
+		return fmt.Errorf("fail to encode record: %s", err)
 	}
-	return ds.dbCache.Set(key, string(jsonBytes))
+	return db.SetWithTTL(key, value, ds.getResultTTL(result))
 }
 
-func (ds *DNSSimpleServer) setBatchValue(record map[string]string, ttl time.Duration, isHostRecord bool) (error) {
-	var err error
+// how long the record should be kept in DBCache: until the last answer is expired and not served as stale,
+// 0 if any answer is long live
+func (ds *DNSSimpleServer) getResultTTL(result map[uint16]*CacheContent) time.Duration {
+	var maxTTL time.Duration
+	for _, cacheContent := range result {
+		if cacheContent.TTL <= LongLiveDNSTTL {
+			return 0
+		}
+		ttl := cacheContent.TTL
+		if !cacheContent.Negative {
+			ttl += ds.staleMaxTTL
+		}
+		if ttl > maxTTL {
+			maxTTL = ttl
+		}
+	}
+	if maxTTL <= 0 {
+		return 0
+	}
+	ttl := maxTTL - time.Duration(time.Now().Unix())*time.Second
+	if ttl <= 0 {
+		// expired record is removed soon
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// setBatchValue replaces record of each key, long live record is saved in one BatchSet
+func (ds *DNSSimpleServer) setBatchValue(db DBCache, record map[string]map[uint16][]dns.RR, ttl time.Duration, isHostRecord bool) (error) {
 	currentTTL := LongLiveDNSTTL
 	if ttl > 0 {
 		currentTTL = time.Duration(time.Now().Unix())*time.Second + ttl
 	}
-	for key, value := range record {
-		result, err := ds.getResult(key)
-		if err != nil && result == nil {
-			result = make(map[uint16]*CacheContent)
+	valueMap := make(map[string]string, len(record))
+	for key, typeRecord := range record {
+		result := make(map[uint16]*CacheContent)
+		for rType, value := range typeRecord {
+			result[rType] = &CacheContent{TTL: currentTTL, Value: value}
 		}
-		result[dns.TypeA] = &CacheContent{TTL: currentTTL, Value: value}
 		if isHostRecord {
-			result[DNSDefaultRType] = &CacheContent{TTL: currentTTL, Value: value}
+			// mark of host record, other query type of host is answered with NODATA
+			if value, exists := typeRecord[dns.TypeA]; exists {
+				result[DNSDefaultRType] = &CacheContent{TTL: currentTTL, Value: value}
+			} else if value, exists := typeRecord[dns.TypeAAAA]; exists {
+				result[DNSDefaultRType] = &CacheContent{TTL: currentTTL, Value: value}
+			}
 		}
-		err = ds.setResult(key, result)
+		if ttl > 0 {
+			if err := ds.setResult(db, key, result); err != nil {
+				return fmt.Errorf("fail to store record: %s", err)
+			}
+			continue
+		}
+		value, err := encodeCacheRecord(result)
 		if err != nil {
-			return fmt.Errorf("fail to store record: %s", err)
+			return fmt.Errorf("fail to encode record: %s", err)
 		}
+		valueMap[key] = value
 	}
-	return err
+	if len(valueMap) == 0 {
+		return nil
+	}
+	return db.BatchSet(valueMap)
+}
+
+// min ttl of answer, clamped by [minTTL, maxTTL]
+func (ds *DNSSimpleServer) getCacheTTL(rList []dns.RR) time.Duration {
+	if len(rList) == 0 {
+		return ds.ttl
+	}
+	ttl := time.Duration(rList[0].Header().Ttl) * time.Second
+	for _, r := range rList[1:] {
+		ttl = common.GetMinDuration(ttl, time.Duration(r.Header().Ttl)*time.Second)
+	}
+	if ttl < ds.minTTL {
+		ttl = ds.minTTL
+	}
+	if ds.maxTTL > 0 && ttl > ds.maxTTL {
+		ttl = ds.maxTTL
+	}
+	return ttl
 }
 
-func (ds *DNSSimpleServer) updateRecord(rList []dns.RR, q *dns.Question) {
+func (ds *DNSSimpleServer) updateRecord(rList []dns.RR, q *dns.Question, state DNSSECState) {
 	defer func() {
 		if e := recover(); e != nil {
-			logger.Errorf("updateRecord panic %s\n", e)
+			ds.logger.Errorf("updateRecord panic %s\n", e)
 		}
 	}()
-	name := q.Name
-	cacheKey := ds.getKey(name)
-	result, err := ds.getResult(cacheKey)
+	ds.updateRecordByKey(ds.getKey(q.Name), rList, q.Qtype, state)
+}
+
+func (ds *DNSSimpleServer) updateRecordByKey(cacheKey string, rList []dns.RR, rType uint16, state DNSSECState) {
+	result, err := ds.getAllResult(ds.answerCache, cacheKey)
 	if err != nil && result == nil {
 		result = make(map[uint16]*CacheContent)
 	}
 	
 	if len(rList) == 0 {
 		// del record
-		delete(result, q.Qtype)
+		delete(result, rType)
 	} else {
 		// add record
-		var answerStrList []string
-		for _, r := range rList {
-			answerStrList = append(answerStrList, r.String())
+		ttl := ds.getCacheTTL(rList)
+		result[rType] = &CacheContent{TTL: ttl + time.Duration(time.Now().Unix())*time.Second, Value: rList, DNSSEC: state, OrigTTL: ttl}
+	}
+	
+	err = ds.setResult(ds.answerCache, cacheKey, result)
+	if err != nil {
+		ds.logger.Errorf("fail to store cacheKey[%s]: %s\n", cacheKey, err)
+	}
+}
+
+// ttl of negative answer is the min of SOA ttl and SOA minimum, ref: rfc2308#section-5
+func getNegativeTTL(nsList []dns.RR) (time.Duration, bool) {
+	for _, r := range nsList {
+		if soa, ok := r.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// SOA for negative answer of host record and blocklist, which has no zone; ttl is limited by negativeMaxTTL
+func (ds *DNSSimpleServer) getLocalNegativeSOA(name string) dns.RR {
+	ttl := ds.ttl
+	if ttl > ds.negativeMaxTTL {
+		ttl = ds.negativeMaxTTL
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(ttl / time.Second)},
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(ttl / time.Second),
+	}
+}
+
+// cache NXDOMAIN/NODATA answer with SOA in authority section, or SERVFAIL for failTTL
+func (ds *DNSSimpleServer) updateNegativeRecord(rcode int, nsList []dns.RR, q *dns.Question, state DNSSECState) {
+	ttl := ds.failTTL
+	if rcode != dns.RcodeServerFailure {
+		var found bool
+		ttl, found = getNegativeTTL(nsList)
+		if !found {
+			// negative answer without SOA should not be cached
+			return
 		}
-		result[q.Qtype] = &CacheContent{TTL: DNSDefaultTTL + time.Duration(time.Now().Unix())*time.Second, Value: strings.Join(answerStrList, keyListSep)}
+		if ttl > ds.negativeMaxTTL {
+			ttl = ds.negativeMaxTTL
+		}
+	}
+	
+	cacheKey := ds.getKey(q.Name)
+	result, err := ds.getAllResult(ds.answerCache, cacheKey)
+	if err != nil && result == nil {
+		result = make(map[uint16]*CacheContent)
 	}
+	result[q.Qtype] = &CacheContent{TTL: ttl + time.Duration(time.Now().Unix())*time.Second, Negative: true, Rcode: rcode, Ns: nsList, DNSSEC: state}
 	
-	err = ds.setResult(cacheKey, result)
+	err = ds.setResult(ds.answerCache, cacheKey, result)
 	if err != nil {
-		logger.Errorf("fail to store cacheKey[%s]: %s\n", cacheKey, err)
+		ds.logger.Errorf("fail to store cacheKey[%s]: %s\n", cacheKey, err)
 	}
 }
 
+func (ds *DNSSimpleServer) exchange(r *dns.Msg, remote string) (*dns.Msg, error) {
+	if isDNSOverHTTPS(remote) {
+		return ds.exchangeHTTPS(r, remote)
+	}
+	if isDNSOverTLS(remote) {
+		return ds.exchangeTLS(r, remote)
+	}
+	
+	c := new(dns.Client)
+	c.Timeout = ds.queryTimeout
+	c.Net = "udp"
+	newMsg, _, err := c.Exchange(r, remote)
+	if err != nil || newMsg == nil || !newMsg.Truncated {
+		return newMsg, err
+	}
+	
+	// truncated reply: retry the same remote server over tcp
+	ds.logger.Infof("truncated reply from remote server[%s], retry with tcp\n", remote)
+	c.Net = "tcp"
+	newMsg, _, err = c.Exchange(r, remote)
+	return newMsg, err
+}
+
 func (ds *DNSSimpleServer) realQuery(r *dns.Msg, m *dns.Msg, fn func(r, m, newMsg *dns.Msg)) {
-	var newMsg *dns.Msg
-	var err error
-	for _, remote := range ds.remoteList {
-		c := new(dns.Client)
-		c.Timeout = DNSQueryDefaultTimeout
-		c.Net = "udp"
-		newMsg, _, err = c.Exchange(r, remote)
-		if err != nil {
-			if newMsg != nil && newMsg.Question != nil && len(newMsg.Question) > 0 {
-				logger.Errorf("fail to query ip for domain[%s] from remote server[%s]: error is %s\n", newMsg.Question[0].Name, remote, err)
-			} else {
-				logger.Errorf("fail to query ip for domain from remote server[%s]: error is %s\n", remote, err)
+	group := ds.upstreamGroup
+	if len(r.Question) > 0 {
+		group = ds.getUpstreamGroup(r.Question[0].Name)
+	}
+	fn(r, m, ds.queryUpstreamGroup(ds.newUpstreamRequest(r), group))
+}
+
+// answer single question from local zone, host record, cache or remote server
+func (ds *DNSSimpleServer) answerQuestion(r *dns.Msg, m *dns.Msg, question *dns.Question) {
+	if ds.answerFromBlocklist(question, m) {
+		return
+	}
+	if ds.answerFromDynamic(question, m) {
+		ds.logger.Infof("host[%s] found in dynamic record\n", question.Name)
+		return
+	}
+	if ds.answerFromZone(question, m) {
+		ds.logger.Infof("host[%s] found in zone\n", question.Name)
+		return
+	}
+	// answer for client subnet first, then answer for all client
+	ecsCacheKey := ds.getECSCacheKey(r, question.Name)
+	if len(ecsCacheKey) > 0 {
+		if scopeCacheKey, answerList := ds.getECSRecord(r, question); len(answerList) > 0 {
+			m.Answer = append(m.Answer, answerList...)
+			m.AuthenticatedData = ds.getRecordState(scopeCacheKey, question.Qtype) == DNSSECSecure
+			ds.checkPrefetch(r, question, scopeCacheKey, ecsCacheKey)
+			ds.logger.Infof("host[%s] found in record of client subnet\n", question.Name)
+			return
+		}
+	}
+	answerList, e := ds.getRecord(question.Name, question.Qtype)
+	if e == nil {
+		m.Answer = append(m.Answer, answerList...)
+		if len(answerList) == 0 {
+			// NODATA of host record
+			m.Ns = append(m.Ns, ds.getLocalNegativeSOA(question.Name))
+		}
+		m.AuthenticatedData = ds.getRecordState(ds.getKey(question.Name), question.Qtype) == DNSSECSecure
+		ds.checkPrefetch(r, question, ds.getKey(question.Name), ecsCacheKey)
+		ds.logger.Infof("host[%s] found in record\n", question.Name)
+		return
+	}
+	if rcode, nsList, negErr := ds.getNegativeRecord(question.Name, question.Qtype); negErr == nil {
+		m.Rcode = rcode
+		m.Ns = append(m.Ns, nsList...)
+		m.AuthenticatedData = ds.getRecordState(ds.getKey(question.Name), question.Qtype) == DNSSECSecure
+		ds.logger.Infof("host[%s] found in negative record, rcode is %s\n", question.Name, dns.RcodeToString[rcode])
+		return
+	}
+	ds.logger.Errorf("host[%s] not found in record: error is %s\n", question.Name, e)
+	
+	ds.answerWithStale(r, m, question, ecsCacheKey)
+}
+
+// answer question from remote server, and update cache; hasCache means that the cached answer is refreshed by
+// prefetch or serve-stale, which is not replaced by SERVFAIL
+func (ds *DNSSimpleServer) queryRemote(r *dns.Msg, m *dns.Msg, question *dns.Question, ecsCacheKey string, hasCache bool) {
+	ds.realQuery(r, m, func(r, m, newMsg *dns.Msg) {
+		if newMsg == nil {
+			// not found ip from remote dns server
+			m.Rcode = dns.RcodeServerFailure
+			if !hasCache {
+				ds.updateNegativeRecord(dns.RcodeServerFailure, nil, question, DNSSECIndeterminate)
 			}
-			newMsg = nil
-			continue
+			return
+		}
+		if newMsg.Rcode == dns.RcodeServerFailure && hasCache {
+			m.Rcode = newMsg.Rcode
+			return
 		}
 		
-		if len(newMsg.Answer) == 0 {
-			if len(newMsg.Question) > 0 {
-				logger.Errorf("fail to query ip for domain[%s] from remote server[%s]\n", newMsg.Question[0].Name, remote)
-			} else {
-				logger.Errorf("fail to query ip for domain from remote server[%s]\n", remote)
+		state := DNSSECIndeterminate
+		if ds.dnssecValidator != nil && (newMsg.Rcode == dns.RcodeSuccess || newMsg.Rcode == dns.RcodeNameError) {
+			state = ds.validateMsg(question, newMsg)
+			if state == DNSSECBogus {
+				ds.logger.Errorf("fail to validate answer of host[%s]: bogus\n", question.Name)
+				if !r.CheckingDisabled {
+					// bogus answer is only for client which disables checking, ref: rfc4035#section-5.5
+					m.Rcode = dns.RcodeServerFailure
+					ds.updateNegativeRecord(dns.RcodeServerFailure, nil, question, state)
+					return
+				}
+				m.Rcode = newMsg.Rcode
+				m.Answer = append(m.Answer, newMsg.Answer...)
+				m.Ns = append(m.Ns, newMsg.Ns...)
+				return
 			}
-			newMsg = nil
-			continue
+			m.AuthenticatedData = state == DNSSECSecure
 		}
-		break
-	}
-	fn(r, m, newMsg)
+		
+		m.Rcode = newMsg.Rcode
+		m.Answer = append(m.Answer, newMsg.Answer...)
+		if len(newMsg.Answer) > 0 && len(ecsCacheKey) > 0 && isECSScopedAnswer(newMsg) {
+			ds.updateECSRecord(r, newMsg, question, state)
+		} else if len(newMsg.Answer) > 0 {
+			ds.updateRecord(newMsg.Answer, question, state)
+		} else {
+			// NXDOMAIN or NODATA: keep authority section for negative cache in client
+			m.Ns = append(m.Ns, newMsg.Ns...)
+			ds.updateNegativeRecord(newMsg.Rcode, newMsg.Ns, question, state)
+		}
+	})
 }
 
 func (ds *DNSSimpleServer) parseQuery(r *dns.Msg, m *dns.Msg) {
 	switch len(m.Question) {
 	case 0:
-		logger.Errorln("Query Error: question cannot be null!")
+		ds.logger.Errorln("Query Error: question cannot be null!")
 	case 1:
 		question := m.Question[0]
-		answerList, e := ds.getRecord(question.Name, question.Qtype)
-		if e == nil {
-			m.Answer = append(m.Answer, answerList...)
-			logger.Infof("host[%s] found in record\n", question.Name)
-			return
-		}
-		logger.Errorf("host[%s] not found in record: error is %s\n", question.Name, e)
-		cacheKey := ds.getKey(question.Name)
-		ds.failRecordLock.RLock()
-		ttl, exists := ds.failRecord[cacheKey]
-		ds.failRecordLock.RUnlock()
-		
-		if !exists || ttl < time.Duration(time.Now().Unix())*time.Second {
-			ds.realQuery(r, m, func(r, m, newMsg *dns.Msg) {
-				isFail := false
-				if newMsg != nil {
-					m.Answer = append(m.Answer, newMsg.Answer...)
-					ds.updateRecord(newMsg.Answer, &newMsg.Question[0])
-				} else {
-					// not found ip from remote dns server
-					//q := m.Question[0]
-					//localhostRR, _ := dns.NewRR(fmt.Sprintf("%s A 127.0.0.1", q.Name))
-					//ds.updateRecord([]dns.RR{localhostRR}, &q)
-					isFail = true
-				}
-				if isFail {
-					ds.failRecordLock.Lock()
-					ds.failRecord[cacheKey] = time.Duration(time.Now().Unix())*time.Second + DNSFailTTL
-					ds.failRecordLock.Unlock()
-				} else {
-					if exists {
-						ds.failRecordLock.Lock()
-						delete(ds.failRecord, cacheKey)
-						ds.failRecordLock.Unlock()
-					}
-				}
-			})
-		}
+		ds.answerQuestion(r, m, &question)
+		ds.chaseCNAME(r, m, &question)
 	
 	default:
 		// multi question: not support in practice
 		ds.realQuery(r, m, func(r, m, newMsg *dns.Msg) {
 			if newMsg != nil {
+				m.Rcode = newMsg.Rcode
 				m.Answer = append(m.Answer, newMsg.Answer...)
+				m.Ns = append(m.Ns, newMsg.Ns...)
+			} else {
+				m.Rcode = dns.RcodeServerFailure
 			}
 		})
 	}
+	
+	// AD bit is only for client which sets DO or AD bit, ref: rfc6840#section-5.8
+	if opt := r.IsEdns0(); !r.AuthenticatedData && (opt == nil || !opt.Do()) {
+		m.AuthenticatedData = false
+	}
 }
 
 func (ds *DNSSimpleServer) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
@@ -359,65 +738,220 @@ func (ds *DNSSimpleServer) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m.SetReply(r)
 	m.Compress = false
 	
-	switch r.Opcode {
-	case dns.OpcodeQuery:
+	// rate limit of udp client, tcp client can not spoof its address
+	clientIP := getAddrIP(w.RemoteAddr())
+	_, isUDP := w.RemoteAddr().(*net.UDPAddr)
+	action, allowed := ds.admitRequest(r, clientIP, isUDP)
+	switch action {
+	case rrlDrop:
+		return
+	case rrlSlip:
+		m.Truncated = true
+		w.WriteMsg(m)
+		return
+	}
+	
+	// OPT of client, before client subnet is added
+	clientOpt := r.IsEdns0()
+	if clientOpt != nil {
+		clientOpt = dns.Copy(clientOpt).(*dns.OPT)
+		if clientOpt.Version() != 0 {
+			// only EDNS version 0 is supported, ref: rfc6891#section-6.1.3
+			m.SetEdns0(ds.ednsUDPSize, false)
+			m.Rcode = dns.RcodeBadVers
+			w.WriteMsg(m)
+			return
+		}
+	}
+	
+	if r.IsTsig() != nil && w.TsigStatus() != nil {
+		// unknown key or bad signature: unsigned NOTAUTH reply, ref: rfc8945#section-5.2
+		ds.logger.Errorf("fail to verify tsig of request: %s\n", w.TsigStatus())
+		m.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(m)
+		return
+	}
+	
+	switch {
+	case !allowed:
+		m.Rcode = dns.RcodeRefused
+	
+	case r.Opcode == dns.OpcodeQuery:
+		ds.setClientECS(r, clientIP)
 		ds.parseQuery(r, m)
 	
-	case dns.OpcodeUpdate:
-		for _, question := range r.Question {
-			for _, rr := range r.Ns {
-				ds.updateRecord([]dns.RR{rr}, &question)
+	case r.Opcode == dns.OpcodeUpdate:
+		m.Rcode = ds.parseUpdate(r)
+	}
+	
+	// udp reply: set TC bit if larger than udp size of client, client would retry with tcp
+	udpSize := ds.setReplyEdns0(clientOpt, m)
+	if isUDP {
+		m.Truncate(udpSize)
+	}
+	signReply(r, m)
+	w.WriteMsg(m)
+}
+
+// Start listens on udp and tcp of each listen address, and serves in background until ctx done or Shutdown
+func (ds *DNSSimpleServer) Start(ctx context.Context) error {
+	ds.serverLock.Lock()
+	defer ds.serverLock.Unlock()
+	if ds.serverList != nil {
+		return fmt.Errorf("dns server is running")
+	}
+	
+	// udp and tcp server share the same request handler and cache
+	handler := dns.HandlerFunc(ds.handleDnsRequest)
+	var serverList []*dns.Server
+	closeListener := func() {
+		for _, server := range serverList {
+			if server.PacketConn != nil {
+				server.PacketConn.Close()
+			}
+			if server.Listener != nil {
+				server.Listener.Close()
 			}
 		}
 	}
+	for _, addr := range ds.listenAddrList {
+		packetConn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			closeListener()
+			return fmt.Errorf("fail to listen udp[%s]: %s", addr, err)
+		}
+		// use the real udp address, so that tcp and udp share the same port even if port is 0
+		listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+		if err != nil {
+			packetConn.Close()
+			closeListener()
+			return fmt.Errorf("fail to listen tcp[%s]: %s", addr, err)
+		}
+		serverList = append(serverList,
+			&dns.Server{PacketConn: packetConn, Net: "udp", Handler: handler, TsigProvider: ds.tsigKeyStore, MsgAcceptFunc: acceptDNSMsg, ReadTimeout: ds.readTimeout, WriteTimeout: ds.writeTimeout},
+			&dns.Server{Listener: listener, Net: "tcp", Handler: handler, TsigProvider: ds.tsigKeyStore, MsgAcceptFunc: acceptDNSMsg, ReadTimeout: ds.readTimeout, WriteTimeout: ds.writeTimeout},
+		)
+	}
 	
-	if r.IsTsig() != nil {
-		if w.TsigStatus() == nil {
-			m.SetTsig(r.Extra[len(r.Extra)-1].(*dns.TSIG).Hdr.Name,
-				dns.HmacMD5, 300, time.Now().Unix())
-		} else {
-			logger.Infoln("Status ", w.TsigStatus().Error())
+	// start server
+	errChan := make(chan error, len(serverList))
+	startChan := make(chan struct{}, len(serverList))
+	for _, server := range serverList {
+		server.NotifyStartedFunc = func() {
+			startChan <- struct{}{}
 		}
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				errChan <- fmt.Errorf("fail to serve %s[%s]: %s", server.Net, ds.getServerAddr(server), err)
+			} else {
+				errChan <- nil
+			}
+		}(server)
 	}
-	w.WriteMsg(m)
+	for range serverList {
+		select {
+		case <-startChan:
+		case err := <-errChan:
+			for _, server := range serverList {
+				server.Shutdown()
+			}
+			closeListener()
+			return err
+		}
+	}
+	for _, server := range serverList {
+		ds.logger.Infof("Starting %s server at %s\n", server.Net, ds.getServerAddr(server))
+	}
+	
+	ds.serverList = serverList
+	ds.serverErrChan = errChan
+	ds.serverStopChan = make(chan struct{})
+	go func(stopChan chan struct{}) {
+		select {
+		case <-ctx.Done():
+			ds.Shutdown(context.Background())
+		case <-stopChan:
+		}
+	}(ds.serverStopChan)
+	return nil
+}
+
+func (ds *DNSSimpleServer) getServerAddr(server *dns.Server) string {
+	if server.PacketConn != nil {
+		return server.PacketConn.LocalAddr().String()
+	}
+	if server.Listener != nil {
+		return server.Listener.Addr().String()
+	}
+	return server.Addr
+}
+
+// Addrs: real listening address, useful when listen port is 0
+func (ds *DNSSimpleServer) Addrs() []net.Addr {
+	ds.serverLock.Lock()
+	defer ds.serverLock.Unlock()
+	
+	var addrList []net.Addr
+	for _, server := range ds.serverList {
+		if server.PacketConn != nil {
+			addrList = append(addrList, server.PacketConn.LocalAddr())
+		} else if server.Listener != nil {
+			addrList = append(addrList, server.Listener.Addr())
+		}
+	}
+	return addrList
+}
+
+// Shutdown stops all udp and tcp server together; dbCache is still available until Close
+func (ds *DNSSimpleServer) Shutdown(ctx context.Context) error {
+	ds.serverLock.Lock()
+	serverList := ds.serverList
+	if ds.serverStopChan != nil {
+		close(ds.serverStopChan)
+		ds.serverStopChan = nil
+	}
+	ds.serverList = nil
+	ds.serverLock.Unlock()
+	
+	var err error
+	for _, server := range serverList {
+		if shutdownErr := server.ShutdownContext(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	ds.tlsConnPool.Close()
+	return err
 }
 
 func (ds *DNSSimpleServer) StartDNSServer(addr string, port int) {
 	// attach new host record trigger
 	if hostDNSUtil != nil {
-		hostDNSUtil.AddHostRecordUpdateTrigger(ds.UpdateHostRecord)
+		hostDNSUtil.AddHostRecordMultiUpdateTrigger(ds.UpdateHostRecordMulti)
 	}
 	
-	// attach request handler func
-	dns.HandleFunc(".", ds.handleDnsRequest)
+	// DoH endpoint share the same http.DefaultServeMux with PProfServer
+	if len(DNSOverHTTPSServePath) > 0 {
+		http.Handle(DNSOverHTTPSServePath, ds)
+		ds.logger.Infof("DoH endpoint registered at %s\n", DNSOverHTTPSServePath)
+	}
 	
 	// start server
-	server := &dns.Server{Addr: addr + ":" + strconv.Itoa(port), Net: "udp"}
-	logger.Infof("Starting at %s:%d\n", addr, port)
-	
-	err := server.ListenAndServe()
+	ds.listenAddrList = []string{addr + ":" + strconv.Itoa(port)}
 	defer ds.Close()
-	defer server.Shutdown()
+	if err := ds.Start(context.Background()); err != nil {
+		logger.Fatalf("Failed to setup the dns server: %s\n", err.Error())
+		return
+	}
 	
+	// any server stop: shutdown all of them
+	err := <-ds.serverErrChan
+	ds.Shutdown(context.Background())
 	if err != nil {
-		logger.Fatalf("Failed to setup the udp server: %s\n", err.Error())
+		logger.Fatalf("Failed to setup the dns server: %s\n", err.Error())
 	}
 }
 
 func StartDNSServer(addr string, port int, hostFile string, remoteList []string) {
-	// bdb
-	dbCache := NewMemCache(GetLogPath("data.db"))
-	
-	// hostIpRecord
-	hostIpRecord := map[string]string{}
-	if hostFile != "" {
-		var recordErr error
-		hostIpRecord, recordErr = common.ParseHostFile(hostFile)
-		if recordErr != nil {
-			logger.Errorln("fail to parse host file[%s], error is %s\n", hostFile, recordErr)
-		}
-	}
-	
 	if port <= 0 {
 		port = DNSPort
 	}
@@ -427,10 +961,9 @@ func StartDNSServer(addr string, port int, hostFile string, remoteList []string)
 			newRemoteList = append(newRemoteList, host)
 		}
 	}
-	ds := &DNSSimpleServer{remoteList: remoteList, remote: remoteList[0], dbCache: dbCache, ttl: DNSDefaultTTL, failRecord: make(map[string]time.Duration), failRecordLock: sync.RWMutex{}}
-	if len(hostIpRecord) > 0 {
-		ds.UpdateHostRecord(hostIpRecord)
+	ds, err := NewDNSSimpleServer(DNSSimpleServerOptions{RemoteList: newRemoteList, HostFile: hostFile})
+	if err != nil {
+		logger.Fatalf("fail to create dns server: %s\n", err)
 	}
-	
 	ds.StartDNSServer(addr, port)
 }
@@ -0,0 +1,137 @@
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// testResponseWriter keeps the reply of handleDnsRequest
+type testResponseWriter struct {
+	remoteAddr net.Addr
+	reply      *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+
+func (w *testResponseWriter) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.reply = m
+	return len(buf), nil
+}
+
+func (w *testResponseWriter) Close() error {
+	return nil
+}
+
+func (w *testResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *testResponseWriter) Hijack() {}
+
+// handleTestRequest: reply of request from client address, nil if request is dropped
+func handleTestRequest(ds *DNSSimpleServer, clientAddr net.Addr, r *dns.Msg) *dns.Msg {
+	w := &testResponseWriter{remoteAddr: clientAddr}
+	ds.handleDnsRequest(w, r)
+	return w.reply
+}
+
+// queryTestServer: reply of query from udp client 127.0.0.1
+func queryTestServer(t *testing.T, ds *DNSSimpleServer, name string, qType uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qType)
+	m := handleTestRequest(ds, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, r)
+	if m == nil {
+		t.Fatalf("query of %s is dropped", name)
+	}
+	return m
+}
+
+// getTestAnswer: rdata of each answer record
+func getTestAnswer(m *dns.Msg) []string {
+	var answerList []string
+	for _, rr := range m.Answer {
+		answerList = append(answerList, rr.String()[len(rr.Header().String()):])
+	}
+	return answerList
+}
+
+// waitTestHostRecord waits for UpdateHostRecordMulti in background until host record of name exists or not
+func waitTestHostRecord(t *testing.T, ds *DNSSimpleServer, name string, exists bool) {
+	for i := 0; i < 100; i++ {
+		if _, err := ds.getRecord(dns.Fqdn(name), dns.TypeA); (err == nil) == exists {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("host record of %s: exists is not %v", name, exists)
+}
+
+func TestUpdateHostRecordMulti(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{})
+	ds.UpdateHostRecordMulti(map[string][]string{
+		"multi.lan": {"10.0.0.1", "10.0.0.2", "2001:db8::1"},
+		"v6.lan":    {"2001:db8::2"},
+		"alias.lan": {"multi.lan"},
+		".wild.lan": {"10.0.0.3"},
+	})
+	waitTestHostRecord(t, ds, "wild.lan", true)
+	testCases := []struct {
+		name   string
+		qType  uint16
+		rcode  int
+		answer []string
+	}{
+		{name: "multi.lan", qType: dns.TypeA, answer: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "multi.lan", qType: dns.TypeAAAA, answer: []string{"2001:db8::1"}},
+		{name: "v6.lan", qType: dns.TypeAAAA, answer: []string{"2001:db8::2"}},
+		// NODATA of host record, instead of querying remote server
+		{name: "v6.lan", qType: dns.TypeA},
+		{name: "v6.lan", qType: dns.TypeMX},
+		{name: "alias.lan", qType: dns.TypeAAAA, answer: []string{"multi.lan.", "2001:db8::1"}},
+		{name: "wild.lan", qType: dns.TypeA, answer: []string{"10.0.0.3"}},
+		{name: "a.b.wild.lan", qType: dns.TypeA, answer: []string{"10.0.0.3"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name+"/"+dns.TypeToString[testCase.qType], func(t *testing.T) {
+			m := queryTestServer(t, ds, testCase.name, testCase.qType)
+			if m.Rcode != testCase.rcode {
+				t.Fatalf("rcode is %s, expected %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[testCase.rcode])
+			}
+			answerList := getTestAnswer(m)
+			if len(answerList) != len(testCase.answer) {
+				t.Fatalf("answer is %v, expected %v", answerList, testCase.answer)
+			}
+			for i := range answerList {
+				if answerList[i] != testCase.answer[i] {
+					t.Errorf("answer is %v, expected %v", answerList, testCase.answer)
+				}
+			}
+		})
+	}
+	
+	// UpdateHostRecord replaces all host record
+	ds.UpdateHostRecord(map[string]string{"single.lan": "10.0.0.4"})
+	waitTestHostRecord(t, ds, "multi.lan", false)
+	if answerList := getTestAnswer(queryTestServer(t, ds, "single.lan", dns.TypeA)); len(answerList) != 1 || answerList[0] != "10.0.0.4" {
+		t.Errorf("answer of single.lan is %v", answerList)
+	}
+}
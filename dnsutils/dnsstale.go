@@ -0,0 +1,152 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc8767, Serving Stale Data to Improve DNS Resiliency
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+var (
+	// cached answer is prefetched if queried when its remaining ttl is less than DNSPrefetchRatio of the original ttl
+	DNSPrefetchRatio = 0.1
+	// how long expired answer is kept for serve-stale
+	DNSStaleMaxTTL = 24 * time.Hour
+	// ttl of stale answer, ref: rfc8767#section-4
+	DNSStaleAnswerTTL = 30 * time.Second
+	// stale answer is used if remote server does not answer in time, ref: rfc8767#section-5
+	DNSStaleClientTimeout = 1800 * time.Millisecond
+	// after refresh fails, stale answer is used at once without waiting for remote server until the interval passes,
+	// ref: rfc8767#section-5, failure recheck timer
+	DNSStaleRecheckInterval = 30 * time.Second
+)
+
+// cached answer of rType, or CNAME of the name
+func (ds *DNSSimpleServer) getCacheContent(cacheKey string, rType uint16) *CacheContent {
+	result, err := ds.getResult(ds.answerCache, cacheKey)
+	if err != nil {
+		return nil
+	}
+	if cacheContent, exists := result[rType]; exists {
+		return cacheContent
+	}
+	if cacheContent, exists := result[dns.TypeCNAME]; exists && !cacheContent.Negative {
+		return cacheContent
+	}
+	return nil
+}
+
+// expired answer which is still in the stale window, with ttl DNSStaleAnswerTTL
+func (ds *DNSSimpleServer) getStaleRecord(cacheKey string, rType uint16) []dns.RR {
+	if ds.staleMaxTTL <= 0 {
+		return nil
+	}
+	result, err := ds.getAllResult(ds.answerCache, cacheKey)
+	if err != nil {
+		return nil
+	}
+	cacheContent, exists := result[rType]
+	if !exists || cacheContent.Negative {
+		cacheContent, exists = result[dns.TypeCNAME]
+	}
+	if !exists || cacheContent.Negative || !cacheContent.isExpired(time.Duration(time.Now().Unix())*time.Second) {
+		return nil
+	}
+	
+	for _, r := range cacheContent.Value {
+		r.Header().Ttl = uint32(DNSStaleAnswerTTL / time.Second)
+	}
+	return cacheContent.Value
+}
+
+func getRefreshKey(question *dns.Question, ecsCacheKey string) string {
+	return fmt.Sprintf("%s/%d/%s", strings.ToLower(question.Name), question.Qtype, ecsCacheKey)
+}
+
+// whether refresh of the question failed in the last DNSStaleRecheckInterval
+func (ds *DNSSimpleServer) isRefreshFailed(refreshKey string) bool {
+	failedAt, exists := ds.staleFailMap.Load(refreshKey)
+	if !exists {
+		return false
+	}
+	if time.Since(failedAt.(time.Time)) < DNSStaleRecheckInterval {
+		return true
+	}
+	ds.staleFailMap.Delete(refreshKey)
+	return false
+}
+
+// refresh cached answer from remote server in background; done is nil if it is being refreshed
+func (ds *DNSSimpleServer) refreshRecord(r *dns.Msg, question *dns.Question, ecsCacheKey string) (subM *dns.Msg, done chan struct{}) {
+	refreshKey := getRefreshKey(question, ecsCacheKey)
+	if _, loaded := ds.refreshMap.LoadOrStore(refreshKey, true); loaded {
+		return nil, nil
+	}
+	
+	subQuestion := *question
+	subR := r.Copy()
+	subR.Question = []dns.Question{subQuestion}
+	subM = new(dns.Msg)
+	subM.SetReply(subR)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ds.refreshMap.Delete(refreshKey)
+		ds.answerFromRemote(subR, subM, &subQuestion, ecsCacheKey, true)
+		if subM.Rcode == dns.RcodeServerFailure {
+			ds.staleFailMap.Store(refreshKey, time.Now())
+		} else {
+			ds.staleFailMap.Delete(refreshKey)
+		}
+	}()
+	return subM, done
+}
+
+// prefetch cached answer which is about to expire, so that hot name is always answered from cache
+func (ds *DNSSimpleServer) checkPrefetch(r *dns.Msg, question *dns.Question, cacheKey string, ecsCacheKey string) {
+	if !ds.prefetch {
+		return
+	}
+	cacheContent := ds.getCacheContent(cacheKey, question.Qtype)
+	if cacheContent == nil || cacheContent.Negative || cacheContent.TTL <= LongLiveDNSTTL || cacheContent.OrigTTL <= 0 {
+		return
+	}
+	remaining := cacheContent.TTL - time.Duration(time.Now().Unix())*time.Second
+	if float64(remaining) < float64(cacheContent.OrigTTL)*DNSPrefetchRatio {
+		if _, done := ds.refreshRecord(r, question, ecsCacheKey); done != nil {
+			ds.logger.Infof("prefetch host[%s], remaining ttl is %s\n", question.Name, remaining)
+		}
+	}
+}
+
+// answer from remote server; if there is stale answer, it is used when remote server fails or is slow, and the
+// cache is still refreshed in background; it is used at once if refresh failed recently
+func (ds *DNSSimpleServer) answerWithStale(r *dns.Msg, m *dns.Msg, question *dns.Question, ecsCacheKey string) {
+	staleList := ds.getStaleRecord(ds.getKey(question.Name), question.Qtype)
+	if len(staleList) == 0 {
+		ds.answerFromRemote(r, m, question, ecsCacheKey, false)
+		return
+	}
+	if ds.isRefreshFailed(getRefreshKey(question, ecsCacheKey)) {
+		ds.logger.Infof("host[%s] is answered with stale record, refresh failed recently\n", question.Name)
+		m.Answer = append(m.Answer, staleList...)
+		return
+	}
+	
+	if subM, done := ds.refreshRecord(r, question, ecsCacheKey); done != nil {
+		select {
+		case <-done:
+			if subM.Rcode != dns.RcodeServerFailure {
+				m.Rcode = subM.Rcode
+				m.AuthenticatedData = subM.AuthenticatedData
+				m.Answer = append(m.Answer, subM.Answer...)
+				m.Ns = append(m.Ns, subM.Ns...)
+				return
+			}
+		case <-time.After(DNSStaleClientTimeout):
+		}
+	}
+	ds.logger.Infof("host[%s] is answered with stale record\n", question.Name)
+	m.Answer = append(m.Answer, staleList...)
+}
@@ -0,0 +1,141 @@
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testUpstreamOK int32 = iota
+	testUpstreamFail
+	testUpstreamSlow
+)
+
+// stand-in of remote server which answers 10.0.0.9, fails, or answers slowly by mode
+type testStaleUpstream struct {
+	mode  int32
+	count int32
+}
+
+func (upstream *testStaleUpstream) handle(w dns.ResponseWriter, r *dns.Msg) {
+	atomic.AddInt32(&upstream.count, 1)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	switch atomic.LoadInt32(&upstream.mode) {
+	case testUpstreamFail:
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	case testUpstreamSlow:
+		time.Sleep(300 * time.Millisecond)
+	}
+	m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A: []byte{10, 0, 0, 9}})
+	w.WriteMsg(m)
+}
+
+// setTestAnswerRecord saves answer of remote server to cache, which expires after expire
+func setTestAnswerRecord(t *testing.T, ds *DNSSimpleServer, rrStr string, expire time.Duration, origTTL time.Duration) {
+	rr := newTestRR(t, rrStr)
+	result := map[uint16]*CacheContent{rr.Header().Rrtype: {
+		TTL:     time.Duration(time.Now().Unix())*time.Second + expire,
+		Value:   []dns.RR{rr},
+		OrigTTL: origTTL,
+	}}
+	if err := ds.setResult(ds.answerCache, ds.getKey(rr.Header().Name), result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitTestAnswer waits for refresh in background until answer of name is ip
+func waitTestAnswer(t *testing.T, ds *DNSSimpleServer, name string, ip string) {
+	for i := 0; i < 100; i++ {
+		if answerList, err := ds.getRecord(dns.Fqdn(name), dns.TypeA); err == nil && len(answerList) == 1 &&
+			answerList[0].(*dns.A).A.String() == ip {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("answer of %s is not refreshed to %s", name, ip)
+}
+
+func TestServeStale(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		DNSStaleClientTimeout, DNSStaleRecheckInterval = timeout, interval
+	}(DNSStaleClientTimeout, DNSStaleRecheckInterval)
+	DNSStaleClientTimeout = 100 * time.Millisecond
+	DNSStaleRecheckInterval = time.Hour
+	
+	upstream := &testStaleUpstream{mode: testUpstreamFail}
+	ds := newTestServer(t, DNSSimpleServerOptions{RemoteList: []string{newTestUpstream(t, upstream.handle)}, ServeStale: true})
+	setTestAnswerRecord(t, ds, "stale.test. 60 IN A 10.0.0.1", -10*time.Second, time.Minute)
+	checkAnswer := func(name string, rcode int, answer string, ttl uint32, count int32) {
+		t.Helper()
+		m := queryTestServer(t, ds, name, dns.TypeA)
+		answerList := getTestAnswer(m)
+		if m.Rcode != rcode || len(answer) > 0 && (len(answerList) != 1 || answerList[0] != answer || m.Answer[0].Header().Ttl != ttl) {
+			t.Errorf("reply of %s is %s", name, m)
+		}
+		if queryCount := atomic.LoadInt32(&upstream.count); queryCount != count {
+			t.Errorf("remote query is %d, expected %d", queryCount, count)
+		}
+	}
+	
+	// remote server fails: stale answer with ttl DNSStaleAnswerTTL
+	checkAnswer("stale.test", dns.RcodeSuccess, "10.0.0.1", uint32(DNSStaleAnswerTTL/time.Second), 1)
+	// refresh failed recently: stale answer without remote query
+	checkAnswer("stale.test", dns.RcodeSuccess, "10.0.0.1", uint32(DNSStaleAnswerTTL/time.Second), 1)
+	// no stale answer
+	checkAnswer("none.test", dns.RcodeServerFailure, "", 0, 2)
+	
+	// recheck interval passes, and remote server is back
+	DNSStaleRecheckInterval = 0
+	atomic.StoreInt32(&upstream.mode, testUpstreamOK)
+	checkAnswer("stale.test", dns.RcodeSuccess, "10.0.0.9", 300, 3)
+	
+	// remote server is slow: stale answer after DNSStaleClientTimeout, and cache is refreshed in background
+	atomic.StoreInt32(&upstream.mode, testUpstreamSlow)
+	setTestAnswerRecord(t, ds, "slow.test. 60 IN A 10.0.0.1", -10*time.Second, time.Minute)
+	start := time.Now()
+	checkAnswer("slow.test", dns.RcodeSuccess, "10.0.0.1", uint32(DNSStaleAnswerTTL/time.Second), 4)
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("stale answer is sent after %s", elapsed)
+	}
+	waitTestAnswer(t, ds, "slow.test", "10.0.0.9")
+}
+
+func TestPrefetch(t *testing.T) {
+	testCases := []struct {
+		name     string
+		prefetch bool
+		// remaining ttl of cached answer, original ttl is 300s
+		expire time.Duration
+		count  int32
+	}{
+		{name: "about to expire", prefetch: true, expire: 10 * time.Second, count: 1},
+		{name: "not about to expire", prefetch: true, expire: 200 * time.Second},
+		{name: "disabled", expire: 10 * time.Second},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			upstream := &testStaleUpstream{}
+			ds := newTestServer(t, DNSSimpleServerOptions{RemoteList: []string{newTestUpstream(t, upstream.handle)}, Prefetch: testCase.prefetch})
+			setTestAnswerRecord(t, ds, "prefetch.test. 300 IN A 10.0.0.1", testCase.expire, 300*time.Second)
+			
+			// cached answer is used, and it is refreshed in background
+			if answerList := getTestAnswer(queryTestServer(t, ds, "prefetch.test", dns.TypeA)); len(answerList) != 1 || answerList[0] != "10.0.0.1" {
+				t.Fatalf("answer is %v", answerList)
+			}
+			if testCase.count > 0 {
+				waitTestAnswer(t, ds, "prefetch.test", "10.0.0.9")
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+			if count := atomic.LoadInt32(&upstream.count); count != testCase.count {
+				t.Errorf("remote query is %d, expected %d", count, testCase.count)
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc2136, dynamic update
+// ref: https://tools.ietf.org/html/rfc8945, TSIG
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"hash"
+	"sync"
+	"time"
+)
+
+const (
+	DNSTsigFudge uint16 = 300
+)
+
+// DNSTsigKey: key for signed dynamic update
+type DNSTsigKey struct {
+	// key name, like `update-key.`
+	Name string
+	// dns.HmacSHA256 or dns.HmacSHA512, default is dns.HmacSHA256
+	Algorithm string
+	// base64 encoded secret
+	Secret string
+	// zone which can be updated with this key, empty means any zone
+	Zones []string
+}
+
+// key store, also used as dns.TsigProvider of dns.Server
+type dnsTsigKeyStore struct {
+	keyMap map[string]*DNSTsigKey
+	lock   sync.RWMutex
+}
+
+func newDNSTsigKeyStore() *dnsTsigKeyStore {
+	return &dnsTsigKeyStore{keyMap: make(map[string]*DNSTsigKey), lock: sync.RWMutex{}}
+}
+
+func (store *dnsTsigKeyStore) get(name string) (*DNSTsigKey, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	key, exists := store.keyMap[dns.CanonicalName(name)]
+	return key, exists
+}
+
+func (store *dnsTsigKeyStore) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key, exists := store.get(t.Hdr.Name)
+	if !exists {
+		return nil, dns.ErrSecret
+	}
+	if dns.CanonicalName(t.Algorithm) != key.Algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch key.Algorithm {
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, secret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (store *dnsTsigKeyStore) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := store.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// SetTsigKey adds or replaces key with the same name
+func (ds *DNSSimpleServer) SetTsigKey(key DNSTsigKey) error {
+	if len(key.Name) == 0 {
+		return fmt.Errorf("name of tsig key is empty")
+	}
+	key.Name = dns.CanonicalName(key.Name)
+	if len(key.Algorithm) == 0 {
+		key.Algorithm = dns.HmacSHA256
+	}
+	key.Algorithm = dns.CanonicalName(key.Algorithm)
+	if key.Algorithm != dns.HmacSHA256 && key.Algorithm != dns.HmacSHA512 {
+		return fmt.Errorf("unsupported algorithm[%s] of tsig key[%s]", key.Algorithm, key.Name)
+	}
+	if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || len(key.Secret) == 0 {
+		return fmt.Errorf("invalid secret of tsig key[%s]", key.Name)
+	}
+	zoneList := make([]string, 0, len(key.Zones))
+	for _, zone := range key.Zones {
+		zoneList = append(zoneList, dns.CanonicalName(zone))
+	}
+	key.Zones = zoneList
+	
+	ds.tsigKeyStore.lock.Lock()
+	ds.tsigKeyStore.keyMap[key.Name] = &key
+	ds.tsigKeyStore.lock.Unlock()
+	return nil
+}
+
+func (ds *DNSSimpleServer) RemoveTsigKey(name string) {
+	ds.tsigKeyStore.lock.Lock()
+	delete(ds.tsigKeyStore.keyMap, dns.CanonicalName(name))
+	ds.tsigKeyStore.lock.Unlock()
+}
+
+func (ds *DNSSimpleServer) getDynamicCacheKey(domain string) string {
+	return ds.getKey(dns.CanonicalName(domain))
+}
+
+// rrset of dynamic record: rType => record list
+func (ds *DNSSimpleServer) getDynamicRecord(domain string) map[uint16][]dns.RR {
+	typeRecord := make(map[uint16][]dns.RR)
+	result, err := ds.getResult(ds.dynamicCache, ds.getDynamicCacheKey(domain))
+	if err != nil {
+		return typeRecord
+	}
+	for rType, cacheContent := range result {
+		typeRecord[rType] = cacheContent.Value
+	}
+	return typeRecord
+}
+
+func (ds *DNSSimpleServer) setDynamicRecord(domain string, typeRecord map[uint16][]dns.RR) error {
+	cacheKey := ds.getDynamicCacheKey(domain)
+	result := make(map[uint16]*CacheContent, len(typeRecord))
+	for rType, rrList := range typeRecord {
+		if len(rrList) == 0 {
+			continue
+		}
+		result[rType] = &CacheContent{TTL: LongLiveDNSTTL, Value: rrList}
+	}
+	if len(result) == 0 {
+		return ds.dynamicCache.Delete(cacheKey)
+	}
+	return ds.setResult(ds.dynamicCache, cacheKey, result)
+}
+
+// answer from dynamic record: rrset of question type, or CNAME
+func (ds *DNSSimpleServer) answerFromDynamic(question *dns.Question, m *dns.Msg) bool {
+	typeRecord := ds.getDynamicRecord(question.Name)
+	answerList := typeRecord[question.Qtype]
+	if len(answerList) == 0 {
+		answerList = typeRecord[dns.TypeCNAME]
+	}
+	if len(answerList) == 0 {
+		return false
+	}
+	m.Answer = append(m.Answer, answerList...)
+	return true
+}
+
+// same rr ignoring ttl and class
+func isSameRecord(r1, r2 dns.RR) bool {
+	r1, r2 = dns.Copy(r1), dns.Copy(r2)
+	r1.Header().Class, r2.Header().Class = dns.ClassINET, dns.ClassINET
+	r1.Header().Name, r2.Header().Name = dns.CanonicalName(r1.Header().Name), dns.CanonicalName(r2.Header().Name)
+	return dns.IsDuplicate(r1, r2)
+}
+
+func containsRecord(rrList []dns.RR, rr dns.RR) bool {
+	for _, r := range rrList {
+		if isSameRecord(r, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// prerequisite section, ref: rfc2136#section-3.2
+func (ds *DNSSimpleServer) checkUpdatePrerequisite(zone *dns.Question, prereqList []dns.RR) int {
+	// value dependent prerequisite is compared as a whole rrset
+	expectedRecord := make(map[string]map[uint16][]dns.RR)
+	for _, rr := range prereqList {
+		header := rr.Header()
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone.Name, header.Name) {
+			return dns.RcodeNotZone
+		}
+		typeRecord := ds.getDynamicRecord(header.Name)
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY {
+				if len(typeRecord) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(typeRecord[header.Rrtype]) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY {
+				if len(typeRecord) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(typeRecord[header.Rrtype]) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case zone.Qclass:
+			name := dns.CanonicalName(header.Name)
+			if _, exists := expectedRecord[name]; !exists {
+				expectedRecord[name] = make(map[uint16][]dns.RR)
+			}
+			expectedRecord[name][header.Rrtype] = append(expectedRecord[name][header.Rrtype], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	
+	for name, expectedTypeRecord := range expectedRecord {
+		typeRecord := ds.getDynamicRecord(name)
+		for rType, expectedList := range expectedTypeRecord {
+			rrList := typeRecord[rType]
+			if len(rrList) != len(expectedList) {
+				return dns.RcodeNXRrset
+			}
+			for _, rr := range expectedList {
+				if !containsRecord(rrList, rr) {
+					return dns.RcodeNXRrset
+				}
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// update section prescan, ref: rfc2136#section-3.4.1
+func prescanUpdate(zone *dns.Question, updateList []dns.RR) int {
+	for _, rr := range updateList {
+		header := rr.Header()
+		if !dns.IsSubDomain(zone.Name, header.Name) {
+			return dns.RcodeNotZone
+		}
+		switch header.Class {
+		case zone.Qclass:
+			if header.Rrtype == dns.TypeANY || header.Rrtype == dns.TypeAXFR || header.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 || header.Rrtype == dns.TypeAXFR || header.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 || header.Rrtype == dns.TypeANY || header.Rrtype == dns.TypeAXFR || header.Rrtype == dns.TypeIXFR {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// update section, ref: rfc2136#section-3.4.2
+func (ds *DNSSimpleServer) applyUpdate(zone *dns.Question, updateList []dns.RR) error {
+	changedRecord := make(map[string]map[uint16][]dns.RR)
+	getTypeRecord := func(name string) map[uint16][]dns.RR {
+		name = dns.CanonicalName(name)
+		if _, exists := changedRecord[name]; !exists {
+			changedRecord[name] = ds.getDynamicRecord(name)
+		}
+		return changedRecord[name]
+	}
+	
+	for _, rr := range updateList {
+		header := rr.Header()
+		typeRecord := getTypeRecord(header.Name)
+		switch header.Class {
+		case zone.Qclass:
+			// add to rrset; CNAME and other data can not coexist
+			if header.Rrtype == dns.TypeCNAME {
+				for rType := range typeRecord {
+					delete(typeRecord, rType)
+				}
+			} else {
+				delete(typeRecord, dns.TypeCNAME)
+			}
+			if header.Rrtype == dns.TypeCNAME || header.Rrtype == dns.TypeSOA {
+				typeRecord[header.Rrtype] = []dns.RR{rr}
+			} else if !containsRecord(typeRecord[header.Rrtype], rr) {
+				typeRecord[header.Rrtype] = append(typeRecord[header.Rrtype], rr)
+			}
+		case dns.ClassANY:
+			if header.Rrtype == dns.TypeANY {
+				for rType := range typeRecord {
+					delete(typeRecord, rType)
+				}
+			} else {
+				delete(typeRecord, header.Rrtype)
+			}
+		case dns.ClassNONE:
+			var rrList []dns.RR
+			for _, r := range typeRecord[header.Rrtype] {
+				if !isSameRecord(r, rr) {
+					rrList = append(rrList, r)
+				}
+			}
+			typeRecord[header.Rrtype] = rrList
+		}
+	}
+	
+	for name, typeRecord := range changedRecord {
+		if err := ds.setDynamicRecord(name, typeRecord); err != nil {
+			return fmt.Errorf("fail to save dynamic record of %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// handle update message, and return rcode
+func (ds *DNSSimpleServer) parseUpdate(r *dns.Msg) int {
+	// only signed update is accepted
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return dns.RcodeRefused
+	}
+	key, exists := ds.tsigKeyStore.get(tsig.Hdr.Name)
+	if !exists {
+		return dns.RcodeNotAuth
+	}
+	
+	// zone section
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := r.Question[0]
+	zone.Name = dns.CanonicalName(zone.Name)
+	if len(key.Zones) > 0 {
+		allowed := false
+		for _, keyZone := range key.Zones {
+			if keyZone == zone.Name {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			// signature is valid, but denied by policy
+			return dns.RcodeRefused
+		}
+	}
+	
+	// prerequisite check and update are done as a whole
+	ds.dynamicLock.Lock()
+	defer ds.dynamicLock.Unlock()
+	if rcode := ds.checkUpdatePrerequisite(&zone, r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := prescanUpdate(&zone, r.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if err := ds.applyUpdate(&zone, r.Ns); err != nil {
+		ds.logger.Errorln(err)
+		return dns.RcodeServerFailure
+	}
+	ds.logger.Infof("success to update zone[%s] with key[%s], %d record\n", zone.Name, key.Name, len(r.Ns))
+	return dns.RcodeSuccess
+}
+
+// dns.DefaultMsgAcceptFunc rejects dynamic update with NOTIMP
+func acceptDNSMsg(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && !isResponse {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// sign reply with the key and algorithm of request
+func signReply(r *dns.Msg, m *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, DNSTsigFudge, time.Now().Unix())
+	}
+}
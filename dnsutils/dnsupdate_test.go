@@ -0,0 +1,149 @@
+package dnsutils
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+const testTsigSecret = "c2VjcmV0c2VjcmV0c2VjcmV0"
+
+func newTestUpdateServer(t *testing.T) string {
+	ds := newTestServer(t, DNSSimpleServerOptions{
+		ListenAddrList: []string{"127.0.0.1:0"},
+		TsigKeys:       []DNSTsigKey{{Name: "update-key", Secret: testTsigSecret, Zones: []string{"dyn.lan"}}},
+	})
+	if err := ds.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ds.Shutdown(context.Background())
+	})
+	return ds.Addrs()[0].String()
+}
+
+// exchange over tcp, message is signed if secret is not empty
+func exchangeTestMsg(t *testing.T, addr string, m *dns.Msg, secret string) *dns.Msg {
+	c := &dns.Client{Net: "tcp"}
+	if len(secret) > 0 {
+		c.TsigSecret = map[string]string{"update-key.": secret}
+		m.SetTsig("update-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newTestRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestParseUpdateAuth(t *testing.T) {
+	addr := newTestUpdateServer(t)
+	rr := newTestRR(t, "a.dyn.lan. 60 IN A 10.0.0.1")
+	testCases := []struct {
+		name   string
+		secret string
+		rcode  int
+	}{
+		{name: "unsigned", secret: "", rcode: dns.RcodeRefused},
+		{name: "bad mac", secret: "YmFkYmFkYmFk", rcode: dns.RcodeNotAuth},
+		{name: "signed", secret: testTsigSecret, rcode: dns.RcodeSuccess},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetUpdate("dyn.lan.")
+			m.Insert([]dns.RR{rr})
+			if r := exchangeTestMsg(t, addr, m, testCase.secret); r.Rcode != testCase.rcode {
+				t.Errorf("rcode is %s, expected %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[testCase.rcode])
+			}
+		})
+	}
+}
+
+func TestParseUpdatePrerequisite(t *testing.T) {
+	addr := newTestUpdateServer(t)
+	rr := newTestRR(t, "a.dyn.lan. 60 IN A 10.0.0.1")
+	m := new(dns.Msg)
+	m.SetUpdate("dyn.lan.")
+	m.Insert([]dns.RR{rr})
+	if r := exchangeTestMsg(t, addr, m, testTsigSecret); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("fail to add record: %s", dns.RcodeToString[r.Rcode])
+	}
+	
+	testCases := []struct {
+		name   string
+		prereq func(m *dns.Msg)
+		rcode  int
+	}{
+		{name: "name not in use", prereq: func(m *dns.Msg) {
+			m.NameNotUsed([]dns.RR{rr})
+		}, rcode: dns.RcodeYXDomain},
+		{name: "rrset exists", prereq: func(m *dns.Msg) {
+			m.RRsetUsed([]dns.RR{newTestRR(t, "a.dyn.lan. 60 IN TXT \"x\"")})
+		}, rcode: dns.RcodeNXRrset},
+		{name: "name in use", prereq: func(m *dns.Msg) {
+			m.NameUsed([]dns.RR{rr})
+		}, rcode: dns.RcodeSuccess},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetUpdate("dyn.lan.")
+			testCase.prereq(m)
+			m.Insert([]dns.RR{newTestRR(t, "b.dyn.lan. 60 IN A 10.0.0.2")})
+			if r := exchangeTestMsg(t, addr, m, testTsigSecret); r.Rcode != testCase.rcode {
+				t.Errorf("rcode is %s, expected %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[testCase.rcode])
+			}
+		})
+	}
+}
+
+func TestParseUpdateQuery(t *testing.T) {
+	addr := newTestUpdateServer(t)
+	rr1 := newTestRR(t, "a.dyn.lan. 60 IN A 10.0.0.1")
+	rr2 := newTestRR(t, "a.dyn.lan. 60 IN A 10.0.0.2")
+	query := func() []dns.RR {
+		q := new(dns.Msg)
+		q.SetQuestion("a.dyn.lan.", dns.TypeA)
+		return exchangeTestMsg(t, addr, q, "").Answer
+	}
+	
+	m := new(dns.Msg)
+	m.SetUpdate("dyn.lan.")
+	m.Insert([]dns.RR{rr1, rr2})
+	if r := exchangeTestMsg(t, addr, m, testTsigSecret); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("fail to add record: %s", dns.RcodeToString[r.Rcode])
+	}
+	if answer := query(); len(answer) != 2 {
+		t.Fatalf("answer after add is %v, expected 2 record", answer)
+	}
+	
+	m = new(dns.Msg)
+	m.SetUpdate("dyn.lan.")
+	m.Remove([]dns.RR{rr1})
+	if r := exchangeTestMsg(t, addr, m, testTsigSecret); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("fail to delete record: %s", dns.RcodeToString[r.Rcode])
+	}
+	if answer := query(); len(answer) != 1 || !isSameRecord(answer[0], rr2) {
+		t.Fatalf("answer after delete is %v, expected %s", answer, rr2)
+	}
+}
+
+func TestNewDNSSimpleServerTsigKey(t *testing.T) {
+	_, err := NewDNSSimpleServer(DNSSimpleServerOptions{
+		DBCache:  NewMemCache(""),
+		TsigKeys: []DNSTsigKey{{Name: "update-key", Secret: "not base64!"}},
+	})
+	if err == nil {
+		t.Fatal("expected error of malformed tsig key")
+	}
+}
@@ -0,0 +1,222 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc8484, DNS Queries over HTTPS (DoH)
+// ref: https://tools.ietf.org/html/rfc7858, DNS over Transport Layer Security (DoT)
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/frkhit/goutils/httputils"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DNSOverHTTPSScheme      = "https://"
+	DNSMessageContentType   = "application/dns-message"
+	dnsOverHTTPSMaxGetSize  = 2048
+	dnsOverHTTPSMaxBodySize = dns.MaxMsgSize
+	DNSOverTLSScheme        = "tls://"
+	DNSOverTLSPort          = 853
+	dnsOverTLSServerNameSep = "#"
+	dnsOverTLSMaxIdleConn   = 4
+	dnsOverTLSIdleTimeout   = 30 * time.Second
+)
+
+var (
+	// proxy for DoH remote server, like socks5://127.0.0.1:1080; empty means direct connect
+	DNSOverHTTPSProxyUrl = ""
+	// always use POST instead of GET when query DoH remote server
+	DNSOverHTTPSUsePost = false
+	// skip certificate verification of DoT remote server, only for testing
+	DNSOverTLSInsecureSkipVerify = false
+)
+
+func isDNSOverHTTPS(remote string) bool {
+	return strings.Index(remote, DNSOverHTTPSScheme) == 0
+}
+
+func isDNSOverTLS(remote string) bool {
+	return strings.Index(remote, DNSOverTLSScheme) == 0
+}
+
+// remote: tls://host:853 or tls://ip:853#server.name, server name is used for SNI and certificate verification
+func parseDNSOverTLSRemote(remote string) (addr string, serverName string) {
+	addr = strings.TrimPrefix(remote, DNSOverTLSScheme)
+	if index := strings.Index(addr, dnsOverTLSServerNameSep); index > -1 {
+		addr, serverName = addr[:index], addr[index+len(dnsOverTLSServerNameSep):]
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(DNSOverTLSPort))
+	}
+	if len(serverName) == 0 {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	return addr, serverName
+}
+
+func createDNSOverHTTPSRequest(r *dns.Msg, remote string) (*http.Request, error) {
+	// use id 0 for http cache friendly, ref: rfc8484#section-4.1
+	query := r.Copy()
+	query.Id = 0
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("fail to pack dns query: %s", err)
+	}
+	
+	headers := map[string]string{"Accept": DNSMessageContentType}
+	var req *http.Request
+	encoded := base64.RawURLEncoding.EncodeToString(buf)
+	if !DNSOverHTTPSUsePost && len(encoded) <= dnsOverHTTPSMaxGetSize {
+		sep := "?"
+		if strings.Contains(remote, "?") {
+			sep = "&"
+		}
+		req, err = httputils.CreateHttpRequest("GET", remote+sep+"dns="+encoded, headers, nil)
+	} else {
+		headers["Content-Type"] = DNSMessageContentType
+		req, err = httputils.CreateHttpRequest("POST", remote, headers, bytes.NewReader(buf))
+	}
+	if err == nil && req == nil {
+		err = fmt.Errorf("invalid DoH remote server: %s", remote)
+	}
+	return req, err
+}
+
+func (ds *DNSSimpleServer) getHTTPClient() (*http.Client, error) {
+	if ds.httpClient != nil {
+		return ds.httpClient, nil
+	}
+	return httputils.DefaultGlobalClientCache.CreateHttpClient(ds.httpsProxyUrl, ds.queryTimeout, "")
+}
+
+func (ds *DNSSimpleServer) exchangeHTTPS(r *dns.Msg, remote string) (*dns.Msg, error) {
+	client, err := ds.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := createDNSOverHTTPSRequest(r, remote)
+	if err != nil {
+		return nil, err
+	}
+	
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httputils.ForceCloseResponse(resp)
+	
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH remote server[%s] response status: %s", remote, resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); strings.Index(contentType, DNSMessageContentType) != 0 {
+		return nil, fmt.Errorf("DoH remote server[%s] response content type: %s", remote, contentType)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dnsOverHTTPSMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	
+	newMsg := new(dns.Msg)
+	if err := newMsg.Unpack(body); err != nil {
+		return nil, fmt.Errorf("fail to unpack DoH response: %s", err)
+	}
+	// query is sent with id 0, so the response should also be id 0
+	if newMsg.Id != 0 {
+		return nil, fmt.Errorf("DoH remote server[%s] response id %d, expected 0", remote, newMsg.Id)
+	}
+	newMsg.Id = r.Id
+	return newMsg, nil
+}
+
+type dnsTLSConn struct {
+	conn     *dns.Conn
+	lastUsed time.Time
+}
+
+// keep idle DoT connections, so that each query would not pay for tcp and tls handshake
+type dnsTLSConnPool struct {
+	idle map[string][]*dnsTLSConn
+	lock sync.Mutex
+}
+
+func newDNSTLSConnPool() *dnsTLSConnPool {
+	return &dnsTLSConnPool{idle: make(map[string][]*dnsTLSConn), lock: sync.Mutex{}}
+}
+
+func (pool *dnsTLSConnPool) get(remote string) *dns.Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	
+	for len(pool.idle[remote]) > 0 {
+		connList := pool.idle[remote]
+		tlsConn := connList[len(connList)-1]
+		pool.idle[remote] = connList[:len(connList)-1]
+		if time.Since(tlsConn.lastUsed) < dnsOverTLSIdleTimeout {
+			return tlsConn.conn
+		}
+		tlsConn.conn.Close()
+	}
+	return nil
+}
+
+func (pool *dnsTLSConnPool) put(remote string, conn *dns.Conn) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	
+	if len(pool.idle[remote]) >= dnsOverTLSMaxIdleConn {
+		conn.Close()
+		return
+	}
+	pool.idle[remote] = append(pool.idle[remote], &dnsTLSConn{conn: conn, lastUsed: time.Now()})
+}
+
+func (pool *dnsTLSConnPool) Close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	
+	for remote, connList := range pool.idle {
+		for _, tlsConn := range connList {
+			tlsConn.conn.Close()
+		}
+		delete(pool.idle, remote)
+	}
+}
+
+func (ds *DNSSimpleServer) exchangeTLS(r *dns.Msg, remote string) (*dns.Msg, error) {
+	addr, serverName := parseDNSOverTLSRemote(remote)
+	c := new(dns.Client)
+	c.Timeout = ds.queryTimeout
+	c.Net = "tcp-tls"
+	c.TLSConfig = &tls.Config{ServerName: serverName, InsecureSkipVerify: ds.tlsInsecureSkipVerify}
+	
+	// reuse idle connection first; it may be closed by remote server, then dial a new one
+	if conn := ds.tlsConnPool.get(remote); conn != nil {
+		newMsg, _, err := c.ExchangeWithConn(r, conn)
+		if err == nil {
+			ds.tlsConnPool.put(remote, conn)
+			return newMsg, nil
+		}
+		conn.Close()
+	}
+	
+	conn, err := c.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	newMsg, _, err := c.ExchangeWithConn(r, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ds.tlsConnPool.put(remote, conn)
+	return newMsg, nil
+}
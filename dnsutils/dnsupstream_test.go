@@ -0,0 +1,341 @@
+package dnsutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DoH stand-in: answers A record of question, fn may change the reply before it is written
+func newTestDoHServer(t *testing.T, fn func(w http.ResponseWriter, req *http.Request, m *dns.Msg) bool) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf []byte
+		switch req.Method {
+		case http.MethodGet:
+			buf, _ = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if req.Header.Get("Content-Type") != DNSMessageContentType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, _ = ioutil.ReadAll(req.Body)
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(buf); err != nil || len(q.Question) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if q.Id != 0 {
+			t.Errorf("DoH query id is %d, expected 0", q.Id)
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 300 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		m.Extra = append(m.Extra, &dns.TXT{Hdr: dns.RR_Header{Name: "method.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{req.Method}})
+		if fn != nil && !fn(w, req, m) {
+			return
+		}
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", DNSMessageContentType)
+		w.Write(out)
+	}))
+	
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestServer(t *testing.T, options DNSSimpleServerOptions) *DNSSimpleServer {
+	if options.DBCache == nil {
+		options.DBCache = NewMemCache("")
+	}
+	if len(options.RemoteList) == 0 {
+		options.RemoteList = []string{"127.0.0.1:1"}
+	}
+	ds, err := NewDNSSimpleServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ds.Close)
+	return ds
+}
+
+// udp stand-in of remote server, handler writes the reply of each query
+func newTestUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startChan := make(chan struct{})
+	server := &dns.Server{PacketConn: packetConn, Handler: handler, NotifyStartedFunc: func() {
+		close(startChan)
+	}}
+	go server.ActivateAndServe()
+	<-startChan
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return packetConn.LocalAddr().String()
+}
+
+func TestExchangeHTTPS(t *testing.T) {
+	testCases := []struct {
+		name    string
+		usePost bool
+		fn      func(w http.ResponseWriter, req *http.Request, m *dns.Msg) bool
+		wantErr bool
+	}{
+		{name: "get", usePost: false},
+		{name: "post", usePost: true},
+		{name: "status", fn: func(w http.ResponseWriter, req *http.Request, m *dns.Msg) bool {
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}, wantErr: true},
+		{name: "content type", fn: func(w http.ResponseWriter, req *http.Request, m *dns.Msg) bool {
+			out, _ := m.Pack()
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(out)
+			return false
+		}, wantErr: true},
+		{name: "id mismatch", fn: func(w http.ResponseWriter, req *http.Request, m *dns.Msg) bool {
+			m.Id = 1234
+			return true
+		}, wantErr: true},
+	}
+	
+	defer func(usePost bool) {
+		DNSOverHTTPSUsePost = usePost
+	}(DNSOverHTTPSUsePost)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			srv := newTestDoHServer(t, testCase.fn)
+			// client of the stand-in trusts its certificate
+			ds := &DNSSimpleServer{httpClient: srv.Client()}
+			DNSOverHTTPSUsePost = testCase.usePost
+			
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			m, err := ds.exchangeHTTPS(r, srv.URL+"/dns-query")
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Id != r.Id {
+				t.Errorf("id is %d, expected %d", m.Id, r.Id)
+			}
+			if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+				t.Errorf("unexpected answer: %v", m.Answer)
+			}
+			method := http.MethodGet
+			if testCase.usePost {
+				method = http.MethodPost
+			}
+			if len(m.Extra) != 1 || m.Extra[0].(*dns.TXT).Txt[0] != method {
+				t.Errorf("request method is %v, expected %s", m.Extra, method)
+			}
+		})
+	}
+}
+
+func TestGetRemoteListHTTPS(t *testing.T) {
+	remoteList := GetRemoteList("8.8.8.8,https://dns.example/dns-query")
+	if len(remoteList) != 2 || remoteList[0] != "8.8.8.8:53" || remoteList[1] != "https://dns.example/dns-query" {
+		t.Fatalf("unexpected remote list: %v", remoteList)
+	}
+}
+
+// self-signed certificate of dns.test and 127.0.0.1
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// DoT stand-in: answers A record of question, and keeps accepted connections and server name of each handshake
+type testDoTServer struct {
+	listener       net.Listener
+	server         *dns.Server
+	connList       []net.Conn
+	serverNameList []string
+	lock           sync.Mutex
+}
+
+func (srv *testDoTServer) Accept() (net.Conn, error) {
+	conn, err := srv.listener.Accept()
+	if err == nil {
+		srv.lock.Lock()
+		srv.connList = append(srv.connList, conn)
+		srv.lock.Unlock()
+	}
+	return conn, err
+}
+
+func (srv *testDoTServer) Close() error {
+	return srv.listener.Close()
+}
+
+func (srv *testDoTServer) Addr() net.Addr {
+	return srv.listener.Addr()
+}
+
+func (srv *testDoTServer) getConnCount() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	
+	return len(srv.connList)
+}
+
+// dropConn closes all accepted connection
+func (srv *testDoTServer) dropConn() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	
+	for _, conn := range srv.connList {
+		conn.Close()
+	}
+}
+
+func newTestDoTServer(t *testing.T) *testDoTServer {
+	srv := &testDoTServer{}
+	config := newTestTLSConfig(t)
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		srv.lock.Lock()
+		srv.serverNameList = append(srv.serverNameList, hello.ServerName)
+		srv.lock.Unlock()
+		return nil, nil
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.listener = listener
+	started := make(chan struct{})
+	srv.server = &dns.Server{Listener: srv, NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 10.0.0.2")
+			m.Answer = append(m.Answer, rr)
+			w.WriteMsg(m)
+		})}
+	go srv.server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		srv.server.Shutdown()
+		srv.dropConn()
+	})
+	return srv
+}
+
+func TestExchangeTLS(t *testing.T) {
+	srv := newTestDoTServer(t)
+	ds := &DNSSimpleServer{tlsConnPool: newDNSTLSConnPool(), tlsInsecureSkipVerify: true, queryTimeout: time.Second}
+	defer ds.tlsConnPool.Close()
+	remote := DNSOverTLSScheme + srv.Addr().String() + dnsOverTLSServerNameSep + "dns.test"
+	
+	testCases := []struct {
+		name      string
+		before    func()
+		connCount int
+	}{
+		{name: "dial", connCount: 1},
+		{name: "reuse idle connection", connCount: 1},
+		{name: "redial after remote closes connection", before: srv.dropConn, connCount: 2},
+		{name: "redial after idle timeout", before: func() {
+			ds.tlsConnPool.lock.Lock()
+			for _, tlsConn := range ds.tlsConnPool.idle[remote] {
+				tlsConn.lastUsed = time.Now().Add(-dnsOverTLSIdleTimeout)
+			}
+			ds.tlsConnPool.lock.Unlock()
+		}, connCount: 3},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.before != nil {
+				testCase.before()
+			}
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			m, err := ds.exchangeTLS(r, remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+				t.Errorf("unexpected answer: %v", m.Answer)
+			}
+			if count := srv.getConnCount(); count != testCase.connCount {
+				t.Errorf("connection count is %d, expected %d", count, testCase.connCount)
+			}
+			if count := len(ds.tlsConnPool.idle[remote]); count != 1 {
+				t.Errorf("idle connection count is %d, expected 1", count)
+			}
+		})
+	}
+	
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if len(srv.serverNameList) != 3 {
+		t.Errorf("handshake count is %d, expected 3", len(srv.serverNameList))
+	}
+	for _, serverName := range srv.serverNameList {
+		if serverName != "dns.test" {
+			t.Errorf("server name is %q, expected dns.test", serverName)
+		}
+	}
+}
+
+func TestDNSTLSConnPoolMaxIdle(t *testing.T) {
+	pool := newDNSTLSConnPool()
+	var connList []net.Conn
+	for i := 0; i < dnsOverTLSMaxIdleConn+2; i++ {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		connList = append(connList, conn)
+		pool.put("tls://127.0.0.1:853", &dns.Conn{Conn: conn})
+	}
+	if count := len(pool.idle["tls://127.0.0.1:853"]); count != dnsOverTLSMaxIdleConn {
+		t.Errorf("idle connection count is %d, expected %d", count, dnsOverTLSMaxIdleConn)
+	}
+	// connection over the limit is closed
+	if _, err := connList[len(connList)-1].Write([]byte{0}); err == nil {
+		t.Error("connection over the limit is not closed")
+	}
+	pool.Close()
+	if conn := pool.get("tls://127.0.0.1:853"); conn != nil {
+		t.Error("idle connection is kept after Close")
+	}
+}
@@ -0,0 +1,304 @@
+package dnsutils
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DNSUpstreamStrategy int
+
+const (
+	// try remote server one by one
+	UpstreamSequential DNSUpstreamStrategy = iota
+	// try remote server in random order
+	UpstreamRandom
+	// each query starts from next remote server
+	UpstreamRoundRobin
+	// query all remote server at the same time, and take the first valid answer
+	UpstreamRace
+	// prefer remote server with lower rtt
+	UpstreamLatency
+)
+
+const (
+	dnsUpstreamRTTWeight = 0.3
+	// remote server is ejected for a while after continuous failure
+	DNSUpstreamMaxFailure = 3
+	DNSUpstreamEjectTime  = 30 * time.Second
+)
+
+var dnsUpstreamStrategyNames = map[DNSUpstreamStrategy]string{
+	UpstreamSequential: "sequential",
+	UpstreamRandom:     "random",
+	UpstreamRoundRobin: "round-robin",
+	UpstreamRace:       "race",
+	UpstreamLatency:    "latency",
+}
+
+func (strategy DNSUpstreamStrategy) String() string {
+	if name, exists := dnsUpstreamStrategyNames[strategy]; exists {
+		return name
+	}
+	return fmt.Sprintf("DNSUpstreamStrategy(%d)", int(strategy))
+}
+
+func ParseDNSUpstreamStrategy(name string) (DNSUpstreamStrategy, error) {
+	for strategy, strategyName := range dnsUpstreamStrategyNames {
+		if strategyName == strings.ToLower(strings.TrimSpace(name)) {
+			return strategy, nil
+		}
+	}
+	return UpstreamSequential, fmt.Errorf("unknown upstream strategy: %s", name)
+}
+
+type DNSUpstreamStat struct {
+	Group              string        `json:"group,omitempty"`
+	Remote             string        `json:"remote"`
+	RTT                time.Duration `json:"rtt"`
+	Success            uint64        `json:"success"`
+	Failure            uint64        `json:"failure"`
+	ConsecutiveFailure int           `json:"consecutive_failure"`
+	Ejected            bool          `json:"ejected"`
+	EjectedUntil       time.Time     `json:"ejected_until"`
+}
+
+type dnsUpstream struct {
+	remote             string
+	rtt                time.Duration
+	success            uint64
+	failure            uint64
+	consecutiveFailure int
+	ejectedUntil       time.Time
+	lock               sync.RWMutex
+}
+
+func (upstream *dnsUpstream) onSuccess(rtt time.Duration) {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	
+	// rtt EWMA
+	if upstream.rtt <= 0 {
+		upstream.rtt = rtt
+	} else {
+		upstream.rtt = time.Duration(float64(upstream.rtt)*(1-dnsUpstreamRTTWeight) + float64(rtt)*dnsUpstreamRTTWeight)
+	}
+	upstream.success++
+	upstream.consecutiveFailure = 0
+	upstream.ejectedUntil = time.Time{}
+}
+
+func (upstream *dnsUpstream) onFailure() {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	
+	upstream.failure++
+	upstream.consecutiveFailure++
+	if upstream.consecutiveFailure >= DNSUpstreamMaxFailure {
+		upstream.ejectedUntil = time.Now().Add(DNSUpstreamEjectTime)
+	}
+}
+
+func (upstream *dnsUpstream) isEjected(now time.Time) bool {
+	upstream.lock.RLock()
+	defer upstream.lock.RUnlock()
+	return now.Before(upstream.ejectedUntil)
+}
+
+func (upstream *dnsUpstream) getRTT() time.Duration {
+	upstream.lock.RLock()
+	defer upstream.lock.RUnlock()
+	return upstream.rtt
+}
+
+func (upstream *dnsUpstream) getStat(now time.Time) DNSUpstreamStat {
+	upstream.lock.RLock()
+	defer upstream.lock.RUnlock()
+	return DNSUpstreamStat{
+		Remote:             upstream.remote,
+		RTT:                upstream.rtt,
+		Success:            upstream.success,
+		Failure:            upstream.failure,
+		ConsecutiveFailure: upstream.consecutiveFailure,
+		Ejected:            now.Before(upstream.ejectedUntil),
+		EjectedUntil:       upstream.ejectedUntil,
+	}
+}
+
+type dnsUpstreamGroup struct {
+	name         string
+	strategy     DNSUpstreamStrategy
+	upstreamList []*dnsUpstream
+	next         uint32
+}
+
+func newDNSUpstreamGroup(remoteList []string, strategy DNSUpstreamStrategy) *dnsUpstreamGroup {
+	group := &dnsUpstreamGroup{strategy: strategy}
+	for _, remote := range remoteList {
+		group.upstreamList = append(group.upstreamList, &dnsUpstream{remote: remote, lock: sync.RWMutex{}})
+	}
+	return group
+}
+
+// order of remote server to try; ejected remote server is moved to the end, and used only if all others fail
+func (group *dnsUpstreamGroup) getOrderedList() []*dnsUpstream {
+	size := len(group.upstreamList)
+	orderedList := make([]*dnsUpstream, size)
+	copy(orderedList, group.upstreamList)
+	if size <= 1 {
+		return orderedList
+	}
+	
+	switch group.strategy {
+	case UpstreamRandom:
+		rand.Shuffle(size, func(i, j int) {
+			orderedList[i], orderedList[j] = orderedList[j], orderedList[i]
+		})
+	
+	case UpstreamRoundRobin:
+		start := int(atomic.AddUint32(&group.next, 1)-1) % size
+		orderedList = append(orderedList[start:], orderedList[:start]...)
+	
+	case UpstreamLatency:
+		// the first one is chosen randomly weighted by 1/rtt, others are sorted by rtt
+		sort.SliceStable(orderedList, func(i, j int) bool {
+			return orderedList[i].getRTT() < orderedList[j].getRTT()
+		})
+		var totalWeight float64
+		weightList := make([]float64, size)
+		for i, upstream := range orderedList {
+			rtt := upstream.getRTT()
+			if rtt <= 0 {
+				// not measured yet: give it a chance
+				rtt = time.Millisecond
+			}
+			weightList[i] = 1 / float64(rtt)
+			totalWeight += weightList[i]
+		}
+		value := rand.Float64() * totalWeight
+		for i, weight := range weightList {
+			if value < weight {
+				orderedList[0], orderedList[i] = orderedList[i], orderedList[0]
+				break
+			}
+			value -= weight
+		}
+	}
+	
+	now := time.Now()
+	var activeList, ejectedList []*dnsUpstream
+	for _, upstream := range orderedList {
+		if upstream.isEjected(now) {
+			ejectedList = append(ejectedList, upstream)
+		} else {
+			activeList = append(activeList, upstream)
+		}
+	}
+	return append(activeList, ejectedList...)
+}
+
+func (group *dnsUpstreamGroup) getStats() []DNSUpstreamStat {
+	now := time.Now()
+	var statList []DNSUpstreamStat
+	for _, upstream := range group.upstreamList {
+		stat := upstream.getStat(now)
+		stat.Group = group.name
+		statList = append(statList, stat)
+	}
+	return statList
+}
+
+// query one remote server and record its health; SERVFAIL/REFUSED answer is not valid, but remote server is still alive
+func (ds *DNSSimpleServer) exchangeUpstream(r *dns.Msg, upstream *dnsUpstream) (*dns.Msg, error) {
+	start := time.Now()
+	newMsg, err := ds.exchange(r, upstream.remote)
+	if err == nil && newMsg == nil {
+		err = fmt.Errorf("empty answer")
+	}
+	if err != nil {
+		upstream.onFailure()
+	} else {
+		upstream.onSuccess(time.Since(start))
+		
+		// NXDOMAIN and NODATA are valid answers, but SERVFAIL/REFUSED should try next remote server
+		if newMsg.Rcode != dns.RcodeSuccess && newMsg.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("rcode is %s", dns.RcodeToString[newMsg.Rcode])
+		}
+	}
+	if err != nil {
+		if len(r.Question) > 0 {
+			ds.logger.Errorf("fail to query ip for domain[%s] from remote server[%s]: error is %s\n", r.Question[0].Name, upstream.remote, err)
+		} else {
+			ds.logger.Errorf("fail to query ip for domain from remote server[%s]: error is %s\n", upstream.remote, err)
+		}
+		return nil, err
+	}
+	return newMsg, nil
+}
+
+func (ds *DNSSimpleServer) queryUpstreamGroup(r *dns.Msg, group *dnsUpstreamGroup) *dns.Msg {
+	orderedList := group.getOrderedList()
+	if group.strategy != UpstreamRace {
+		for _, upstream := range orderedList {
+			if newMsg, err := ds.exchangeUpstream(r, upstream); err == nil {
+				return newMsg
+			}
+		}
+		return nil
+	}
+	
+	// race all active remote server; ejected ones are used only if all of them fail
+	now := time.Now()
+	var raceList, ejectedList []*dnsUpstream
+	for _, upstream := range orderedList {
+		if upstream.isEjected(now) {
+			ejectedList = append(ejectedList, upstream)
+		} else {
+			raceList = append(raceList, upstream)
+		}
+	}
+	for _, upstreamList := range [][]*dnsUpstream{raceList, ejectedList} {
+		if len(upstreamList) == 0 {
+			continue
+		}
+		// buffered so that slow remote server would not block
+		msgChan := make(chan *dns.Msg, len(upstreamList))
+		for _, upstream := range upstreamList {
+			go func(upstream *dnsUpstream) {
+				newMsg, _ := ds.exchangeUpstream(r.Copy(), upstream)
+				msgChan <- newMsg
+			}(upstream)
+		}
+		for range upstreamList {
+			if newMsg := <-msgChan; newMsg != nil {
+				return newMsg
+			}
+		}
+	}
+	return nil
+}
+
+// UpstreamStats: health of each remote server, remote server of route rule is grouped by its domain
+func (ds *DNSSimpleServer) UpstreamStats() []DNSUpstreamStat {
+	statList := ds.upstreamGroup.getStats()
+	
+	ds.routeTable.lock.RLock()
+	var groupList []*dnsUpstreamGroup
+	for _, group := range ds.routeTable.groupMap {
+		groupList = append(groupList, group)
+	}
+	ds.routeTable.lock.RUnlock()
+	
+	sort.Slice(groupList, func(i, j int) bool {
+		return groupList[i].name < groupList[j].name
+	})
+	for _, group := range groupList {
+		statList = append(statList, group.getStats()...)
+	}
+	return statList
+}
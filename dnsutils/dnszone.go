@@ -0,0 +1,327 @@
+package dnsutils
+
+// ref: https://tools.ietf.org/html/rfc1035#section-5, master files
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// separator of zone origin, zone version and record name in key of zone bucket
+const dnsZoneKeySep = "|"
+
+type dnsZone struct {
+	origin string
+	key    string
+	soa    *dns.SOA
+	// key prefix of record of this version of zone: `origin|version|`
+	prefix string
+}
+
+// zone table: reversed label key of zone origin => zone
+type dnsZoneTable struct {
+	zoneMap map[string]*dnsZone
+	lock    sync.RWMutex
+	// load and remove of zone are serialized, so that one load would not delete record of another
+	loadLock    sync.Mutex
+	lastVersion int64
+}
+
+func newDNSZoneTable() *dnsZoneTable {
+	return &dnsZoneTable{zoneMap: make(map[string]*dnsZone), lock: sync.RWMutex{}, loadLock: sync.Mutex{}}
+}
+
+// prefix of key of all version of zone
+func getZoneOriginPrefix(zoneKey string) string {
+	return zoneKey + dnsZoneKeySep
+}
+
+// each zone has its own keyspace, so record of parent zone and child zone with the same name would not overwrite
+// each other; and each load has new version, so that old version is answered until new version is ready
+func (ds *DNSSimpleServer) getZoneCacheKey(zone *dnsZone, domain string) string {
+	return zone.prefix + ds.getKey(domain)
+}
+
+// cache key of all version of zone, except the version with keepPrefix
+func (ds *DNSSimpleServer) getZoneKeyList(zoneKey string, keepPrefix string) ([]string, error) {
+	var keyList []string
+	err := ds.zoneCache.Scan(getZoneOriginPrefix(zoneKey), func(key, value string) bool {
+		if len(keepPrefix) == 0 || strings.Index(key, keepPrefix) != 0 {
+			keyList = append(keyList, key)
+		}
+		return true
+	})
+	return keyList, err
+}
+
+// ParseZoneFile: all records of zone file, origin is taken from SOA record if empty
+func ParseZoneFile(zoneFile, origin string) (string, []dns.RR, error) {
+	f, err := os.Open(zoneFile)
+	if err != nil {
+		return origin, nil, err
+	}
+	defer f.Close()
+	
+	if len(origin) > 0 {
+		origin = dns.Fqdn(origin)
+	}
+	var rrList []dns.RR
+	var soa *dns.SOA
+	zp := dns.NewZoneParser(f, origin, zoneFile)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if record, isSOA := rr.(*dns.SOA); isSOA {
+			if soa != nil {
+				return origin, nil, fmt.Errorf("more than one SOA record in zone file[%s]", zoneFile)
+			}
+			soa = record
+		}
+		rrList = append(rrList, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return origin, nil, fmt.Errorf("fail to parse zone file[%s]: %s", zoneFile, err)
+	}
+	if soa == nil {
+		return origin, nil, fmt.Errorf("SOA record not found in zone file[%s]", zoneFile)
+	}
+	if len(origin) == 0 {
+		origin = soa.Hdr.Name
+	}
+	if !strings.EqualFold(soa.Hdr.Name, origin) {
+		return origin, nil, fmt.Errorf("SOA record[%s] is not at zone apex[%s]", soa.Hdr.Name, origin)
+	}
+	for _, rr := range rrList {
+		if !dns.IsSubDomain(origin, rr.Header().Name) {
+			return origin, nil, fmt.Errorf("record[%s] is out of zone[%s]", rr.String(), origin)
+		}
+	}
+	return origin, rrList, nil
+}
+
+// LoadZoneFile loads RFC 1035 master file and answers authoritatively for the zone;
+// loading the same zone again atomically replaces its records
+func (ds *DNSSimpleServer) LoadZoneFile(zoneFile, origin string) error {
+	origin, rrList, err := ParseZoneFile(zoneFile, origin)
+	if err != nil {
+		return err
+	}
+	return ds.UpdateZoneRecord(origin, rrList)
+}
+
+func (ds *DNSSimpleServer) UpdateZoneRecord(origin string, rrList []dns.RR) error {
+	ds.zoneTable.loadLock.Lock()
+	defer ds.zoneTable.loadLock.Unlock()
+	
+	// new version of zone, version is unique even if old version is left in persistent cache by last process
+	origin = dns.Fqdn(origin)
+	version := time.Now().UnixNano()
+	if version <= ds.zoneTable.lastVersion {
+		version = ds.zoneTable.lastVersion + 1
+	}
+	ds.zoneTable.lastVersion = version
+	zone := &dnsZone{origin: origin, key: ds.getKey(origin)}
+	zone.prefix = getZoneOriginPrefix(zone.key) + strconv.FormatInt(version, 36) + dnsZoneKeySep
+	
+	var soa *dns.SOA
+	cacheRecord := make(map[string]map[uint16][]dns.RR)
+	for _, rr := range rrList {
+		name := rr.Header().Name
+		if record, isSOA := rr.(*dns.SOA); isSOA {
+			soa = record
+		}
+		cacheKey := ds.getZoneCacheKey(zone, name)
+		if _, exists := cacheRecord[cacheKey]; !exists {
+			cacheRecord[cacheKey] = make(map[uint16][]dns.RR)
+		}
+		cacheRecord[cacheKey][rr.Header().Rrtype] = append(cacheRecord[cacheKey][rr.Header().Rrtype], rr)
+		
+		// empty non-terminal between record and zone apex: exists, but no record (NODATA instead of NXDOMAIN)
+		labels := dns.SplitDomainName(name)
+		for i := 1; i < len(labels) && dns.IsSubDomain(origin, dns.Fqdn(strings.Join(labels[i:], "."))); i++ {
+			parentKey := ds.getZoneCacheKey(zone, dns.Fqdn(strings.Join(labels[i:], ".")))
+			if _, exists := cacheRecord[parentKey]; !exists {
+				cacheRecord[parentKey] = make(map[uint16][]dns.RR)
+			}
+		}
+	}
+	if soa == nil {
+		return fmt.Errorf("SOA record not found in zone[%s]", origin)
+	}
+	zone.soa = soa
+	
+	// save new version first, then switch zone table to it, so that query gets either old or new version;
+	// old version is deleted at last
+	if err := ds.setBatchValue(ds.zoneCache, cacheRecord, LongLiveDNSTTL, false); err != nil {
+		return fmt.Errorf("fail to save zone record: %s", err)
+	}
+	ds.zoneTable.lock.Lock()
+	ds.zoneTable.zoneMap[zone.key] = zone
+	ds.zoneTable.lock.Unlock()
+	
+	oldCacheKeyList, err := ds.getZoneKeyList(zone.key, zone.prefix)
+	if err != nil {
+		return fmt.Errorf("fail to scan old zone record: %s", err)
+	}
+	if len(oldCacheKeyList) > 0 {
+		if err := ds.zoneCache.BatchDelete(oldCacheKeyList); err != nil {
+			return fmt.Errorf("fail to delete old zone record: %s", err)
+		}
+	}
+	ds.logger.Infof("success to load zone[%s], %d record, %d name\n", origin, len(rrList), len(cacheRecord))
+	return nil
+}
+
+// RemoveZone stops answering for the zone and deletes its records
+func (ds *DNSSimpleServer) RemoveZone(origin string) error {
+	ds.zoneTable.loadLock.Lock()
+	defer ds.zoneTable.loadLock.Unlock()
+	
+	zoneKey := ds.getKey(dns.Fqdn(origin))
+	ds.zoneTable.lock.Lock()
+	delete(ds.zoneTable.zoneMap, zoneKey)
+	ds.zoneTable.lock.Unlock()
+	
+	zoneKeyList, err := ds.getZoneKeyList(zoneKey, "")
+	if err != nil || len(zoneKeyList) == 0 {
+		return err
+	}
+	return ds.zoneCache.BatchDelete(zoneKeyList)
+}
+
+// the closest zone which contains domain
+func (ds *DNSSimpleServer) findZone(domain string) *dnsZone {
+	key := ds.getKey(domain)
+	ds.zoneTable.lock.RLock()
+	defer ds.zoneTable.lock.RUnlock()
+	
+	if len(ds.zoneTable.zoneMap) == 0 {
+		return nil
+	}
+	for len(key) > 0 {
+		if zone, exists := ds.zoneTable.zoneMap[key]; exists {
+			return zone
+		}
+		index := strings.LastIndex(key, ".")
+		if index < 0 {
+			break
+		}
+		key = key[:index]
+	}
+	if zone, exists := ds.zoneTable.zoneMap[""]; exists {
+		return zone
+	}
+	return nil
+}
+
+func (ds *DNSSimpleServer) getZoneRecord(cacheKey string) (map[uint16][]dns.RR, bool) {
+	result, err := ds.getResult(ds.zoneCache, cacheKey)
+	if err != nil {
+		return nil, false
+	}
+	typeRecord := make(map[uint16][]dns.RR, len(result))
+	for rType, cacheContent := range result {
+		typeRecord[rType] = cacheContent.Value
+	}
+	return typeRecord, true
+}
+
+// record of domain in zone; if domain not exists, wildcard of its closest encloser is used, ref: rfc4592
+func (ds *DNSSimpleServer) lookupZoneRecord(zone *dnsZone, domain string) (map[uint16][]dns.RR, bool) {
+	if typeRecord, exists := ds.getZoneRecord(ds.getZoneCacheKey(zone, domain)); exists {
+		return typeRecord, true
+	}
+	
+	labels := dns.SplitDomainName(domain)
+	for i := 1; i < len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !dns.IsSubDomain(zone.origin, encloser) {
+			break
+		}
+		if _, exists := ds.getZoneRecord(ds.getZoneCacheKey(zone, encloser)); !exists {
+			continue
+		}
+		typeRecord, exists := ds.getZoneRecord(ds.getZoneCacheKey(zone, "*."+encloser))
+		if !exists {
+			return nil, false
+		}
+		for _, rrList := range typeRecord {
+			for _, rr := range rrList {
+				rr.Header().Name = dns.Fqdn(domain)
+			}
+		}
+		return typeRecord, true
+	}
+	return nil, false
+}
+
+// SOA for authority section of negative answer, ttl is limited by SOA minimum, ref: rfc2308#section-3
+func (zone *dnsZone) getNegativeSOA() dns.RR {
+	soa := dns.Copy(zone.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// A/AAAA of NS, MX and SRV target in the same zone
+func (ds *DNSSimpleServer) getZoneAdditional(zone *dnsZone, answerList []dns.RR) []dns.RR {
+	var extraList []dns.RR
+	for _, rr := range answerList {
+		var target string
+		switch record := rr.(type) {
+		case *dns.NS:
+			target = record.Ns
+		case *dns.MX:
+			target = record.Mx
+		case *dns.SRV:
+			target = record.Target
+		}
+		if len(target) == 0 || !dns.IsSubDomain(zone.origin, target) {
+			continue
+		}
+		if typeRecord, exists := ds.getZoneRecord(ds.getZoneCacheKey(zone, target)); exists {
+			extraList = append(extraList, typeRecord[dns.TypeA]...)
+			extraList = append(extraList, typeRecord[dns.TypeAAAA]...)
+		}
+	}
+	return extraList
+}
+
+// answer question from local zone with AA bit; return false if question is not in any zone
+func (ds *DNSSimpleServer) answerFromZone(question *dns.Question, m *dns.Msg) bool {
+	zone := ds.findZone(question.Name)
+	if zone == nil {
+		return false
+	}
+	m.Authoritative = true
+	
+	typeRecord, exists := ds.lookupZoneRecord(zone, question.Name)
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, zone.getNegativeSOA())
+		return true
+	}
+	
+	var answerList []dns.RR
+	switch {
+	case question.Qtype == dns.TypeANY:
+		for _, rrList := range typeRecord {
+			answerList = append(answerList, rrList...)
+		}
+	case len(typeRecord[question.Qtype]) > 0:
+		answerList = typeRecord[question.Qtype]
+	default:
+		answerList = typeRecord[dns.TypeCNAME]
+	}
+	if len(answerList) == 0 {
+		// NODATA
+		m.Ns = append(m.Ns, zone.getNegativeSOA())
+		return true
+	}
+	m.Answer = append(m.Answer, answerList...)
+	m.Extra = append(m.Extra, ds.getZoneAdditional(zone, answerList)...)
+	return true
+}
@@ -0,0 +1,162 @@
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+const testZoneContent = `$ORIGIN example.lan.
+$TTL 3600
+@ IN SOA ns.example.lan. admin.example.lan. 1 7200 3600 1209600 300
+@ IN NS ns
+@ IN MX 10 mail
+ns IN A 10.0.0.1
+mail IN A 10.0.0.2
+www IN CNAME web
+web IN A 10.0.0.3
+remote IN CNAME www.remote.test.
+a.b.deep IN A 10.0.0.4
+*.wild IN A 10.0.0.5
+sub IN NS ns.sub
+ns.sub IN A 10.0.0.6
+`
+
+const testSubZoneContent = `$ORIGIN sub.example.lan.
+@ 3600 IN SOA ns.sub.example.lan. admin.example.lan. 1 7200 3600 1209600 60
+@ 3600 IN NS ns
+ns 3600 IN A 10.0.1.1
+`
+
+func TestAnswerFromZone(t *testing.T) {
+	upstream := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A: []byte{10, 1, 0, 1}})
+		w.WriteMsg(m)
+	})
+	ds := newTestServer(t, DNSSimpleServerOptions{RemoteList: []string{upstream}})
+	// child zone is loaded first, so that glue of parent zone would overwrite it if they share keyspace
+	if err := ds.LoadZoneFile(writeTestFile(t, testSubZoneContent), "sub.example.lan"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.LoadZoneFile(writeTestFile(t, testZoneContent), ""); err != nil {
+		t.Fatal(err)
+	}
+	
+	testCases := []struct {
+		name   string
+		qType  uint16
+		rcode  int
+		aa     bool
+		answer []string
+		// type of authority record
+		ns    uint16
+		extra int
+	}{
+		{name: "ns.example.lan", qType: dns.TypeA, aa: true, answer: []string{"10.0.0.1"}},
+		{name: "example.lan", qType: dns.TypeMX, aa: true, answer: []string{"10 mail.example.lan."}, extra: 1},
+		{name: "www.example.lan", qType: dns.TypeA, aa: true, answer: []string{"web.example.lan.", "10.0.0.3"}},
+		// CNAME target out of zone is answered by remote server, which is not authoritative
+		{name: "remote.example.lan", qType: dns.TypeA, answer: []string{"www.remote.test.", "10.1.0.1"}},
+		{name: "web.example.lan", qType: dns.TypeAAAA, aa: true, ns: dns.TypeSOA},
+		{name: "deep.example.lan", qType: dns.TypeA, aa: true, ns: dns.TypeSOA},
+		{name: "none.example.lan", qType: dns.TypeA, rcode: dns.RcodeNameError, aa: true, ns: dns.TypeSOA},
+		{name: "x.wild.example.lan", qType: dns.TypeA, aa: true, answer: []string{"10.0.0.5"}},
+		// the most specific zone is used: glue in parent zone is not the answer of child zone
+		{name: "ns.sub.example.lan", qType: dns.TypeA, aa: true, answer: []string{"10.0.1.1"}},
+		{name: "none.sub.example.lan", qType: dns.TypeA, rcode: dns.RcodeNameError, aa: true, ns: dns.TypeSOA},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name+"/"+dns.TypeToString[testCase.qType], func(t *testing.T) {
+			m := queryTestServer(t, ds, testCase.name, testCase.qType)
+			if m.Rcode != testCase.rcode || m.Authoritative != testCase.aa {
+				t.Fatalf("rcode is %s, aa is %v: %s", dns.RcodeToString[m.Rcode], m.Authoritative, m)
+			}
+			answerList := getTestAnswer(m)
+			if len(answerList) != len(testCase.answer) {
+				t.Fatalf("answer is %v, expected %v", answerList, testCase.answer)
+			}
+			for i := range answerList {
+				if answerList[i] != testCase.answer[i] {
+					t.Errorf("answer is %v, expected %v", answerList, testCase.answer)
+				}
+			}
+			if testCase.ns > 0 && (len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != testCase.ns) {
+				t.Errorf("authority is %v", m.Ns)
+			}
+			if len(m.Extra) < testCase.extra {
+				t.Errorf("additional is %v", m.Extra)
+			}
+		})
+	}
+	
+	// negative ttl is limited by SOA minimum
+	if m := queryTestServer(t, ds, "none.sub.example.lan", dns.TypeA); m.Ns[0].Header().Ttl != 60 {
+		t.Errorf("ttl of negative SOA is %d", m.Ns[0].Header().Ttl)
+	}
+}
+
+func TestUpdateZoneRecordReload(t *testing.T) {
+	ds := newTestServer(t, DNSSimpleServerOptions{})
+	zoneFile := writeTestFile(t, testZoneContent)
+	if err := ds.LoadZoneFile(zoneFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	oldCount, err := ds.zoneCache.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// reload: new record is answered, and removed record is NXDOMAIN
+	newContent := `$ORIGIN example.lan.
+@ 3600 IN SOA ns.example.lan. admin.example.lan. 2 7200 3600 1209600 300
+ns 3600 IN A 10.0.0.10
+new 3600 IN A 10.0.0.11
+`
+	if err := ds.LoadZoneFile(writeTestFile(t, newContent), "example.lan"); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name   string
+		rcode  int
+		answer string
+	}{
+		{name: "ns.example.lan", answer: "10.0.0.10"},
+		{name: "new.example.lan", answer: "10.0.0.11"},
+		{name: "web.example.lan", rcode: dns.RcodeNameError},
+		{name: "x.wild.example.lan", rcode: dns.RcodeNameError},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := queryTestServer(t, ds, testCase.name, dns.TypeA)
+			answerList := getTestAnswer(m)
+			if m.Rcode != testCase.rcode || len(testCase.answer) > 0 && (len(answerList) != 1 || answerList[0] != testCase.answer) {
+				t.Errorf("rcode is %s, answer is %v", dns.RcodeToString[m.Rcode], answerList)
+			}
+		})
+	}
+	
+	// old version of zone is deleted: apex, ns and new
+	if count, err := ds.zoneCache.Len(); err != nil || count != 3 || count >= oldCount {
+		t.Errorf("zone record is %d, old record is %d, error is %v", count, oldCount, err)
+	}
+	
+	// reload with invalid file keeps the old version
+	if err := ds.LoadZoneFile(writeTestFile(t, "bad"), "example.lan"); err == nil {
+		t.Error("expected error of invalid zone file")
+	}
+	if answerList := getTestAnswer(queryTestServer(t, ds, "new.example.lan", dns.TypeA)); len(answerList) != 1 {
+		t.Errorf("answer after invalid reload is %v", answerList)
+	}
+	
+	if err := ds.RemoveZone("example.lan"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := ds.zoneCache.Len(); err != nil || count != 0 {
+		t.Errorf("zone record after remove is %d, error is %v", count, err)
+	}
+	if m := queryTestServer(t, ds, "new.example.lan", dns.TypeA); m.Authoritative {
+		t.Errorf("answer of removed zone is authoritative: %s", m)
+	}
+}
@@ -15,8 +15,15 @@ type HostDNSUtil struct {
 	uri                   string
 	hostFile              string
 	refresh               time.Duration
-	hostRecordTriggerList []func(map[string]string)
-	hostFileTriggerList   []func(string)
+	hostRecordTriggerList      []func(map[string]string)
+	hostRecordMultiTriggerList []func(map[string][]string)
+	hostFileTriggerList        []func(string)
+	stopChan                   chan struct{}
+}
+
+// NewHostDNSUtil: download uri to hostFile every refresh time, and notify triggers if changed; call Start to run
+func NewHostDNSUtil(uri, hostFile string, refreshTime time.Duration) *HostDNSUtil {
+	return &HostDNSUtil{uri: uri, refresh: refreshTime, hostFile: hostFile, hostRecordTriggerList: []func(map[string]string){}, stopChan: make(chan struct{})}
 }
 
 func (util *HostDNSUtil) updateHost() {
@@ -43,26 +50,48 @@ func (util *HostDNSUtil) updateHost() {
 			}
 		}
 		
-		// deal with new host record
-		hostIPRecord, hostErr := common.ParseHostFile(util.hostFile)
-		if hostErr == nil && len(util.hostRecordTriggerList) > 0 {
-			for _, handler := range util.hostRecordTriggerList {
-				tmpHostIPRecord := make(map[string]string, len(hostIPRecord))
-				for key, value := range hostIPRecord {
-					tmpHostIPRecord[key] = value
+		// deal with new host record: file of other format, like adblock list, is only parsed by its file trigger
+		if len(util.hostRecordTriggerList) > 0 {
+			hostIPRecord, hostErr := common.ParseHostFile(util.hostFile)
+			if hostErr == nil {
+				for _, handler := range util.hostRecordTriggerList {
+					tmpHostIPRecord := make(map[string]string, len(hostIPRecord))
+					for key, value := range hostIPRecord {
+						tmpHostIPRecord[key] = value
+					}
+					handler(tmpHostIPRecord)
+				}
+			}
+		}
+		if len(util.hostRecordMultiTriggerList) > 0 {
+			hostIPRecord, hostErr := common.ParseHostFileMulti(util.hostFile)
+			if hostErr == nil {
+				for _, handler := range util.hostRecordMultiTriggerList {
+					tmpHostIPRecord := make(map[string][]string, len(hostIPRecord))
+					for key, value := range hostIPRecord {
+						tmpHostIPRecord[key] = append([]string{}, value...)
+					}
+					handler(tmpHostIPRecord)
 				}
-				handler(tmpHostIPRecord)
 			}
 		}
 	}
 }
 
+// AddHostRecordUpdateTrigger: handler gets host => ip of the last line of host
 func (util *HostDNSUtil) AddHostRecordUpdateTrigger(callbackHandler func(map[string]string)) {
 	if callbackHandler != nil {
 		util.hostRecordTriggerList = append(util.hostRecordTriggerList, callbackHandler)
 	}
 }
 
+// AddHostRecordMultiUpdateTrigger: handler gets host => all ip of host
+func (util *HostDNSUtil) AddHostRecordMultiUpdateTrigger(callbackHandler func(map[string][]string)) {
+	if callbackHandler != nil {
+		util.hostRecordMultiTriggerList = append(util.hostRecordMultiTriggerList, callbackHandler)
+	}
+}
+
 func (util *HostDNSUtil) AddHostFileUpdateTrigger(callbackHandler func(string)) {
 	if callbackHandler != nil {
 		util.hostFileTriggerList = append(util.hostFileTriggerList, callbackHandler)
@@ -72,13 +101,34 @@ func (util *HostDNSUtil) AddHostFileUpdateTrigger(callbackHandler func(string))
 func (util *HostDNSUtil) loopRefresh() {
 	for {
 		util.updateHost()
-		time.Sleep(util.refresh)
+		select {
+		case <-util.stopChan:
+			return
+		case <-time.After(util.refresh):
+		}
 	}
 }
 
+func (util *HostDNSUtil) Start() {
+	go util.loopRefresh()
+}
+
+// Stop refresh worker started by Start
+func (util *HostDNSUtil) Stop() {
+	select {
+	case <-util.stopChan:
+	default:
+		close(util.stopChan)
+	}
+}
+
+func (util *HostDNSUtil) GetHostFile() string {
+	return util.hostFile
+}
+
 func StartHostFileRefreshWorker(uri string, refreshTime time.Duration) {
 	if hostDNSUtil == nil {
-		hostDNSUtil = &HostDNSUtil{uri: uri, refresh: refreshTime, hostFile: GetLogPath("tmp.hosts.log"), hostRecordTriggerList: []func(map[string]string){}}
+		hostDNSUtil = NewHostDNSUtil(uri, GetLogPath("tmp.hosts.log"), refreshTime)
 	}
 	go hostDNSUtil.loopRefresh()
 }
@@ -90,6 +140,13 @@ func AddHostRecordUpdateTrigger(callbackHandler func(map[string]string)) {
 	hostDNSUtil.AddHostRecordUpdateTrigger(callbackHandler)
 }
 
+func AddHostRecordMultiUpdateTrigger(callbackHandler func(map[string][]string)) {
+	if hostDNSUtil == nil {
+		logger.Fatalf("hostDNSUtil not exist now!")
+	}
+	hostDNSUtil.AddHostRecordMultiUpdateTrigger(callbackHandler)
+}
+
 func AddHostFileUpdateTrigger(callbackHandler func(string)) {
 	if hostDNSUtil == nil {
 		logger.Fatalf("hostDNSUtil not exist now!")